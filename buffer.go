@@ -17,8 +17,14 @@ func (s *SequenceBuffer) Reset() {
 	resetSequenceBuffer(s.entries)
 }
 
+// RemoveRange removes the entries of all sequence numbers from start up to, but not including, end.
 func (s *SequenceBuffer) RemoveRange(start, end uint16) {
-	start, end = start%(uint16(cap(s.entries))+1), end%(uint16(cap(s.entries))+1)
+	if end-start >= uint16(cap(s.entries)) {
+		resetSequenceBuffer(s.entries)
+		return
+	}
+
+	start, end = start%uint16(cap(s.entries)), end%uint16(cap(s.entries))
 
 	if end < start {
 		resetSequenceBuffer(s.entries[start:])
@@ -20,6 +20,29 @@ func TestEmptySequenceBuffer(t *testing.T) {
 	}
 }
 
+func TestSequenceBufferRemoveRange(t *testing.T) {
+	s := NewPacketBuffer(256)
+
+	for seq := uint16(290); seq < 300; seq++ {
+		s.Insert(seq)
+	}
+
+	// Inserting a sequence number ahead of the latest should only remove the entries of the sequence numbers skipped.
+
+	s.Insert(302)
+
+	for seq := uint16(290); seq < 300; seq++ {
+		require.NotNil(t, s.Find(seq))
+	}
+	require.NotNil(t, s.Find(302))
+
+	s.Insert(302 + 1024)
+
+	for seq := uint16(290); seq < 300; seq++ {
+		require.Nil(t, s.Find(seq))
+	}
+}
+
 func TestSentPacketBuffer(t *testing.T) {
 	s := NewSentPacketBuffer(1024)
 
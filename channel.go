@@ -4,22 +4,150 @@ import (
 	"fmt"
 	"github.com/lithdew/bytesutil"
 	"github.com/valyala/bytebufferpool"
+	"sync"
 )
 
 var _ EndpointDispatcher = (*Channel)(nil)
 
+var messagePool sync.Pool
+
+// Size of the message ID that prefixes messages sent over reliable channels.
+const messageIDSize = 2
+
+// Number of packets that may be received since we last wrote a packet before an ACK is written. The ACKs of a packet
+// only cover the newest 32 sequence numbers received, and so packets that are received faster than we write packets
+// would otherwise never be ACK'ed.
+const ackEvery = 16
+
+// ChannelType denotes the delivery guarantees of messages sent over a channel.
+type ChannelType uint8
+
+const (
+	// ReliableOrdered channels retransmit messages until they are ACK'ed, and deliver them in order.
+	ReliableOrdered ChannelType = iota
+
+	// ReliableUnordered channels retransmit messages until they are ACK'ed, and deliver them as they arrive.
+	ReliableUnordered
+
+	// UnreliableSequenced channels send messages once, and drop messages older than the newest message received.
+	UnreliableSequenced
+
+	// Unreliable channels send messages once, and deliver them as they arrive.
+	Unreliable
+)
+
+func (t ChannelType) String() string {
+	switch t {
+	case ReliableOrdered:
+		return "reliable-ordered"
+	case ReliableUnordered:
+		return "reliable-unordered"
+	case UnreliableSequenced:
+		return "unreliable-sequenced"
+	case Unreliable:
+		return "unreliable"
+	default:
+		return fmt.Sprintf("ChannelType(%d)", uint8(t))
+	}
+}
+
+// reliable reports whether messages sent over channels of type t are retransmitted until they are ACK'ed.
+func (t ChannelType) reliable() bool {
+	return t == ReliableOrdered || t == ReliableUnordered
+}
+
+// MessageHandler handles a message received over the channel with the given ID. seq is as returned by Message.Seq.
+// buf is only valid until it returns.
+type MessageHandler func(channel uint8, seq uint16, buf []byte)
+
+// Message is a message received over a Channel. It must be released once it is no longer used.
+type Message struct {
+	channel uint8
+	seq     uint16
+	buf     *bytebufferpool.ByteBuffer
+	pool    *bytebufferpool.Pool
+}
+
+// Channel returns the ID of the channel this message was received over.
+func (m *Message) Channel() uint8 {
+	return m.channel
+}
+
+// Seq returns the ID of this message should it have been received over a reliable channel, or otherwise the sequence
+// number of the packet it was received in.
+func (m *Message) Seq() uint16 {
+	return m.seq
+}
+
+// Body returns the contents of this message. It is only valid until this message is released.
+func (m *Message) Body() []byte {
+	return m.buf.B
+}
+
+// Release returns the buffer backing this message to the pool of the channel it was received over.
+func (m *Message) Release() {
+	m.pool.Put(m.buf)
+	*m = Message{}
+	messagePool.Put(m)
+}
+
+// channelWrite is a message to be written over the channel with the given ID.
+type channelWrite struct {
+	channel uint8
+	buf     []byte
+}
+
+// queuedWrite is a copy of a message to be written over the channel with the given ID once the window of un-ACK'ed
+// packets has room for it.
+type queuedWrite struct {
+	channel uint8
+	buf     *bytebufferpool.ByteBuffer
+}
+
+// channelState is the state of a logical channel carried by a Channel.
+type channelState struct {
+	typ ChannelType
+
+	// Sequence number of the newest packet received over an unreliable-sequenced channel, and whether or not any
+	// packet has been received over it yet.
+	latest   uint16
+	received bool
+
+	// ID to assign to the next message sent over a reliable channel.
+	nextID uint16
+
+	// ID of the next message to be delivered over a reliable-ordered channel.
+	expectedID uint16
+
+	// Messages received over a reliable-ordered channel ahead of expectedID, keyed by message ID. Over a
+	// reliable-unordered channel, it instead marks the IDs of messages that have been delivered.
+	reorder *PacketBuffer
+}
+
+// Channel carries messages between two peers over one or more logical channels, each of a ChannelType configured by
+// Config.Channels. Messages are tagged with the ID of their channel, and all channels share the ACKs of a single
+// Endpoint. Only packets sent over reliable channels are retransmitted.
 type Channel struct {
 	endpoint *Endpoint
 	window   *PacketBuffer
+	channels []channelState
 
-	readQueue  chan []byte
-	writeQueue chan []byte
-	outQueue   chan []byte
+	// Handles received messages. Should it be nil, received messages are queued up to be read from Messages instead.
+	// It is called by Update, which is blocked until it returns.
+	Handler MessageHandler
 
-	queue []*bytebufferpool.ByteBuffer
+	readQueue    chan []byte
+	writeQueue   chan channelWrite
+	outQueue     chan []byte
+	messageQueue chan *Message
+
+	queue []queuedWrite
 
 	oldestUnacked uint16
 	lastSent      float64
+
+	// Number of packets received since we last wrote a packet.
+	received int
 }
 
 func NewChannel(config *Config) *Channel {
@@ -28,9 +156,23 @@ func NewChannel(config *Config) *Channel {
 	channel.endpoint = NewEndpoint(channel, config)
 	channel.window = NewPacketBuffer(uint16(channel.endpoint.config.SentPacketBufferSize))
 
+	types := channel.endpoint.config.Channels
+	if len(types) == 0 {
+		types = []ChannelType{ReliableOrdered}
+	}
+
+	channel.channels = make([]channelState, len(types))
+	for i, typ := range types {
+		channel.channels[i].typ = typ
+		if typ.reliable() {
+			channel.channels[i].reorder = NewPacketBuffer(uint16(channel.endpoint.config.RecvPacketBufferSize))
+		}
+	}
+
 	channel.readQueue = make(chan []byte, channel.endpoint.config.RecvPacketBufferSize)
-	channel.writeQueue = make(chan []byte, channel.endpoint.config.SentPacketBufferSize)
+	channel.writeQueue = make(chan channelWrite, channel.endpoint.config.SentPacketBufferSize)
 	channel.outQueue = make(chan []byte, channel.endpoint.config.SentPacketBufferSize)
+	channel.messageQueue = make(chan *Message, channel.endpoint.config.MessageQueueSize)
 
 	return channel
 }
@@ -39,136 +181,373 @@ func (c *Channel) Read(buf []byte) {
 	c.readQueue <- buf
 }
 
+// Write queues buf to be written over the default channel.
 func (c *Channel) Write(buf []byte) {
-	c.writeQueue <- buf
+	c.writeQueue <- channelWrite{buf: buf}
+}
+
+// WriteChannel queues buf to be written over the channel with the given ID.
+func (c *Channel) WriteChannel(channel uint8, buf []byte) error {
+	if int(channel) >= len(c.channels) {
+		return ErrUnknownChannel
+	}
+	c.writeQueue <- channelWrite{channel: channel, buf: buf}
+	return nil
 }
 
-func (c *Channel) Update(time float64) error {
+// Update processes received packets, writes queued messages, and retransmits un-ACK'ed packets. Packets that fail to
+// be processed are dropped without holding up the rest of the update, and the first such failure is returned once the
+// update has completed.
+func (c *Channel) Update(time float64) (err error) {
 	c.endpoint.Update(time)
 
 Reading:
 	for {
 		select {
 		case b := <-c.readQueue:
-			err := c.endpoint.ReadPacket(b)
-			if err != nil {
-				return fmt.Errorf("failed to receive packet: %w", err)
+			if readErr := c.endpoint.ReadPacket(b); readErr != nil && err == nil {
+				err = fmt.Errorf("failed to receive packet: %w", readErr)
+			}
+
+			c.received++
+			if c.received >= ackEvery {
+				c.endpoint.WritePacket(nil)
 			}
 		default:
 			break Reading
 		}
 	}
 
+	// Deliver messages held in reorder buffers that could not be delivered while the message queue was full.
+
+	for i := range c.channels {
+		if c.channels[i].typ == ReliableOrdered {
+			c.release(uint8(i))
+		}
+	}
+
 Writing:
 	for {
 		select {
-		case buf := <-c.writeQueue:
-			if c.oldestUnacked+uint16(c.endpoint.config.RecvPacketBufferSize) == c.endpoint.seq {
+		case w := <-c.writeQueue:
+			// Should the window of un-ACK'ed packets be full, queue up messages sent over reliable channels to be
+			// written once it has room, and drop messages sent over unreliable channels.
+
+			if len(c.queue) > 0 || c.full() {
+				if !c.channels[w.channel].typ.reliable() {
+					continue
+				}
+
 				b := c.endpoint.pool.Get()
-				b.B = bytesutil.ExtendSlice(b.B, len(buf))
-				copy(b.B, buf)
+				b.B = bytesutil.ExtendSlice(b.B, len(w.buf))
+				copy(b.B, w.buf)
 
-				c.queue = append(c.queue, b)
+				c.queue = append(c.queue, queuedWrite{channel: w.channel, buf: b})
 				continue
 			}
 
-			c.endpoint.WritePacket(buf)
+			c.writePacket(w.channel, w.buf)
 		default:
 			break Writing
 		}
 	}
 
-	// Write packets that have yet to be written, and also write packets that have yet to be ACK'ed after 0.1 seconds
-	// from the moment we originally wrote them.
-
-	max := c.oldestUnacked + uint16(c.endpoint.config.RecvPacketBufferSize)
+	// Retransmit messages that have yet to be ACK'ed after 0.1 seconds from the moment we last wrote them. They are
+	// written under a fresh sequence number, as our peer only ACKs the newest 32 sequence numbers it has received,
+	// and are deduplicated by our peer by their message ID. Messages are retransmitted in the order they were sent,
+	// such that the oldest un-ACK'ed message makes room for itself should the window be full.
 
-	for seq := c.oldestUnacked; seqLTE(seq, max); seq++ {
+	for seq, end := c.oldestUnacked, c.endpoint.Next(); seq != end; seq++ {
 		packet := c.window.Find(seq)
-		if packet == nil {
+		if packet == nil || time-packet.time < 0.1 {
 			continue
 		}
 
-		if packet.written && time-packet.time < 0.1 {
-			continue
+		if len(c.outQueue) == cap(c.outQueue) || (c.full() && seq != c.oldestUnacked) {
+			break
 		}
 
-		packet.written = true
-		packet.time = time
-
-		c.lastSent = time
+		channel, buf := packet.channel, packet.buf
 
-		c.outQueue <- packet.buf.B
+		c.window.Remove(seq)
+		c.send(channel, buf)
 	}
 
-	if time-c.lastSent >= 0.1 {
+	// Write a heartbeat should we not have written a packet for 0.1 seconds, or should packets we have received have
+	// yet to be ACK'ed.
+
+	if time-c.lastSent >= 0.1 || c.received > 0 {
 		c.endpoint.WritePacket(nil)
 	}
 
-	return nil
+	return err
 }
 
-func (c *Channel) Out() <-chan []byte {
-	return c.outQueue
-}
+// writePacket writes buf over the channel with the given ID. Messages sent over reliable channels are prefixed with
+// a message ID such that our peer may deliver them in order and drop duplicates.
+func (c *Channel) writePacket(channel uint8, buf []byte) {
+	state := &c.channels[channel]
+
+	if !state.typ.reliable() {
+		c.endpoint.WriteChannelPacket(channel, buf)
+		return
+	}
 
-func (c *Channel) Transmit(seq uint16, buf []byte) {
 	b := c.endpoint.pool.Get()
-	b.B = bytesutil.ExtendSlice(b.B, len(buf))
-	copy(b.B, buf)
+	b.B = bytesutil.AppendUint16BE(b.B[:0], state.nextID)
+	b.B = append(b.B, buf...)
+
+	state.nextID++
+
+	c.send(channel, b)
+}
+
+// send writes a message prefixed with its message ID over the reliable channel with the given ID, and tracks it in
+// the window of un-ACK'ed packets under the sequence number it was written with until that sequence number is
+// ACK'ed. The window takes ownership of buf.
+func (c *Channel) send(channel uint8, buf *bytebufferpool.ByteBuffer) {
+	seq := c.endpoint.Next()
+
+	if c.endpoint.WriteChannelPacket(channel, buf.B) == 0 {
+		c.endpoint.pool.Put(buf)
+		return
+	}
 
 	packet := c.window.Insert(seq)
 	packet.Reset()
-	packet.buf = b
+
+	packet.time = c.endpoint.time
+	packet.channel = channel
+	packet.buf = buf
 }
 
-func (c *Channel) Process(seq uint16, data []byte) {
-	fmt.Printf("[sequence number: %d, content: %q]\n", seq, string(data))
+func (c *Channel) Out() <-chan []byte {
+	return c.outQueue
 }
 
-func (c *Channel) ACK(seq uint16) {
-	packet := c.window.Find(seq)
-	if packet == nil {
-		return
+// Transmit writes packets immediately, and drops them should the queue of packets to be written be full. Messages
+// sent over reliable channels are tracked by writePacket, and retransmitted by Update until they are ACK'ed.
+func (c *Channel) Transmit(_ uint8, _ uint16, buf []byte) {
+	c.out(buf)
+}
+
+// out queues a copy of buf to be written without blocking, as buf is only valid until Transmit returns. It reports
+// false should the queue of packets to be written be full.
+func (c *Channel) out(buf []byte) bool {
+	packet := make([]byte, len(buf))
+	copy(packet, buf)
+
+	select {
+	case c.outQueue <- packet:
+		c.lastSent = c.endpoint.time
+		c.received = 0
+		return true
+	default:
+		return false
 	}
+}
 
-	c.window.Remove(seq)
-	c.endpoint.pool.Put(packet.buf)
+// Messages returns the queue of received messages, in the order they were processed. It is only used should Handler
+// be nil. Messages read from the queue must be released.
+func (c *Channel) Messages() <-chan *Message {
+	return c.messageQueue
+}
 
-	if seq != c.oldestUnacked {
-		return
+// Process delivers the contents of a received packet to Handler, or queues it up to be read from Messages. Should
+// the queue be full, packets received over reliable-ordered channels are held in a reorder buffer until the
+// application has caught up, packets received over reliable-unordered channels are left un-ACK'ed such that our peer
+// retransmits them, and packets received over unreliable channels are dropped. Empty packets are heartbeats, and are
+// not delivered. Packets received over unknown channels are dropped.
+//
+// Messages received over reliable channels are delivered at most once. Over reliable-ordered channels, messages
+// received ahead of the next message to be delivered are held in a reorder buffer until all messages before them
+// have been delivered.
+func (c *Channel) Process(channel uint8, seq uint16, data []byte) bool {
+	if len(data) == 0 || int(channel) >= len(c.channels) {
+		return true
 	}
 
-	// Find the next oldest un-ACK'ed packet sequence number.
+	state := &c.channels[channel]
 
-	oldestUnacked := c.oldestUnacked
+	switch state.typ {
+	case ReliableOrdered:
+		return c.processOrdered(channel, data)
+	case ReliableUnordered:
+		return c.processUnordered(channel, data)
+	case UnreliableSequenced:
+		// Drop packets that are older than the newest packet received.
 
-	updated, max := false, oldestUnacked+uint16(c.endpoint.config.RecvPacketBufferSize)
+		if state.received && !seqGreaterThan(seq, state.latest) {
+			return true
+		}
+		state.latest, state.received = seq, true
+	}
 
-	for seq := oldestUnacked + 1; seqLTE(seq, max); seq++ {
-		packet := c.window.Find(seq)
-		if packet == nil {
-			continue
+	c.deliver(channel, seq, data)
+
+	return true
+}
+
+func (c *Channel) processOrdered(channel uint8, data []byte) bool {
+	id, data, ok := unmarshalMessageID(data)
+	if !ok {
+		return true
+	}
+
+	state := &c.channels[channel]
+
+	// Drop messages that have already been delivered.
+
+	if seqLessThan(id, state.expectedID) {
+		return true
+	}
+
+	// Drop messages that are already held in the reorder buffer.
+
+	if state.reorder.Find(id) != nil {
+		return true
+	}
+
+	// Deliver the next expected message, followed by any messages held in the reorder buffer that follow it. Should
+	// the message queue be full, the next expected message is held in the reorder buffer instead, and is delivered by
+	// Update once the application has caught up.
+
+	if id == state.expectedID && c.deliver(channel, id, data) {
+		state.expectedID++
+		c.release(channel)
+
+		return true
+	}
+
+	// Leave messages that are too far ahead to be held in the reorder buffer un-ACK'ed, such that our peer
+	// retransmits them once there is room for them.
+
+	if id-state.expectedID >= uint16(cap(state.reorder.entries)) {
+		return false
+	}
+
+	entry := state.reorder.Insert(id)
+	if entry == nil {
+		return false
+	}
+
+	entry.Reset()
+	entry.buf = c.endpoint.pool.Get()
+	entry.buf.B = append(entry.buf.B[:0], data...)
+
+	return true
+}
+
+// release delivers messages held in the reorder buffer of a reliable-ordered channel for as long as the next expected
+// message is held, and may be delivered.
+func (c *Channel) release(channel uint8) {
+	state := &c.channels[channel]
+
+	for {
+		entry := state.reorder.Find(state.expectedID)
+		if entry == nil || !c.deliver(channel, state.expectedID, entry.buf.B) {
+			return
 		}
 
-		c.oldestUnacked, updated = seq, true
-		break
+		state.reorder.Remove(state.expectedID)
+		c.endpoint.pool.Put(entry.buf)
+
+		state.expectedID++
+	}
+}
+
+func (c *Channel) processUnordered(channel uint8, data []byte) bool {
+	id, data, ok := unmarshalMessageID(data)
+	if !ok {
+		return true
 	}
 
-	// If the oldest ACK was not updated, set the oldest ACK to be the latest sent packet sequence number.
+	state := &c.channels[channel]
+
+	// Drop messages that have already been delivered.
 
-	if !updated {
-		c.oldestUnacked = max
+	if state.reorder.IsOutdated(id) || state.reorder.Find(id) != nil {
+		return true
 	}
 
-	// Send packets that were previously queued up due to the oldest un-ACK'ed packet.
+	if !c.deliver(channel, id, data) {
+		return false
+	}
+
+	state.reorder.Insert(id).Reset()
+
+	return true
+}
+
+// deliver hands a message to Handler, or queues it up to be read from Messages. It reports false should the queue
+// be full.
+func (c *Channel) deliver(channel uint8, seq uint16, data []byte) bool {
+	if c.Handler != nil {
+		c.Handler(channel, seq, data)
+		return true
+	}
 
-	diff := c.oldestUnacked - oldestUnacked
+	if len(c.messageQueue) == cap(c.messageQueue) {
+		return false
+	}
+
+	msg := acquireMessage(channel, seq, &c.endpoint.pool)
+	msg.buf.B = append(msg.buf.B[:0], data...)
+
+	c.messageQueue <- msg
+
+	return true
+}
+
+func unmarshalMessageID(buf []byte) (uint16, []byte, bool) {
+	if len(buf) < messageIDSize {
+		return 0, buf, false
+	}
+	return bytesutil.Uint16BE(buf[:messageIDSize]), buf[messageIDSize:], true
+}
+
+func acquireMessage(channel uint8, seq uint16, pool *bytebufferpool.Pool) *Message {
+	msg, _ := messagePool.Get().(*Message)
+	if msg == nil {
+		msg = new(Message)
+	}
 
-	for i := uint16(0); len(c.queue) > 0 && i < diff; i++ {
+	msg.channel = channel
+	msg.seq = seq
+	msg.buf = pool.Get()
+	msg.pool = pool
+
+	return msg
+}
+
+func (c *Channel) ACK(seq uint16) {
+	packet := c.window.Find(seq)
+	if packet == nil {
+		return
+	}
+
+	c.window.Remove(seq)
+	c.endpoint.pool.Put(packet.buf)
+
+	// Send packets that were previously queued up due to the oldest un-ACK'ed packet.
+
+	for len(c.queue) > 0 && !c.full() {
 		popped := c.queue[0]
 		c.queue = c.queue[1:]
-		c.endpoint.WritePacket(popped.B)
-		c.endpoint.pool.Put(popped)
+		c.writePacket(popped.channel, popped.buf.B)
+		c.endpoint.pool.Put(popped.buf)
 	}
 }
+
+// full reports whether the window of un-ACK'ed packets is full, in which case no more packets may be written until
+// the oldest un-ACK'ed packet is ACK'ed.
+func (c *Channel) full() bool {
+	// Find the oldest un-ACK'ed packet sequence number. Packets sent over unreliable channels are never tracked, and
+	// thus never hold up the window. Should there be no un-ACK'ed packets, it is the next sequence number to be sent.
+
+	for c.oldestUnacked != c.endpoint.seq && c.window.Find(c.oldestUnacked) == nil {
+		c.oldestUnacked++
+	}
+
+	return c.endpoint.seq-c.oldestUnacked >= uint16(c.endpoint.config.RecvPacketBufferSize)
+}
@@ -60,3 +60,386 @@ func TestChannelEmptyQueue(t *testing.T) {
 	require.Len(t, channel.queue, 0)
 	require.EqualValues(t, channel.window.buf.latest, channel.endpoint.config.RecvPacketBufferSize+1)
 }
+
+// transmit feeds all packets sent by src to dst.
+func transmit(t *testing.T, src, dst *Channel) {
+	t.Helper()
+
+	for len(src.Out()) > 0 {
+		dst.Read(<-src.Out())
+	}
+}
+
+func TestChannelMessageQueue(t *testing.T) {
+	config := NewConfig()
+	config.MessageQueueSize = 4
+	config.Channels = []ChannelType{ReliableUnordered}
+
+	client, server := NewChannel(config), NewChannel(config)
+
+	for i := uint(0); i < server.endpoint.config.MessageQueueSize+1; i++ {
+		client.Write([]byte{byte(i)})
+	}
+
+	require.NoError(t, client.Update(0))
+	transmit(t, client, server)
+	require.NoError(t, server.Update(0))
+
+	// Messages should be queued up in order, and the message that did not fit in the queue should not be ACK'ed.
+
+	require.Len(t, server.Messages(), int(server.endpoint.config.MessageQueueSize))
+	require.Nil(t, server.endpoint.recv.Find(uint16(server.endpoint.config.MessageQueueSize)))
+
+	for i := uint(0); i < server.endpoint.config.MessageQueueSize; i++ {
+		msg := <-server.Messages()
+		require.EqualValues(t, i, msg.Seq())
+		require.EqualValues(t, []byte{byte(i)}, msg.Body())
+		msg.Release()
+	}
+
+	// Have the server ACK the messages it queued up. The message that was not ACK'ed should be delivered once it is
+	// retransmitted.
+
+	server.Write([]byte("ack"))
+	require.NoError(t, server.Update(0))
+	transmit(t, server, client)
+
+	require.NoError(t, client.Update(1))
+	transmit(t, client, server)
+	require.NoError(t, server.Update(1))
+
+	require.Len(t, server.Messages(), 1)
+
+	msg := <-server.Messages()
+	require.EqualValues(t, []byte{byte(server.endpoint.config.MessageQueueSize)}, msg.Body())
+	msg.Release()
+}
+
+func TestChannelMessageQueueOrdered(t *testing.T) {
+	config := NewConfig()
+	config.MessageQueueSize = 4
+
+	client, server := NewChannel(nil), NewChannel(config)
+
+	for i := uint(0); i < server.endpoint.config.MessageQueueSize+1; i++ {
+		client.Write([]byte{byte(i)})
+	}
+
+	require.NoError(t, client.Update(0))
+	transmit(t, client, server)
+	require.NoError(t, server.Update(0))
+
+	// The message that did not fit in the queue should be ACK'ed, and held in the reorder buffer.
+
+	require.Len(t, server.Messages(), int(server.endpoint.config.MessageQueueSize))
+	require.NotNil(t, server.endpoint.recv.Find(uint16(server.endpoint.config.MessageQueueSize)))
+	require.NotNil(t, server.channels[0].reorder.Find(uint16(server.endpoint.config.MessageQueueSize)))
+
+	for i := uint(0); i < server.endpoint.config.MessageQueueSize; i++ {
+		msg := <-server.Messages()
+		require.EqualValues(t, i, msg.Seq())
+		msg.Release()
+	}
+
+	// The held message should be delivered on the next update without having to be retransmitted.
+
+	require.NoError(t, server.Update(0))
+	require.Len(t, server.Messages(), 1)
+
+	msg := <-server.Messages()
+	require.EqualValues(t, []byte{byte(server.endpoint.config.MessageQueueSize)}, msg.Body())
+	msg.Release()
+}
+
+func TestChannelMessageHandler(t *testing.T) {
+	client, server := NewChannel(nil), NewChannel(nil)
+
+	var received []string
+
+	server.Handler = func(_ uint8, seq uint16, buf []byte) {
+		received = append(received, string(buf))
+	}
+
+	client.Write([]byte("hello"))
+	client.Write([]byte("world"))
+
+	require.NoError(t, client.Update(0))
+	transmit(t, client, server)
+	require.NoError(t, server.Update(0))
+
+	require.EqualValues(t, []string{"hello", "world"}, received)
+	require.Len(t, server.Messages(), 0)
+}
+
+func TestChannelTypes(t *testing.T) {
+	config := NewConfig()
+	config.Channels = []ChannelType{ReliableOrdered, ReliableUnordered, UnreliableSequenced, Unreliable}
+
+	client, server := NewChannel(config), NewChannel(config)
+
+	received := make(map[uint8][]string)
+
+	server.Handler = func(channel uint8, _ uint16, buf []byte) {
+		received[channel] = append(received[channel], string(buf))
+	}
+
+	for channel := uint8(0); channel < 4; channel++ {
+		require.NoError(t, client.WriteChannel(channel, []byte("a")))
+		require.NoError(t, client.WriteChannel(channel, []byte("b")))
+	}
+
+	require.Equal(t, ErrUnknownChannel, client.WriteChannel(4, []byte("c")))
+
+	require.NoError(t, client.Update(0))
+
+	// Only packets sent over reliable channels should be tracked for retransmission.
+
+	require.Len(t, client.Out(), 8)
+	require.NotNil(t, client.window.Find(0))
+	require.NotNil(t, client.window.Find(3))
+	require.Nil(t, client.window.Find(4))
+	require.Nil(t, client.window.Find(7))
+
+	// Deliver the packets sent over the unreliable-sequenced channel out of order. Packets are written in the order
+	// they were sent.
+
+	packets := make([][]byte, 0, 8)
+	for len(client.Out()) > 0 {
+		packets = append(packets, <-client.Out())
+	}
+
+	packets[4], packets[5] = packets[5], packets[4]
+
+	for _, packet := range packets {
+		server.Read(packet)
+	}
+
+	require.NoError(t, server.Update(0))
+
+	require.EqualValues(t, []string{"a", "b"}, received[0])
+	require.EqualValues(t, []string{"a", "b"}, received[1])
+	require.EqualValues(t, []string{"b"}, received[2])
+	require.EqualValues(t, []string{"a", "b"}, received[3])
+
+	// ACKs for all channels should be shared.
+
+	server.Write([]byte("ack"))
+	require.NoError(t, server.Update(0))
+	transmit(t, server, client)
+	require.NoError(t, client.Update(1))
+
+	// Only a heartbeat should be written, as there are no un-ACK'ed packets left to be retransmitted.
+
+	require.Len(t, client.Out(), 1)
+
+	for seq := uint16(0); seq < 4; seq++ {
+		require.Nil(t, client.window.Find(seq))
+	}
+}
+
+func TestChannelUnreliableDoesNotHoldUpWindow(t *testing.T) {
+	config := NewConfig()
+	config.Channels = []ChannelType{ReliableOrdered, Unreliable}
+
+	channel := NewChannel(config)
+
+	// Packets sent over unreliable channels are never ACK'ed, and thus should not count towards the window of
+	// un-ACK'ed packets.
+
+	for i := 0; i < int(config.RecvPacketBufferSize)*2; i++ {
+		require.NoError(t, channel.WriteChannel(1, []byte("a")))
+		require.NoError(t, channel.Update(0))
+
+		for len(channel.Out()) > 0 {
+			<-channel.Out()
+		}
+	}
+
+	channel.Write([]byte("b"))
+	require.NoError(t, channel.Update(0))
+
+	require.Len(t, channel.queue, 0)
+	require.Len(t, channel.Out(), 1)
+}
+
+func TestChannelReorder(t *testing.T) {
+	config := NewConfig()
+	config.Channels = []ChannelType{ReliableOrdered, ReliableUnordered}
+
+	client, server := NewChannel(config), NewChannel(config)
+
+	received := make(map[uint8][]string)
+
+	server.Handler = func(channel uint8, _ uint16, buf []byte) {
+		received[channel] = append(received[channel], string(buf))
+	}
+
+	for channel := uint8(0); channel < 2; channel++ {
+		for _, msg := range []string{"a", "b", "c"} {
+			require.NoError(t, client.WriteChannel(channel, []byte(msg)))
+		}
+	}
+
+	require.NoError(t, client.Update(0))
+
+	packets := make([][]byte, 0, 6)
+	for len(client.Out()) > 0 {
+		packets = append(packets, <-client.Out())
+	}
+
+	// Deliver the packets of each channel out of order, and with duplicates.
+
+	for _, i := range []int{2, 0, 0, 2, 1, 5, 3, 5, 3, 4} {
+		server.Read(packets[i])
+	}
+
+	require.NoError(t, server.Update(0))
+
+	require.EqualValues(t, []string{"a", "b", "c"}, received[0])
+	require.EqualValues(t, []string{"c", "a", "b"}, received[1])
+
+	// Retransmissions of messages that have already been delivered should be dropped.
+
+	require.NoError(t, client.Update(1))
+	transmit(t, client, server)
+	require.NoError(t, server.Update(1))
+
+	require.Len(t, received[0], 3)
+	require.Len(t, received[1], 3)
+}
+
+func TestChannelReorderBackpressure(t *testing.T) {
+	config := NewConfig()
+	config.MessageQueueSize = 1
+
+	client, server := NewChannel(nil), NewChannel(config)
+
+	for _, msg := range []string{"a", "b", "c"} {
+		client.Write([]byte(msg))
+	}
+
+	require.NoError(t, client.Update(0))
+
+	packets := make([][]byte, 0, 3)
+	for len(client.Out()) > 0 {
+		packets = append(packets, <-client.Out())
+	}
+
+	// Messages held in the reorder buffer should be delivered once the application catches up.
+
+	for _, i := range []int{2, 1, 0} {
+		server.Read(packets[i])
+	}
+
+	require.NoError(t, server.Update(0))
+
+	for _, expected := range []string{"a", "b", "c"} {
+		require.Len(t, server.Messages(), 1)
+
+		msg := <-server.Messages()
+		require.EqualValues(t, expected, msg.Body())
+		msg.Release()
+
+		require.NoError(t, server.Update(0))
+	}
+
+	require.Len(t, server.Messages(), 0)
+}
+
+func TestChannelUpdateDropsBadPackets(t *testing.T) {
+	client, server := NewChannel(nil), NewChannel(nil)
+
+	client.Write([]byte("hello"))
+	require.NoError(t, client.Update(0))
+
+	// Malformed and stale packets should be dropped without holding up the rest of the update.
+
+	server.Read(nil)
+	server.Read([]byte{0xFF})
+	transmit(t, client, server)
+
+	server.Write([]byte("world"))
+	require.Error(t, server.Update(0))
+
+	require.Len(t, server.Messages(), 1)
+	require.Len(t, server.Out(), 1)
+}
+
+func TestChannelUpdateDoesNotBlockOnFullOutQueue(t *testing.T) {
+	channel := NewChannel(nil)
+
+	for i := uint(0); i < channel.endpoint.config.RecvPacketBufferSize; i++ {
+		channel.Write([]byte("a"))
+	}
+
+	require.NoError(t, channel.Update(0))
+	require.Len(t, channel.Out(), cap(channel.Out()))
+
+	// Retransmits should be deferred to a later update while the queue of packets to be written is full.
+
+	require.NoError(t, channel.Update(1))
+
+	// Packets handed out should be copies that are unaffected by the window of un-ACK'ed packets being ACK'ed.
+
+	packet := <-channel.Out()
+	expected := append([]byte(nil), packet...)
+
+	channel.ACK(0)
+	channel.Write([]byte("b"))
+	require.NoError(t, channel.Update(1))
+
+	require.EqualValues(t, expected, packet)
+}
+
+func TestChannelRetransmitUnderFreshSeq(t *testing.T) {
+	client, server := NewChannel(nil), NewChannel(nil)
+
+	client.Write([]byte("hello"))
+	require.NoError(t, client.Update(0))
+
+	// Drop the packet, and have it be retransmitted.
+
+	<-client.Out()
+
+	require.NoError(t, client.Update(1))
+	require.Nil(t, client.window.Find(0))
+	require.NotNil(t, client.window.Find(1))
+
+	transmit(t, client, server)
+	require.NoError(t, server.Update(1))
+
+	msg := <-server.Messages()
+	require.EqualValues(t, 0, msg.Seq())
+	require.EqualValues(t, "hello", msg.Body())
+	msg.Release()
+
+	// The retransmitted packet should be ACK'ed under its fresh sequence number.
+
+	server.Write([]byte("ack"))
+	require.NoError(t, server.Update(1))
+	transmit(t, server, client)
+	require.NoError(t, client.Update(1))
+
+	require.Nil(t, client.window.Find(1))
+}
+
+func TestChannelACKsBurst(t *testing.T) {
+	client, server := NewChannel(nil), NewChannel(nil)
+
+	// Packets received faster than the server writes packets should all be ACK'ed, despite the ACKs of a single
+	// packet only covering the newest 32 sequence numbers received.
+
+	for i := 0; i < 100; i++ {
+		client.Write([]byte{byte(i)})
+	}
+
+	require.NoError(t, client.Update(0))
+	transmit(t, client, server)
+	require.NoError(t, server.Update(0))
+	transmit(t, server, client)
+	require.NoError(t, client.Update(0))
+
+	for seq := uint16(0); seq < 100; seq++ {
+		require.Nil(t, client.window.Find(seq))
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/lithdew/sleepy"
 	"log"
-	"net"
 	"time"
 )
 
@@ -18,41 +17,16 @@ func check(err error) {
 	}
 }
 
-func now() float64 {
-	return float64(time.Now().UnixNano()) / (1000 * 1000 * 1000)
-}
-
-func update(c *sleepy.Channel) {
-	ticker := time.NewTicker(16 * time.Millisecond)
-	defer ticker.Stop()
-
-	tick := now()
-
-	for range ticker.C {
-		check(c.Update(tick))
-		tick += 16.0 / 1000
-	}
-}
+func read(c *sleepy.Conn) {
+	var buf []byte
 
-func read(c *sleepy.Channel, conn *net.UDPConn) {
 	for {
-		buf := make([]byte, 65536)
-
-		n, _, err := conn.ReadFrom(buf)
+		msg, err := c.ReadMessage(buf[:0])
 		check(err)
 
-		c.Read(buf[:n])
-	}
-}
-
-func write(c *sleepy.Channel, conn *net.UDPConn) {
-	for b := range c.Out() {
-		n, err := conn.WriteTo(b, conn.LocalAddr())
-		check(err)
+		fmt.Printf("[from: %s, content: %q]\n", c.RemoteAddr(), string(msg))
 
-		if n != len(b) {
-			check(fmt.Errorf("wrote only %d byte(s), but buf is %d byte(s)", n, len(b)))
-		}
+		buf = msg
 	}
 }
 
@@ -61,24 +35,26 @@ func main() {
 	flag.StringVar(&addr, "addr", ":4444", "address to listen/dial")
 	flag.Parse()
 
-	addr, err := net.ResolveUDPAddr("udp", addr)
-	check(err)
+	var (
+		c   *sleepy.Conn
+		err error
+	)
 
-	c := sleepy.NewChannel(nil)
+	if client {
+		c, err = sleepy.Dial(addr)
+	} else {
+		c, err = sleepy.Listen(addr)
+	}
+	check(err)
 
-	if !client {
-		conn, err := net.ListenUDP("udp", addr)
-		check(err)
+	defer c.Close()
 
-		go read(c, conn)
-		go write(c, conn)
-		go update(c)
+	go read(c)
 
-		ticker := time.NewTicker(1 * time.Second)
-		defer ticker.Stop()
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
 
-		for range ticker.C {
-			c.Write([]byte("hello!"))
-		}
+	for range ticker.C {
+		check(c.WriteMessage([]byte("hello!")))
 	}
 }
@@ -1,5 +1,11 @@
 package sleepy
 
+import "time"
+
+// DefaultTimeout is how long a Conn waits to complete its handshake, or to receive a packet from its connected peer,
+// before timing out.
+const DefaultTimeout = 5 * time.Second
+
 type Config struct {
 	FragmentAbove                uint
 	FragmentSize                 uint
@@ -10,6 +16,17 @@ type Config struct {
 	RecvPacketBufferSize         uint
 	FragmentReassemblyBufferSize uint
 
+	// Max number of received messages that may be queued up for the application to read.
+	MessageQueueSize uint
+
+	// Types of the logical channels carried by a connection, indexed by channel ID. Both peers must be configured
+	// with the same channels.
+	Channels []ChannelType
+
+	// Max duration a Conn waits to complete its handshake, or to receive a packet from its connected peer, before
+	// timing out.
+	Timeout time.Duration
+
 	RTTSmoothingFactor        float64
 	PacketLossSmoothingFactor float64
 	BandwidthSmoothingFactor  float64
@@ -25,6 +42,10 @@ func NewConfig() *Config {
 		SentPacketBufferSize:         256,
 		RecvPacketBufferSize:         256,
 		FragmentReassemblyBufferSize: 256,
+		MessageQueueSize:             256,
+
+		Channels: []ChannelType{ReliableOrdered},
+		Timeout:  DefaultTimeout,
 
 		RTTSmoothingFactor:        .0025,
 		PacketLossSmoothingFactor: .1,
@@ -0,0 +1,476 @@
+package sleepy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultUpdateInterval is how often a Conn updates its channel, which is when received packets are processed,
+// written messages are sent, and un-ACK'ed packets are retransmitted.
+const DefaultUpdateInterval = 16 * time.Millisecond
+
+// Max size of a UDP datagram.
+const maxDatagramSize = 65535
+
+// Conn is a connection to a single peer over a UDP socket. It owns the socket, and the goroutines that read packets
+// from the socket, write packets to the socket, and update its channel every DefaultUpdateInterval.
+//
+// Conns returned by Dial complete a challenge-response handshake with the address that was dialed before returning.
+// Conns returned by Listen complete a handshake with the first peer that echoes back the challenge token they were
+// sent, and drop packets from any other peer. Every packet is tagged with a session ID assigned by the listening
+// conn, and conns time out should their peer stop sending packets for Config.Timeout.
+type Conn struct {
+	conn       *net.UDPConn
+	dialed     bool
+	channel    *Channel
+	start      time.Time
+	timeout    time.Duration
+	challenger *challenger
+
+	// State of the connection. raddr is nil for listening conns until the handshake has completed, and token is the
+	// challenge token last received by a dialed conn that is connecting.
+	mu       sync.Mutex
+	raddr    *net.UDPAddr
+	state    ConnState
+	session  uint32
+	token    []byte
+	lastRecv time.Time
+	err      error
+
+	// When a handshake packet was last sent. It is only accessed by the update loop.
+	lastHandshake time.Time
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	// Closed once the handshake has completed, once c has been closed, timed out or disconnected by its peer, and
+	// once the update loop has stopped.
+	connected chan struct{}
+	done      chan struct{}
+	updated   chan struct{}
+
+	closeOnce    sync.Once
+	shutdownOnce sync.Once
+	wg           sync.WaitGroup
+}
+
+// Dial opens a UDP socket, and returns a Conn once it has completed its handshake with the peer at addr. It fails
+// with ErrConnTimedOut should the handshake not complete within DefaultTimeout.
+func Dial(addr string) (*Conn, error) {
+	return DialConfig(addr, nil)
+}
+
+// DialConfig is like Dial, though the returned Conn is configured by config. Should config be nil, NewConfig is used.
+func DialConfig(addr string, config *Config) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConn(conn, raddr, nil, config)
+
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		err := c.closeErr()
+		c.Close()
+		return nil, err
+	}
+}
+
+// Listen opens a UDP socket bound to addr, and returns a Conn that connects to the first peer to complete its
+// handshake with it.
+func Listen(addr string) (*Conn, error) {
+	return ListenConfig(addr, nil)
+}
+
+// ListenConfig is like Listen, though the returned Conn is configured by config. Should config be nil, NewConfig is
+// used.
+func ListenConfig(addr string, config *Config) (*Conn, error) {
+	challenger, err := newChallenger()
+	if err != nil {
+		return nil, err
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(conn, nil, challenger, config), nil
+}
+
+// newConn returns a Conn that owns conn. Dialed conns are given the address of their peer, and listening conns are
+// given a challenger to issue challenge tokens with instead.
+func newConn(conn *net.UDPConn, raddr *net.UDPAddr, challenger *challenger, config *Config) *Conn {
+	c := &Conn{
+		conn:       conn,
+		dialed:     challenger == nil,
+		channel:    NewChannel(config),
+		start:      time.Now(),
+		challenger: challenger,
+		raddr:      raddr,
+
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+		updated:   make(chan struct{}),
+	}
+
+	c.timeout = c.channel.endpoint.config.Timeout
+	if c.timeout <= 0 {
+		c.timeout = DefaultTimeout
+	}
+
+	c.wg.Add(3)
+
+	go c.readLoop()
+	go c.writeLoop()
+	go c.updateLoop()
+
+	return c
+}
+
+// ReadMessage blocks until a message is received from the peer over any channel, and appends it to dst. Should
+// messages not be read quickly enough, the peer retransmits messages sent over reliable channels until they may be
+// queued up again. It fails with an error whose Timeout method returns true should the read deadline be exceeded, with
+// ErrConnClosed should c be closed, with ErrPeerDisconnected should the peer have closed the connection, or with
+// ErrConnTimedOut should the connection have timed out.
+func (c *Conn) ReadMessage(dst []byte) ([]byte, error) {
+	_, dst, err := c.ReadChannelMessage(dst)
+	return dst, err
+}
+
+// ReadChannelMessage is like ReadMessage, though it also returns the ID of the channel the message was received over.
+func (c *Conn) ReadChannelMessage(dst []byte) (uint8, []byte, error) {
+	select {
+	case <-c.done:
+		return 0, dst, c.closeErr()
+	case <-c.readDeadline.wait():
+		return 0, dst, errTimeout
+	default:
+	}
+
+	select {
+	case <-c.done:
+		return 0, dst, c.closeErr()
+	case <-c.readDeadline.wait():
+		return 0, dst, errTimeout
+	case msg := <-c.channel.Messages():
+		channel := msg.Channel()
+		dst = append(dst, msg.Body()...)
+		msg.Release()
+		return channel, dst, nil
+	}
+}
+
+// WriteMessage queues a copy of buf to be sent to the peer over the default channel, blocking while the queue of
+// messages to be sent is full. It fails with an error whose Timeout method returns true should the write deadline be
+// exceeded, or with the same errors as ReadMessage should the connection be over. Empty messages may not be written,
+// as empty packets are sent as heartbeats.
+func (c *Conn) WriteMessage(buf []byte) error {
+	return c.WriteChannelMessage(0, buf)
+}
+
+// WriteChannelMessage is like WriteMessage, though buf is sent over the channel with the given ID.
+func (c *Conn) WriteChannelMessage(channel uint8, buf []byte) error {
+	if int(channel) >= len(c.channel.channels) {
+		return ErrUnknownChannel
+	}
+
+	if len(buf) == 0 {
+		return ErrEmptyMessage
+	}
+
+	if uint(len(buf)+messageIDSize) > c.channel.endpoint.config.MaxPacketSize {
+		return ErrMessageTooLarge
+	}
+
+	select {
+	case <-c.done:
+		return c.closeErr()
+	case <-c.writeDeadline.wait():
+		return errTimeout
+	default:
+	}
+
+	msg := make([]byte, len(buf))
+	copy(msg, buf)
+
+	select {
+	case <-c.done:
+		return c.closeErr()
+	case <-c.writeDeadline.wait():
+		return errTimeout
+	case c.channel.writeQueue <- channelWrite{channel: channel, buf: msg}:
+		return nil
+	}
+}
+
+// Close sends disconnect packets to the peer should c be connected, closes the UDP socket, and waits for all
+// goroutines owned by c to stop. Pending and subsequent reads and writes fail with ErrConnClosed, unless the
+// connection was already over.
+func (c *Conn) Close() error {
+	err := ErrConnClosed
+
+	c.closeOnce.Do(func() {
+		c.disconnect()
+		c.shutdown(StateDisconnected, ErrConnClosed)
+		err = nil
+	})
+
+	c.wg.Wait()
+
+	return err
+}
+
+// State returns the state of the connection.
+func (c *Conn) State() ConnState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer. It returns nil should c have been returned by Listen, and should no
+// peer have completed its handshake yet.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.raddr == nil {
+		return nil
+	}
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// readLoop reads packets from the socket, and handles them until the socket is closed. Packets carrying a payload
+// are queued to be processed by the channel.
+func (c *Conn) readLoop() {
+	defer c.wg.Done()
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, addr, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if isEOF(err) {
+				return
+			}
+
+			// Errors such as ICMP port unreachable messages being reported by the socket are transient.
+
+			continue
+		}
+
+		kind, session, payload, err := unmarshalConnHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		if c.dialed {
+			c.handleClientPacket(kind, session, payload)
+		} else {
+			c.handleServerPacket(addr, kind, session, payload)
+		}
+	}
+}
+
+// feed queues a copy of a payload received from the peer to be processed by the channel.
+func (c *Conn) feed(payload []byte) {
+	packet := make([]byte, len(payload))
+	copy(packet, payload)
+
+	select {
+	case c.channel.readQueue <- packet:
+	case <-c.done:
+	}
+}
+
+// writeLoop writes packets sent by the channel to the socket until the update loop has stopped, such that the update
+// loop is never left blocked on sending a packet. Packets are tagged with the session ID of the connection, and are
+// dropped while c is not connected.
+func (c *Conn) writeLoop() {
+	defer c.wg.Done()
+
+	packet := make([]byte, 0, maxDatagramSize)
+
+	for {
+		select {
+		case buf := <-c.channel.Out():
+			c.mu.Lock()
+			state, raddr, session := c.state, c.raddr, c.session
+			c.mu.Unlock()
+
+			if state != StateConnected {
+				continue
+			}
+
+			packet = appendConnHeader(packet[:0], kindPayload, session)
+			packet = append(packet, buf...)
+
+			c.sendTo(raddr, packet)
+		case <-c.updated:
+			return
+		}
+	}
+}
+
+// sendTo writes buf to addr. Dialed conns always write to their peer, and ignore addr. Failing to write a packet is
+// not fatal, as un-ACK'ed packets and handshake packets are retransmitted.
+func (c *Conn) sendTo(addr *net.UDPAddr, buf []byte) {
+	if c.dialed {
+		c.conn.Write(buf)
+		return
+	}
+
+	if addr == nil {
+		return
+	}
+
+	c.conn.WriteToUDP(buf, addr)
+}
+
+// updateLoop updates the channel, and the state of the connection, every DefaultUpdateInterval until c is over.
+func (c *Conn) updateLoop() {
+	defer c.wg.Done()
+	defer close(c.updated)
+
+	ticker := time.NewTicker(DefaultUpdateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			// Errors only stem from stale or malformed packets sent by the peer, which are dropped by Update without
+			// holding up the rest of the update.
+
+			c.channel.Update(time.Since(c.start).Seconds())
+			c.tick(now)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// shutdown marks the connection as over with the given state, closes the UDP socket, and unblocks all pending reads
+// and writes such that they fail with err. Only the first call has any effect.
+func (c *Conn) shutdown(state ConnState, err error) {
+	c.shutdownOnce.Do(func() {
+		c.mu.Lock()
+		c.state, c.err = state, err
+		c.mu.Unlock()
+
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// closeErr returns the error that reads and writes fail with once the connection is over.
+func (c *Conn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		return ErrConnClosed
+	}
+	return c.err
+}
+
+// deadline is a read or write deadline that may be changed while callers are waiting on it.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed once the deadline has been exceeded
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline to t. The deadline is cleared should t be zero.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	// Replace cancel should the previous deadline have been exceeded.
+
+	closed := isClosedChan(d.cancel)
+
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed once the deadline has been exceeded.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
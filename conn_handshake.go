@@ -0,0 +1,380 @@
+package sleepy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"github.com/lithdew/bytesutil"
+	"io"
+	"net"
+	"time"
+)
+
+// ConnState is the state of a Conn.
+type ConnState int32
+
+const (
+	// StateConnecting is the state of a Conn that has yet to complete its handshake with a peer.
+	StateConnecting ConnState = iota
+
+	// StateConnected is the state of a Conn that has completed its handshake with a peer.
+	StateConnected
+
+	// StateDisconnecting is the state of a Conn that is sending disconnect packets to its peer after being closed.
+	StateDisconnecting
+
+	// StateDisconnected is the state of a Conn that has either been closed, or that was disconnected by its peer.
+	StateDisconnected
+
+	// StateTimedOut is the state of a Conn whose peer either failed to complete its handshake, or stopped sending
+	// packets, within Config.Timeout.
+	StateTimedOut
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnecting:
+		return "disconnecting"
+	case StateDisconnected:
+		return "disconnected"
+	case StateTimedOut:
+		return "timed out"
+	default:
+		return fmt.Sprintf("ConnState(%d)", int32(s))
+	}
+}
+
+// connPacketKind denotes the kind of a datagram exchanged between conns.
+type connPacketKind uint8
+
+const (
+	// Sent by clients to request to connect. It is padded to handshakePacketSize.
+	kindConnectionRequest connPacketKind = iota + 1
+
+	// Sent by servers in reply to a connection request. It carries a challenge token.
+	kindChallenge
+
+	// Sent by clients in reply to a challenge. It echoes the challenge token, and is padded to handshakePacketSize.
+	kindChallengeResponse
+
+	// Sent by servers once a challenge token has been verified. It carries the session ID of the connection.
+	kindConnectionAccepted
+
+	// Carries a packet written by an Endpoint.
+	kindPayload
+
+	// Sent by either peer once their conn has been closed.
+	kindDisconnect
+)
+
+const (
+	// Size of the header prefixing every datagram, comprised of its kind and the session ID of the connection. The
+	// session ID is zero for datagrams sent before the handshake has completed.
+	connHeaderSize = 5
+
+	// Min size of connection requests and challenge responses. Datagrams sent in reply to an address that has yet
+	// to be verified are always smaller, such that conns may not be used to amplify traffic towards spoofed
+	// addresses.
+	handshakePacketSize = 64
+
+	// Size of a challenge token, comprised of its expiry and a truncated HMAC.
+	challengeTokenSize = 8 + 16
+
+	// Duration a challenge token is valid for.
+	challengeTokenTTL = 5 * time.Second
+
+	// How often connection requests and challenge responses are retransmitted until the handshake completes.
+	handshakeResendInterval = 100 * time.Millisecond
+
+	// Number of times a disconnect packet is sent, as any of them may be lost.
+	disconnectRedundancy = 3
+)
+
+func appendConnHeader(dst []byte, kind connPacketKind, session uint32) []byte {
+	dst = append(dst, byte(kind))
+	dst = bytesutil.AppendUint32BE(dst, session)
+	return dst
+}
+
+func unmarshalConnHeader(buf []byte) (kind connPacketKind, session uint32, leftover []byte, err error) {
+	if len(buf) < connHeaderSize {
+		return kind, session, buf, io.ErrUnexpectedEOF
+	}
+
+	kind, buf = connPacketKind(buf[0]), buf[1:]
+	session, buf = bytesutil.Uint32BE(buf[:4]), buf[4:]
+
+	return kind, session, buf, nil
+}
+
+// appendHandshakePacket appends a connection request should token be nil, or otherwise a challenge response echoing
+// token, padded to handshakePacketSize.
+func appendHandshakePacket(dst []byte, token []byte) []byte {
+	start := len(dst)
+
+	if token == nil {
+		dst = appendConnHeader(dst, kindConnectionRequest, 0)
+	} else {
+		dst = appendConnHeader(dst, kindChallengeResponse, 0)
+		dst = append(dst, token...)
+	}
+
+	for len(dst)-start < handshakePacketSize {
+		dst = append(dst, 0)
+	}
+
+	return dst
+}
+
+// challenger issues challenge tokens to addresses that request to connect, and verifies challenge responses. Tokens
+// are authenticated with a random key rather than stored, such that no state is kept for addresses that have yet to
+// prove they may receive datagrams.
+type challenger struct {
+	key [32]byte
+}
+
+func newChallenger() (*challenger, error) {
+	var c challenger
+	if _, err := rand.Read(c.key[:]); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// appendToken appends a challenge token for addr that expires at expiry to dst.
+func (c *challenger) appendToken(dst []byte, addr *net.UDPAddr, expiry int64) []byte {
+	dst = bytesutil.AppendUint64BE(dst, uint64(expiry))
+
+	mac := hmac.New(sha256.New, c.key[:])
+	mac.Write(dst[len(dst)-8:])
+	mac.Write([]byte(addr.String()))
+
+	var sum [sha256.Size]byte
+	return append(dst, mac.Sum(sum[:0])[:challengeTokenSize-8]...)
+}
+
+// verify reports whether token was issued to addr, and has yet to expire.
+func (c *challenger) verify(token []byte, addr *net.UDPAddr, now time.Time) bool {
+	if len(token) < challengeTokenSize {
+		return false
+	}
+
+	token = token[:challengeTokenSize]
+
+	expiry := int64(bytesutil.Uint64BE(token[:8]))
+	if now.UnixNano() > expiry {
+		return false
+	}
+
+	var scratch [challengeTokenSize]byte
+	return hmac.Equal(token, c.appendToken(scratch[:0], addr, expiry))
+}
+
+// newSessionID returns a random, non-zero session ID.
+func newSessionID() (uint32, error) {
+	var buf [4]byte
+
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0, err
+		}
+		if session := bytesutil.Uint32BE(buf[:]); session != 0 {
+			return session, nil
+		}
+	}
+}
+
+// handleClientPacket handles a datagram received by a dialed conn from its server.
+func (c *Conn) handleClientPacket(kind connPacketKind, session uint32, payload []byte) {
+	switch kind {
+	case kindChallenge:
+		if session != 0 || len(payload) < challengeTokenSize {
+			return
+		}
+
+		c.mu.Lock()
+		if c.state != StateConnecting {
+			c.mu.Unlock()
+			return
+		}
+		c.token = append(c.token[:0], payload[:challengeTokenSize]...)
+		c.mu.Unlock()
+
+		c.sendTo(nil, appendHandshakePacket(nil, payload[:challengeTokenSize]))
+	case kindConnectionAccepted:
+		if session == 0 {
+			return
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if c.state != StateConnecting {
+			return
+		}
+
+		c.session = session
+		c.connectLocked()
+	case kindPayload:
+		if c.verify(nil, session) {
+			c.feed(payload)
+		}
+	case kindDisconnect:
+		if c.verify(nil, session) {
+			c.shutdown(StateDisconnected, ErrPeerDisconnected)
+		}
+	}
+}
+
+// handleServerPacket handles a datagram received by a listening conn from addr. Connection requests are replied to
+// with a challenge token, and the first address to echo back a valid challenge token becomes the peer of c.
+func (c *Conn) handleServerPacket(addr *net.UDPAddr, kind connPacketKind, session uint32, payload []byte) {
+	now := time.Now()
+
+	switch kind {
+	case kindConnectionRequest:
+		if session != 0 || len(payload)+connHeaderSize < handshakePacketSize || c.State() != StateConnecting {
+			return
+		}
+
+		var scratch [connHeaderSize + challengeTokenSize]byte
+
+		buf := appendConnHeader(scratch[:0], kindChallenge, 0)
+		buf = c.challenger.appendToken(buf, addr, now.Add(challengeTokenTTL).UnixNano())
+
+		c.sendTo(addr, buf)
+	case kindChallengeResponse:
+		if session != 0 || len(payload)+connHeaderSize < handshakePacketSize {
+			return
+		}
+
+		if !c.challenger.verify(payload, addr, now) {
+			return
+		}
+
+		// Accept the first peer to respond to a challenge. Should the peer retransmit its response, it missed our
+		// reply, so reply again.
+
+		c.mu.Lock()
+		switch {
+		case c.state == StateConnecting:
+			id, err := newSessionID()
+			if err != nil {
+				c.mu.Unlock()
+				return
+			}
+
+			c.raddr, c.session = addr, id
+			c.connectLocked()
+		case c.state != StateConnected || !udpAddrEqual(c.raddr, addr):
+			c.mu.Unlock()
+			return
+		}
+		session = c.session
+		c.mu.Unlock()
+
+		var scratch [connHeaderSize]byte
+		c.sendTo(addr, appendConnHeader(scratch[:0], kindConnectionAccepted, session))
+	case kindPayload:
+		if c.verify(addr, session) {
+			c.feed(payload)
+		}
+	case kindDisconnect:
+		if c.verify(addr, session) {
+			c.shutdown(StateDisconnected, ErrPeerDisconnected)
+		}
+	}
+}
+
+// connectLocked marks the handshake of c as completed. c.mu must be held.
+func (c *Conn) connectLocked() {
+	c.state = StateConnected
+	c.lastRecv = time.Now()
+	close(c.connected)
+}
+
+// verify reports whether a datagram tagged with session was sent by the peer of c over the current connection, and
+// if so, marks the peer as alive. addr is ignored for dialed conns, as their socket only receives datagrams from
+// their peer.
+func (c *Conn) verify(addr *net.UDPAddr, session uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != StateConnected || session != c.session {
+		return false
+	}
+
+	if !c.dialed && !udpAddrEqual(c.raddr, addr) {
+		return false
+	}
+
+	c.lastRecv = time.Now()
+
+	return true
+}
+
+// tick retransmits the handshake of a dialed conn that is connecting, and times out conns whose peer failed to
+// complete its handshake, or stopped sending packets, within Config.Timeout. Heartbeats sent by the channel of the
+// peer every 0.1 seconds keep idle connections alive.
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	state, lastRecv := c.state, c.lastRecv
+
+	var token []byte
+	if c.token != nil {
+		token = append(token, c.token...)
+	}
+	c.mu.Unlock()
+
+	switch state {
+	case StateConnecting:
+		if !c.dialed {
+			return
+		}
+
+		if now.Sub(c.start) >= c.timeout {
+			c.shutdown(StateTimedOut, ErrConnTimedOut)
+			return
+		}
+
+		if now.Sub(c.lastHandshake) >= handshakeResendInterval {
+			c.lastHandshake = now
+			c.sendTo(nil, appendHandshakePacket(nil, token))
+		}
+	case StateConnected:
+		if now.Sub(lastRecv) >= c.timeout {
+			c.shutdown(StateTimedOut, ErrConnTimedOut)
+		}
+	}
+}
+
+// disconnect sends disconnect packets to the peer of c should it be connected.
+func (c *Conn) disconnect() {
+	c.mu.Lock()
+	if c.state != StateConnected {
+		c.mu.Unlock()
+		return
+	}
+	c.state = StateDisconnecting
+	raddr, session := c.raddr, c.session
+	c.mu.Unlock()
+
+	var scratch [connHeaderSize]byte
+
+	buf := appendConnHeader(scratch[:0], kindDisconnect, session)
+	for i := 0; i < disconnectRedundancy; i++ {
+		c.sendTo(raddr, buf)
+	}
+}
+
+func udpAddrEqual(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
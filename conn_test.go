@@ -0,0 +1,299 @@
+package sleepy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestConns(t *testing.T) (*Conn, *Conn) {
+	t.Helper()
+
+	server, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+
+	client, err := Dial(server.LocalAddr().String())
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+func TestConnReadWriteMessage(t *testing.T) {
+	client, server := newTestConns(t)
+
+	// The listening conn should have connected to the dialed conn during its handshake.
+
+	require.Equal(t, StateConnected, client.State())
+	require.Equal(t, StateConnected, server.State())
+	require.EqualValues(t, client.LocalAddr().String(), server.RemoteAddr().String())
+
+	require.NoError(t, client.WriteMessage([]byte("hello")))
+
+	msg, err := server.ReadMessage(nil)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", msg)
+
+	require.NoError(t, server.WriteMessage([]byte("world")))
+
+	msg, err = client.ReadMessage(nil)
+	require.NoError(t, err)
+	require.EqualValues(t, "world", msg)
+}
+
+func TestConnWriteMessageInvalid(t *testing.T) {
+	client, _ := newTestConns(t)
+
+	require.Equal(t, ErrEmptyMessage, client.WriteMessage(nil))
+	require.Equal(t, ErrMessageTooLarge, client.WriteMessage(make([]byte, NewConfig().MaxPacketSize)))
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	client, _ := newTestConns(t)
+
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+
+	_, err := client.ReadMessage(nil)
+	require.Error(t, err)
+
+	netErr, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, netErr.Timeout())
+
+	// Clearing the deadline should allow reads to block again.
+
+	require.NoError(t, client.SetReadDeadline(time.Time{}))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.ReadMessage(nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("read returned early with %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Closing the conn should unblock pending reads.
+
+	require.NoError(t, client.Close())
+	require.Equal(t, ErrConnClosed, <-done)
+
+	require.Equal(t, ErrConnClosed, client.WriteMessage([]byte("hello")))
+	require.Equal(t, ErrConnClosed, client.Close())
+}
+
+func TestConnWriteBurst(t *testing.T) {
+	client, server := newTestConns(t)
+
+	// Write far more messages than the 32 packets covered by a single ACK without waiting for any replies.
+
+	const count = 1000
+
+	errs := make(chan error, 1)
+
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := client.WriteMessage([]byte{byte(i >> 8), byte(i)}); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(10*time.Second)))
+
+	for i := 0; i < count; i++ {
+		msg, err := server.ReadMessage(nil)
+		require.NoError(t, err, "read %d message(s)", i)
+		require.EqualValues(t, []byte{byte(i >> 8), byte(i)}, msg)
+	}
+
+	require.NoError(t, <-errs)
+}
+
+func TestConnChannels(t *testing.T) {
+	config := NewConfig()
+	config.Channels = []ChannelType{ReliableOrdered, Unreliable}
+
+	server, err := ListenConfig("127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := DialConfig(server.LocalAddr().String(), config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.Equal(t, ErrUnknownChannel, client.WriteChannelMessage(2, []byte("hello")))
+	require.NoError(t, client.WriteChannelMessage(1, []byte("hello")))
+
+	channel, msg, err := server.ReadChannelMessage(nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, channel)
+	require.EqualValues(t, "hello", msg)
+}
+
+func TestConnDialTimeout(t *testing.T) {
+	// Reserve an address that no conn is listening on.
+
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	conn, err := net.ListenUDP("udp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	config := NewConfig()
+	config.Timeout = 100 * time.Millisecond
+
+	client, err := DialConfig(conn.LocalAddr().String(), config)
+	require.Nil(t, client)
+	require.Equal(t, ErrConnTimedOut, err)
+
+	// Connection requests should have been padded.
+
+	buf := make([]byte, maxDatagramSize)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err := conn.ReadFromUDP(buf)
+	require.NoError(t, err)
+	require.EqualValues(t, handshakePacketSize, n)
+}
+
+func TestConnDisconnect(t *testing.T) {
+	client, server := newTestConns(t)
+
+	require.NoError(t, client.Close())
+	require.Equal(t, StateDisconnected, client.State())
+
+	_, err := server.ReadMessage(nil)
+	require.Equal(t, ErrPeerDisconnected, err)
+	require.Equal(t, StateDisconnected, server.State())
+
+	require.Equal(t, ErrPeerDisconnected, server.WriteMessage([]byte("hello")))
+	require.NoError(t, server.Close())
+}
+
+func TestConnTimeout(t *testing.T) {
+	config := NewConfig()
+	config.Timeout = 200 * time.Millisecond
+
+	server, err := ListenConfig("127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := DialConfig(server.LocalAddr().String(), config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// Heartbeats should keep idle connections alive.
+
+	time.Sleep(2 * config.Timeout)
+	require.Equal(t, StateConnected, client.State())
+	require.Equal(t, StateConnected, server.State())
+
+	// Silence the server without it sending disconnect packets.
+
+	require.NoError(t, server.conn.Close())
+
+	_, err = client.ReadMessage(nil)
+	require.Equal(t, ErrConnTimedOut, err)
+	require.Equal(t, StateTimedOut, client.State())
+}
+
+func TestConnHandshakeAmplification(t *testing.T) {
+	server, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	conn, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, maxDatagramSize)
+
+	// Undersized connection requests should not be replied to.
+
+	_, err = conn.Write(appendConnHeader(nil, kindConnectionRequest, 0))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = conn.Read(buf)
+	require.Error(t, err)
+
+	// Challenges should be smaller than the connection requests they reply to.
+
+	_, err = conn.Write(appendHandshakePacket(nil, nil))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Less(t, n, handshakePacketSize)
+
+	kind, session, token, err := unmarshalConnHeader(buf[:n])
+	require.NoError(t, err)
+	require.Equal(t, kindChallenge, kind)
+	require.EqualValues(t, 0, session)
+
+	// Echoing back the challenge token should complete the handshake.
+
+	_, err = conn.Write(appendHandshakePacket(nil, token))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err = conn.Read(buf)
+	require.NoError(t, err)
+
+	kind, session, _, err = unmarshalConnHeader(buf[:n])
+	require.NoError(t, err)
+	require.Equal(t, kindConnectionAccepted, kind)
+	require.NotZero(t, session)
+	require.Equal(t, StateConnected, server.State())
+}
+
+func TestChallengerVerify(t *testing.T) {
+	c, err := newChallenger()
+	require.NoError(t, err)
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1235}
+
+	now := time.Now()
+	token := c.appendToken(nil, addr, now.Add(challengeTokenTTL).UnixNano())
+
+	require.Len(t, token, challengeTokenSize)
+	require.True(t, c.verify(token, addr, now))
+
+	require.False(t, c.verify(token, other, now))
+	require.False(t, c.verify(token, addr, now.Add(2*challengeTokenTTL)))
+	require.False(t, c.verify(token[:challengeTokenSize-1], addr, now))
+
+	token[len(token)-1]++
+	require.False(t, c.verify(token, addr, now))
+}
+
+func TestIsEOF(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	_, _, err = conn.ReadFromUDP(make([]byte, 1))
+	require.True(t, isEOF(err))
+	require.True(t, isEOF(fmt.Errorf("failed to read: %w", err)))
+
+	require.True(t, isEOF(fmt.Errorf("failed to read: %w", io.EOF)))
+	require.False(t, isEOF(errors.New("use of closed network connection")))
+	require.False(t, isEOF(errTimeout))
+}
@@ -4,12 +4,17 @@ import (
 	"fmt"
 	"github.com/lithdew/bytesutil"
 	"github.com/valyala/bytebufferpool"
+	"io"
 	"math"
 )
 
 type EndpointDispatcher interface {
-	Transmit(seq uint16, buf []byte)
-	Process(seq uint16, buf []byte)
+	Transmit(channel uint8, seq uint16, buf []byte)
+
+	// Process handles the contents of a packet received over a channel, which are only valid until it returns.
+	// Should it return false, the packet is not ACK'ed such that the peer retransmits it later.
+	Process(channel uint8, seq uint16, buf []byte) bool
+
 	ACK(seq uint16)
 }
 
@@ -51,7 +56,14 @@ func NewEndpoint(dispatcher EndpointDispatcher, config *Config) *Endpoint {
 	return e
 }
 
+// WritePacket writes buf over the default channel.
 func (e *Endpoint) WritePacket(buf []byte) (written int) {
+	return e.WriteChannelPacket(0, buf)
+}
+
+// WriteChannelPacket writes buf over the channel with the given ID. The ACKs of all channels are shared, as channels
+// share the sequence numbers of this endpoint.
+func (e *Endpoint) WriteChannelPacket(channel uint8, buf []byte) (written int) {
 	seq, size := e.seq, uint(len(buf))
 
 	if size > e.config.MaxPacketSize {
@@ -85,9 +97,10 @@ func (e *Endpoint) WritePacket(buf []byte) (written int) {
 	// bitset of the last 32 acknowledged packet sequence numbers.
 
 	header := PacketHeader{
-		seq:  seq,
-		ack:  ack,
-		acks: acks,
+		seq:     seq,
+		ack:     ack,
+		acks:    acks,
+		channel: channel,
 	}
 
 	// If the packet is small enough, we don't need to fragment it and can prepend a header to it and directly
@@ -102,7 +115,7 @@ func (e *Endpoint) WritePacket(buf []byte) (written int) {
 		written += copy(scratch.B[written:], buf)
 
 		// Write to the connection all data written to the scratch buffer.
-		e.dispatcher.Transmit(seq, scratch.B[:written])
+		e.dispatcher.Transmit(channel, seq, scratch.B[:written])
 
 		return written
 	}
@@ -145,7 +158,7 @@ func (e *Endpoint) WritePacket(buf []byte) (written int) {
 
 		// Write the fragment to the connection.
 
-		e.dispatcher.Transmit(seq, scratch.B)
+		e.dispatcher.Transmit(channel, seq, scratch.B)
 
 		// Keep track of the total number of bytes written to the connection.
 
@@ -156,6 +169,10 @@ func (e *Endpoint) WritePacket(buf []byte) (written int) {
 }
 
 func (e *Endpoint) ReadPacket(buf []byte) error {
+	if len(buf) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+
 	// If the first bit is set, process the packet as a fragmented packet. Otherwise, process it as a
 	// compact, non-fragmented packet.
 
@@ -291,16 +308,28 @@ func (e *Endpoint) recvCompactPacket(buf []byte) error {
 		return fmt.Errorf("failed to unmarshal packet header: %w", err)
 	}
 
-	// Mark packets that have been ACKed by our peer.
-
-	recv := e.recv.Insert(header.seq)
-	if recv == nil {
+	if e.recv.IsOutdated(header.seq) {
 		return fmt.Errorf("packet received w/ sequence number %d is stale", header.seq)
 	}
 
-	// Process the packets contents now that it has successfully been received.
+	// Silently drop packets that were duplicated over the network such that their contents are only ever processed
+	// once.
 
-	e.dispatcher.Process(header.seq, buf)
+	if e.recv.Find(header.seq) != nil {
+		return nil
+	}
+
+	// Process the packets contents. Should the dispatcher not accept the packet, leave it un-ACK'ed such that our
+	// peer retransmits it, though still mark new ACKs from our peer.
+
+	if !e.dispatcher.Process(header.channel, header.seq, buf) {
+		e.processACKs(header.ack, header.acks)
+		return nil
+	}
+
+	// Mark the packet as received such that it is ACK'ed to our peer.
+
+	recv := e.recv.Insert(header.seq)
 
 	recv.Reset()
 
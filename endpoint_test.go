@@ -12,14 +12,15 @@ type MockDispatcher struct {
 	r, w [][]byte
 }
 
-func (m *MockDispatcher) Transmit(seq uint16, buf []byte) {
+func (m *MockDispatcher) Transmit(_ uint8, seq uint16, buf []byte) {
 	m.w = append(m.w, make([]byte, len(buf)))
 	copy(m.w[len(m.w)-1], buf)
 }
 
-func (m *MockDispatcher) Process(seq uint16, buf []byte) {
+func (m *MockDispatcher) Process(_ uint8, seq uint16, buf []byte) bool {
 	m.r = append(m.r, make([]byte, len(buf)))
 	copy(m.r[len(m.r)-1], buf)
+	return true
 }
 
 func (m *MockDispatcher) ACK(_ uint16) {}
@@ -80,6 +81,22 @@ func TestEndpointSendRecvCompactPacket(t *testing.T) {
 	require.True(t, client.sent.entries[0].acked)
 }
 
+func TestEndpointRecvDuplicateCompactPacket(t *testing.T) {
+	client, clientConn := newTestEndpoint(t)
+	server, serverConn := newTestEndpoint(t)
+
+	client.WritePacket([]byte("test"))
+	require.Len(t, clientConn.w, 1)
+
+	// A packet duplicated over the network should only be processed once.
+
+	require.NoError(t, server.ReadPacket(clientConn.w[0]))
+	require.NoError(t, server.ReadPacket(clientConn.w[0]))
+
+	require.Len(t, serverConn.r, 1)
+	require.EqualValues(t, "test", serverConn.r[0])
+}
+
 func TestEndpointSendRecvFragmentedPacket(t *testing.T) {
 	var err error
 
@@ -6,15 +6,46 @@ import (
 	"net"
 )
 
+// ErrConnClosed is returned when reading from or writing to a Conn that has been closed.
+var ErrConnClosed = errors.New("use of closed sleepy connection")
+
+// ErrConnTimedOut is returned when reading from or writing to a Conn whose peer either failed to complete its
+// handshake, or stopped sending packets, within Config.Timeout.
+var ErrConnTimedOut = errors.New("sleepy connection timed out")
+
+// ErrPeerDisconnected is returned when reading from or writing to a Conn whose peer has closed the connection.
+var ErrPeerDisconnected = errors.New("sleepy connection closed by peer")
+
+// ErrMessageTooLarge is returned when writing a message larger than the max packet size of a Conn.
+var ErrMessageTooLarge = errors.New("message is larger than the max packet size")
+
+// ErrUnknownChannel is returned when writing a message over a channel that was not configured.
+var ErrUnknownChannel = errors.New("unknown channel")
+
+// ErrEmptyMessage is returned when writing an empty message, as empty packets are reserved for heartbeats.
+var ErrEmptyMessage = errors.New("message is empty")
+
+// errTimeout is returned when a read or write deadline of a Conn has been exceeded.
+var errTimeout net.Error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// isEOF reports whether err denotes that no more packets may be read from a socket.
 func isEOF(err error) bool {
-	if errors.Is(err, io.EOF) {
-		return true
-	}
+	return errors.Is(err, io.EOF) || isClosedConnError(err)
+}
 
-	var netErr *net.OpError
-	if errors.As(err, &netErr) {
-		return netErr.Err.Error() == "use of closed network connection"
+// isClosedConnError reports whether err was returned by an operation against a closed network connection. The error
+// is only exported as net.ErrClosed from Go 1.16 onwards, whereas this module targets Go 1.14, leaving its message as
+// the only way to detect it.
+func isClosedConnError(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Err == nil {
+		return false
 	}
-
-	return false
+	return opErr.Err.Error() == "use of closed network connection"
 }
@@ -9,13 +9,13 @@ import (
 )
 
 const (
-	MaxPacketHeaderSize = uint(9)
+	MaxPacketHeaderSize = uint(10)
 	FragmentHeaderSize  = uint(5)
 )
 
 type BufferedPacket struct {
 	time    float64
-	written bool
+	channel uint8
 	buf     *bytebufferpool.ByteBuffer
 }
 
@@ -51,6 +51,7 @@ const (
 	FlagC
 	FlagD
 	FlagACKEncoded
+	FlagChannel
 )
 
 func (p PacketHeaderFlag) Toggle(flag PacketHeaderFlag) PacketHeaderFlag {
@@ -69,6 +70,9 @@ type PacketHeader struct {
 	seq  uint16
 	ack  uint16
 	acks uint32
+
+	// ID of the channel the packet was sent over.
+	channel uint8
 }
 
 func (p PacketHeader) AppendTo(dst []byte) []byte {
@@ -99,6 +103,12 @@ func (p PacketHeader) AppendTo(dst []byte) []byte {
 		flag = flag.Toggle(FlagACKEncoded)
 	}
 
+	// Only write down the channel ID should it not be the default channel, and set the 7th bit of flag.
+
+	if p.channel != 0 {
+		flag = flag.Toggle(FlagChannel)
+	}
+
 	// Marshal the flag and sequence number and latest ACK'd sequence number.
 
 	dst = flag.AppendTo(dst)
@@ -125,6 +135,12 @@ func (p PacketHeader) AppendTo(dst []byte) []byte {
 		dst = append(dst, uint8((p.acks&0xFF000000)>>24))
 	}
 
+	// Marshal channel ID.
+
+	if p.channel != 0 {
+		dst = append(dst, p.channel)
+	}
+
 	return dst
 }
 
@@ -191,6 +207,15 @@ func UnmarshalPacketHeader(buf []byte) (header PacketHeader, leftover []byte, er
 		buf = buf[1:]
 	}
 
+	// Read channel ID.
+
+	if flag.Toggled(FlagChannel) {
+		if len(buf) < 1 {
+			return header, buf, io.ErrUnexpectedEOF
+		}
+		header.channel, buf = buf[0], buf[1:]
+	}
+
 	return header, buf, nil
 }
 
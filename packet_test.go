@@ -13,8 +13,8 @@ func TestEncodeDecodePacketHeader(t *testing.T) {
 	buf := bytebufferpool.Get()
 	defer bytebufferpool.Put(buf)
 
-	f := func(seq, ack uint16, acks uint32) bool {
-		header := PacketHeader{seq: seq, ack: ack, acks: acks}
+	f := func(seq, ack uint16, acks uint32, channel uint8) bool {
+		header := PacketHeader{seq: seq, ack: ack, acks: acks, channel: channel}
 		recovered, leftover, err := UnmarshalPacketHeader(header.AppendTo(buf.B[:0]))
 		return assert.NoError(t, err) && assert.Len(t, leftover, 0) && assert.EqualValues(t, header, recovered)
 	}
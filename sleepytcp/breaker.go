@@ -0,0 +1,153 @@
+package sleepytcp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBreakerOpenDuration   = 5 * time.Second
+	DefaultBreakerHalfOpenProbes = 1
+)
+
+// ErrCircuitOpen is matched by errors.Is against any *CircuitOpenError.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitOpenError is returned when a request is rejected without being attempted as the circuit breaker of the
+// HostClient it was to be sent through is open.
+type CircuitOpenError struct {
+	Addr string
+
+	// Duration until the circuit breaker allows for a probe request to go through.
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open (retry after %s)", e.Addr, e.RetryAfter)
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+type BreakerState int32
+
+const (
+	// Requests go through as usual.
+	BreakerClosed BreakerState = iota
+
+	// Requests are rejected with a *CircuitOpenError.
+	BreakerOpen
+
+	// A limited number of probe requests go through. Should a probe succeed, the breaker is closed. Should a probe
+	// fail, the breaker is opened again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int32(s))
+	}
+}
+
+type breakerOutcome int
+
+const (
+	// The request neither succeeded nor failed in a way that says anything about the health of the peer (i.e. the
+	// caller gave up, or no connection was available).
+	breakerNeutral breakerOutcome = iota
+	breakerSuccess
+	breakerFailure
+)
+
+// circuitBreaker opens after a threshold of consecutive dial or IO failures, and rejects requests while open. After
+// openDuration, it half-opens and lets through a limited number of probe requests.
+type circuitBreaker struct {
+	mu sync.Mutex
+
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+// allow reports whether or not a request may go through, and whether or not the request is a probe request. The
+// outcome of every allowed request must be reported via done.
+func (b *circuitBreaker) allow(addr string, openDuration time.Duration, maxProbes int) (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		elapsed := time.Since(b.openedAt)
+		if elapsed < openDuration {
+			return false, &CircuitOpenError{Addr: addr, RetryAfter: openDuration - elapsed}
+		}
+		b.state, b.probes = BreakerHalfOpen, 0
+	}
+
+	if b.state == BreakerHalfOpen {
+		if b.probes >= maxProbes {
+			return false, &CircuitOpenError{Addr: addr}
+		}
+		b.probes++
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// done reports the outcome of a request that was allowed to go through.
+func (b *circuitBreaker) done(probe bool, outcome breakerOutcome, threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe && b.state == BreakerHalfOpen {
+		b.probes--
+	}
+
+	switch outcome {
+	case breakerSuccess:
+		b.failures = 0
+		if probe && b.state == BreakerHalfOpen {
+			b.state = BreakerClosed
+		}
+	case breakerFailure:
+		b.failLocked(threshold)
+	}
+}
+
+// fail records a dial or IO failure.
+func (b *circuitBreaker) fail(threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failLocked(threshold)
+}
+
+func (b *circuitBreaker) failLocked(threshold int) {
+	b.failures++
+
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= threshold) {
+		b.state, b.openedAt = BreakerOpen, time.Now()
+	}
+}
+
+func (b *circuitBreaker) current(openDuration time.Duration) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= openDuration {
+		return BreakerHalfOpen
+	}
+
+	return b.state
+}
@@ -0,0 +1,95 @@
+package sleepytcp
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostClientCircuitBreaker(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	var (
+		dials int32
+		down  int32 = 1
+	)
+
+	c := &HostClient{
+		Addr: addr,
+		Dial: func(addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			if atomic.LoadInt32(&down) == 1 {
+				return nil, errors.New("peer is down")
+			}
+			return net.Dial("tcp", addr)
+		},
+		BreakerThreshold:    3,
+		BreakerOpenDuration: 50 * time.Millisecond,
+	}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	// Trip the circuit breaker.
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, BreakerClosed, c.BreakerState())
+
+		_, err := c.Do(nil, req)
+		require.Error(t, err)
+		require.False(t, errors.Is(err, ErrCircuitOpen))
+	}
+
+	require.Equal(t, BreakerOpen, c.BreakerState())
+
+	// Requests should fail fast without dialing while the circuit breaker is open.
+
+	_, err := c.Do(nil, req)
+	require.True(t, errors.Is(err, ErrCircuitOpen))
+
+	var openErr *CircuitOpenError
+	require.True(t, errors.As(err, &openErr))
+	require.Equal(t, addr, openErr.Addr)
+	require.EqualValues(t, 3, atomic.LoadInt32(&dials))
+
+	// A failed probe should open the circuit breaker again.
+
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(t, BreakerHalfOpen, c.BreakerState())
+
+	_, err = c.Do(nil, req)
+	require.False(t, errors.Is(err, ErrCircuitOpen))
+	require.Equal(t, BreakerOpen, c.BreakerState())
+
+	// A successful probe should close the circuit breaker.
+
+	atomic.StoreInt32(&down, 0)
+
+	time.Sleep(60 * time.Millisecond)
+
+	_, err = c.Do(nil, req)
+	require.NoError(t, err)
+	require.Equal(t, BreakerClosed, c.BreakerState())
+}
+
+func TestClientBreakerStates(t *testing.T) {
+	c := &Client{
+		Dial: func(addr string) (net.Conn, error) {
+			return nil, errors.New("peer is down")
+		},
+		BreakerThreshold: 1,
+	}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.SetAddr("peer:1234")
+
+	_, err := c.Do(nil, req)
+	require.Error(t, err)
+
+	require.Equal(t, map[string]BreakerState{"peer:1234": BreakerOpen}, c.BreakerStates())
+}
@@ -1,7 +1,10 @@
 package sleepytcp
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"io"
 	"sync"
 	"time"
 )
@@ -10,13 +13,22 @@ const (
 	DefaultMaxConnsPerHost           = 512
 	DefaultMaxIdleConnDuration       = 10 * time.Second
 	DefaultMaxIdempotentCallAttempts = 5
+	DefaultMaxInflightPerConn        = 128
+	DefaultMuxLivenessTimeout        = 30 * time.Second
 
 	DefaultReadBufferSize  = 4096
 	DefaultWriteBufferSize = 4096
+
+	DefaultMaxResponseBodySize = 16 * 1024 * 1024
+
+	DefaultCloseTimeout = 5 * time.Second
+
+	DefaultPriorityAgingInterval = 500 * time.Millisecond
 )
 
 var (
 	ErrConnectionClosed = errors.New("connection closed")
+	ErrClientClosed     = errors.New("client closed")
 	ErrNoFreeConns      = errors.New("no free connections are available")
 	ErrTimeout          = errors.New("timed out")
 )
@@ -25,6 +37,7 @@ var startTimeUnix = time.Now().Unix()
 
 type Client struct {
 	Dial          DialFunc
+	DialContext   DialContextFunc
 	DialDualStack bool
 
 	MaxConnsPerHost           int
@@ -32,6 +45,25 @@ type Client struct {
 	MaxIdleConnDuration       time.Duration
 	MaxIdempotentCallAttempts int
 
+	AdaptivePoolSize bool
+	MinIdleConns     int
+
+	PriorityAgingInterval time.Duration
+
+	RetryPolicy      RetryPolicy
+	RetryBudgetRatio float64
+	RetryBudgetBurst int
+
+	BreakerThreshold      int
+	BreakerOpenDuration   time.Duration
+	BreakerHalfOpenProbes int
+
+	Multiplexed        bool
+	MaxInflightPerConn int
+	MuxLivenessTimeout time.Duration
+
+	PushHandler PushHandler
+
 	ReadBufferSize  int
 	WriteBufferSize int
 
@@ -40,15 +72,72 @@ type Client struct {
 
 	MaxResponseBodySize int
 
+	TLSConfig           *tls.Config
+	TLSHandshakeTimeout time.Duration
+
+	OnConnect        OnConnectFunc
+	OnConnectTimeout time.Duration
+
+	Codecs               []Codec
+	CompressionThreshold int
+
+	KeepAlivePeriod    time.Duration
+	IdleCheckThreshold time.Duration
+	IdlePing           *Frame
+	IdlePingTimeout    time.Duration
+
 	mu      sync.Mutex
 	clients map[string]*HostClient
+
+	// Whether or not Shutdown() or Close() has been called, and a channel that is closed once it has been called.
+	closed bool
+	done   chan struct{}
 }
 
 func (c *Client) Do(dst []byte, req *Frame) ([]byte, error) {
-	addr, startCleaner := req.addr, false
+	return c.DoContext(context.Background(), dst, req)
+}
+
+// DoContext sends req to the address it is addressed to, and appends the response body to dst. See
+// HostClient.DoContext for how ctx is honored.
+func (c *Client) DoContext(ctx context.Context, dst []byte, req *Frame) ([]byte, error) {
+	client, err := c.hostClient(req.addr)
+	if err != nil {
+		return dst, err
+	}
+	return client.DoContext(ctx, dst, req)
+}
+
+// DoStream sends req to the address it is addressed to, and returns the response body as a stream. See
+// HostClient.DoStream.
+func (c *Client) DoStream(ctx context.Context, req *Frame) (io.ReadCloser, error) {
+	client, err := c.hostClient(req.addr)
+	if err != nil {
+		return nil, err
+	}
+	return client.DoStream(ctx, req)
+}
+
+// Prewarm establishes MinIdleConns idle connections to addr in the background. See HostClient.Prewarm.
+func (c *Client) Prewarm(addr string) error {
+	client, err := c.hostClient(addr)
+	if err != nil {
+		return err
+	}
+	return client.Prewarm()
+}
+
+// hostClient returns the HostClient that manages connections to addr, creating it should it not yet exist.
+func (c *Client) hostClient(addr string) (*HostClient, error) {
+	startCleaner := false
 
 	c.mu.Lock()
 
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+
 	clients := c.clients
 
 	if clients == nil {
@@ -63,12 +152,32 @@ func (c *Client) Do(dst []byte, req *Frame) ([]byte, error) {
 			Addr: addr,
 
 			Dial:          c.Dial,
+			DialContext:   c.DialContext,
 			DialDualStack: c.DialDualStack,
 
 			MaxConns:                  c.MaxConnsPerHost,
 			MaxConnWaitTimeout:        c.MaxConnWaitTimeout,
 			MaxIdempotentCallAttempts: c.MaxIdempotentCallAttempts,
 
+			AdaptivePoolSize: c.AdaptivePoolSize,
+			MinIdleConns:     c.MinIdleConns,
+
+			PriorityAgingInterval: c.PriorityAgingInterval,
+
+			RetryPolicy:      c.RetryPolicy,
+			RetryBudgetRatio: c.RetryBudgetRatio,
+			RetryBudgetBurst: c.RetryBudgetBurst,
+
+			BreakerThreshold:      c.BreakerThreshold,
+			BreakerOpenDuration:   c.BreakerOpenDuration,
+			BreakerHalfOpenProbes: c.BreakerHalfOpenProbes,
+
+			Multiplexed:        c.Multiplexed,
+			MaxInflightPerConn: c.MaxInflightPerConn,
+			MuxLivenessTimeout: c.MuxLivenessTimeout,
+
+			PushHandler: c.PushHandler,
+
 			ReadBufferSize:  c.ReadBufferSize,
 			WriteBufferSize: c.WriteBufferSize,
 
@@ -76,6 +185,20 @@ func (c *Client) Do(dst []byte, req *Frame) ([]byte, error) {
 			WriteTimeout: c.WriteTimeout,
 
 			MaxResponseBodySize: c.MaxResponseBodySize,
+
+			TLSConfig:           c.TLSConfig,
+			TLSHandshakeTimeout: c.TLSHandshakeTimeout,
+
+			OnConnect:        c.OnConnect,
+			OnConnectTimeout: c.OnConnectTimeout,
+
+			Codecs:               c.Codecs,
+			CompressionThreshold: c.CompressionThreshold,
+
+			KeepAlivePeriod:    c.KeepAlivePeriod,
+			IdleCheckThreshold: c.IdleCheckThreshold,
+			IdlePing:           c.IdlePing,
+			IdlePingTimeout:    c.IdlePingTimeout,
 		}
 
 		clients[addr] = client
@@ -85,16 +208,110 @@ func (c *Client) Do(dst []byte, req *Frame) ([]byte, error) {
 		}
 	}
 
+	done := c.doneChanLocked()
+
 	c.mu.Unlock()
 
 	if startCleaner {
-		go c.cleanupIdleClients(clients)
+		go c.cleanupIdleClients(clients, done)
 	}
 
-	return client.Do(dst, req)
+	return client, nil
 }
 
-func (c *Client) cleanupIdleClients(clients map[string]*HostClient) {
+// BreakerStates returns the circuit breaker state of every HostClient currently managed by this client, keyed by
+// host address. Hosts that are not present may be assumed to have a closed circuit breaker.
+func (c *Client) BreakerStates() map[string]BreakerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	states := make(map[string]BreakerState, len(c.clients))
+	for addr, client := range c.clients {
+		states[addr] = client.BreakerState()
+	}
+
+	return states
+}
+
+// Stats returns a snapshot of the connections and requests of all HostClients currently managed by this client,
+// both per host and aggregated across all hosts.
+func (c *Client) Stats() ClientStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := ClientStats{Hosts: make(map[string]HostClientStats, len(c.clients))}
+
+	for addr, client := range c.clients {
+		s := client.Stats()
+
+		stats.Hosts[addr] = s
+		stats.Total.add(s)
+	}
+
+	return stats
+}
+
+// Shutdown stops this client from accepting new requests, and shuts down all HostClients currently managed by this
+// client concurrently. See HostClient.Shutdown for how ctx is honored.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.doneChanLocked())
+	}
+
+	clients := make([]*HostClient, 0, len(c.clients))
+	for host, client := range c.clients {
+		clients = append(clients, client)
+		delete(c.clients, host)
+	}
+
+	c.mu.Unlock()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		ferr error
+	)
+
+	for _, client := range clients {
+		wg.Add(1)
+
+		go func(client *HostClient) {
+			defer wg.Done()
+
+			if err := client.Shutdown(ctx); err != nil {
+				mu.Lock()
+				if ferr == nil {
+					ferr = err
+				}
+				mu.Unlock()
+			}
+		}(client)
+	}
+
+	wg.Wait()
+
+	return ferr
+}
+
+// Close shuts down this client, waiting up to DefaultCloseTimeout for in-flight requests to complete.
+func (c *Client) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCloseTimeout)
+	defer cancel()
+
+	return c.Shutdown(ctx)
+}
+
+func (c *Client) doneChanLocked() chan struct{} {
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+	return c.done
+}
+
+func (c *Client) cleanupIdleClients(clients map[string]*HostClient, done <-chan struct{}) {
 	for {
 		c.mu.Lock()
 
@@ -103,12 +320,16 @@ func (c *Client) cleanupIdleClients(clients map[string]*HostClient) {
 			idle := client.count == 0
 			client.mu.Unlock()
 
+			// Keep clients whose circuit breaker is not closed around such that they keep failing fast.
+
+			idle = idle && client.BreakerState() == BreakerClosed
+
 			if idle {
 				delete(clients, host)
 			}
 		}
 
-		stop := len(clients) == 0
+		stop := len(clients) == 0 || c.closed
 
 		c.mu.Unlock()
 
@@ -116,6 +337,13 @@ func (c *Client) cleanupIdleClients(clients map[string]*HostClient) {
 			break
 		}
 
-		time.Sleep(10 * time.Second)
+		timer := AcquireTimer(10 * time.Second)
+
+		select {
+		case <-done:
+		case <-timer.C:
+		}
+
+		ReleaseTimer(timer)
 	}
 }
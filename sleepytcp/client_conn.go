@@ -9,17 +9,21 @@ import (
 type clientConn struct {
 	conn        net.Conn
 	lastUseTime time.Time
+
+	// Codec negotiated for conn. It is nil should frames sent over conn not be compressed.
+	codec Codec
 }
 
 var clientConnPool sync.Pool
 
-func acquireClientConn(conn net.Conn) *clientConn {
+func acquireClientConn(conn net.Conn, codec Codec) *clientConn {
 	v := clientConnPool.Get()
 	if v == nil {
 		v = &clientConn{}
 	}
 	cc := v.(*clientConn)
 	cc.conn = conn
+	cc.codec = codec
 	return cc
 }
 
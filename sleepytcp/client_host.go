@@ -2,9 +2,9 @@ package sleepytcp
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
-	"fmt"
-	"io"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -15,6 +15,7 @@ type HostClient struct {
 	Addr string
 
 	Dial          DialFunc
+	DialContext   DialContextFunc
 	DialDualStack bool
 
 	MaxConns                  int
@@ -22,6 +23,61 @@ type HostClient struct {
 	MaxIdleConnDuration       time.Duration
 	MaxIdempotentCallAttempts int
 
+	// Whether or not to adapt the max number of connections between max(MinIdleConns, 1) and MaxConns from observed
+	// request latency and connection wait times. The pool grows should callers have to wait for connections, or
+	// immediately should MaxConnWaitTimeout not be set, and shrinks should request latency rise.
+	AdaptivePoolSize bool
+
+	// Min number of idle connections to keep established, such that bursts of requests need not wait for
+	// connections to be established. Idle connections are established in the background as they are used up, or
+	// upfront by calling Prewarm. Should they fail to be established, doing so is backed off until a connection is
+	// established. Ignored should connections be multiplexed.
+	MinIdleConns int
+
+	// Duration after which the priority of a caller waiting for a connection is raised by one level, such that
+	// callers sending frames of low priority never starve. Defaults to DefaultPriorityAgingInterval.
+	PriorityAgingInterval time.Duration
+
+	// Policy that decides whether or not a frame that failed to be delivered should be retried, and how long to back
+	// off for before retrying it. Defaults to DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+
+	// Ratio of retries to requests that may be made, and the max number of retries that may be made in a burst.
+	RetryBudgetRatio float64
+	RetryBudgetBurst int
+
+	// Number of consecutive dial or IO failures after which the circuit breaker opens, and requests fail fast with a
+	// *CircuitOpenError. The circuit breaker is disabled should it not be positive.
+	BreakerThreshold int
+
+	// Duration the circuit breaker stays open for before letting through probe requests, and the max number of
+	// concurrent probe requests. Default to DefaultBreakerOpenDuration and DefaultBreakerHalfOpenProbes.
+	BreakerOpenDuration   time.Duration
+	BreakerHalfOpenProbes int
+
+	// Whether or not to multiplex concurrent requests over each connection. Requests are tagged with a request ID
+	// such that responses may arrive out of order and be matched back to their callers. Note that multiplexed
+	// connections are susceptible to head-of-line blocking should the peer be slow to respond. Frames with a body
+	// stream are sent over a connection that is dedicated to them, such that a slow body stream never holds up other
+	// requests.
+	Multiplexed bool
+
+	// Handler of frames pushed by the peer, unsolicited, over connections established by this client. Should it be
+	// set, connections are bidirectional: they are multiplexed regardless of Multiplexed such that pushes may arrive
+	// at any time, and are handled while responses to outstanding requests are still routed to their callers. Pushes
+	// are discarded should it be nil.
+	PushHandler PushHandler
+
+	// Max number of in-flight requests per multiplexed connection. Should all connections have hit this limit, a new
+	// connection is established, up to MaxConns connections. Callers then wait for up to MaxConnWaitTimeout for a
+	// slot to free up, in the same order of priority as callers waiting for pooled connections.
+	MaxInflightPerConn int
+
+	// Max duration to wait for the peer to send anything over a multiplexed connection while requests are in-flight
+	// over it, such that half-open connections are detected even should ReadTimeout not be set. The connection is
+	// closed, and all of its in-flight requests fail, should it be exceeded. Defaults to DefaultMuxLivenessTimeout.
+	MuxLivenessTimeout time.Duration
+
 	ReadBufferSize  int
 	WriteBufferSize int
 
@@ -30,24 +86,102 @@ type HostClient struct {
 
 	MaxResponseBodySize int
 
+	// TLS configuration to establish connections with. Connections are established over plaintext should it be nil.
+	TLSConfig *tls.Config
+
+	// Max duration to wait for a TLS handshake to complete. Defaults to DefaultTLSHandshakeTimeout.
+	TLSHandshakeTimeout time.Duration
+
+	// Handshake to perform over every newly established connection, after its TLS handshake should TLSConfig be set.
+	// A connection only joins the pool should the handshake succeed. Failed handshakes count as failures to dial.
+	OnConnect OnConnectFunc
+
+	// Max duration to wait for codec negotiation and OnConnect to each complete. Defaults to DefaultOnConnectTimeout.
+	OnConnectTimeout time.Duration
+
+	// Codecs to offer to the peer in order of preference when establishing a connection. Frame bodies of at least
+	// CompressionThreshold bytes sent over the connection are compressed with the codec the peer picks, and
+	// compressed responses are decompressed up to MaxResponseBodySize bytes. Frames are never compressed should it
+	// be empty, or should the peer pick no codec.
+	Codecs []Codec
+
+	// Min size in bytes a frame body must have for it to be compressed. Defaults to DefaultCompressionThreshold.
+	CompressionThreshold int
+
+	// Period between TCP keepalive probes sent over established connections, such that connections silently
+	// dropped by the peer or by a middlebox are eventually closed by the OS. Defaults to DefaultKeepAlivePeriod.
+	// TCP keepalives are disabled should it be negative.
+	KeepAlivePeriod time.Duration
+
+	// Duration an idle connection must have idled for before it is validated upon being handed out to a caller.
+	// Connections found to be dead are closed, and another connection is handed out instead. Defaults to
+	// DefaultIdleCheckThreshold. Idle connections are never validated should it be negative.
+	//
+	// Idle connections are validated with a non-blocking read that detects whether the peer has closed them, which
+	// is not supported for TLS connections. Should IdlePing be set, it is sent over idle connections to validate
+	// them instead, and its response is discarded. Multiplexed connections are never validated, as their closure is
+	// detected by the goroutine reading responses off of them.
+	IdleCheckThreshold time.Duration
+	IdlePing           *Frame
+
+	// Max duration to wait for the response to IdlePing. Defaults to DefaultIdlePingTimeout.
+	IdlePingTimeout time.Duration
+
+	tlsConfigOnce sync.Once
+	tlsConfig     *tls.Config
+
 	mu sync.Mutex
 
 	// Slice of all available idle connections. Should they idle too long, they get cleaned up in
 	// cleanupIdleConnections().
 	conns []*clientConn
 
+	// Slice of all open multiplexed connections.
+	mconns []*muxConn
+
 	// Total number of pending/open connections for this client.
 	count int
 
-	// Queue of all callers waiting for an available connection.
-	queue *waitingCallerQueue
+	// Queue of all callers waiting for an available connection, and of all callers waiting for a slot on a
+	// multiplexed connection, ordered by priority.
+	queue    *waitingCallerQueue
+	muxQueue *waitingCallerQueue
 
 	// Whether or not cleanupIdleConnections() is running in the background.
 	cleanerRunning bool
 
+	// Number of connections being established in the background to keep MinIdleConns idle connections available.
+	prewarming int
+
+	// Number of consecutive failures to establish a connection in the background, and the time until which no
+	// connections are to be established in the background because of them.
+	prewarmFailures  int
+	prewarmRetryTime time.Time
+
+	// Max number of connections that may be established should AdaptivePoolSize be set.
+	poolLimiter poolLimiter
+
+	// Whether or not Shutdown() or Close() has been called, and a channel that is closed once it has been called
+	// such that cleanupIdleConnections() stops.
+	closed bool
+	done   chan struct{}
+
 	readerPool sync.Pool
 	writerPool sync.Pool
 
+	// Budget of retries that may be made.
+	retryBudget retryBudget
+
+	// Circuit breaker that trips after BreakerThreshold consecutive failures.
+	breaker circuitBreaker
+
+	// Counters that make up snapshots returned by Stats().
+	metrics hostClientMetrics
+
+	// Total number of connections that are pending to be established, and that are established and not yet closed.
+	dialing int32
+	open    int32
+
 	// Total number of pending concurrent requests.
 	pendingRequests int32
 
@@ -63,7 +197,181 @@ func (c *HostClient) LastUseTime() time.Time {
 	return time.Unix(startTimeUnix+int64(atomic.LoadUint32(&c.lastUseTime)), 0)
 }
 
+// Stats returns a snapshot of the connections and requests of this client.
+func (c *HostClient) Stats() HostClientStats {
+	var s HostClientStats
+
+	c.metrics.snapshot(&s)
+
+	s.DialingConns = int(atomic.LoadInt32(&c.dialing))
+	s.OpenConns = int(atomic.LoadInt32(&c.open))
+	s.PendingRequests = c.PendingRequests()
+	s.TargetConns = c.maxConns()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s.IdleConns = len(c.conns)
+
+	for _, mc := range c.mconns {
+		if mc.inflight == 0 {
+			s.IdleConns++
+		}
+	}
+
+	for _, queue := range [...]*waitingCallerQueue{c.queue, c.muxQueue} {
+		if queue == nil {
+			continue
+		}
+
+		s.WaitingCallers += queue.waiting()
+
+		for priority, n := range queue.waitingByPriority() {
+			if s.WaitingCallersByPriority == nil {
+				s.WaitingCallersByPriority = make(map[int]int)
+			}
+			s.WaitingCallersByPriority[priority] += n
+		}
+	}
+
+	return s
+}
+
+// BreakerState returns the current state of this client's circuit breaker.
+func (c *HostClient) BreakerState() BreakerState {
+	if c.BreakerThreshold <= 0 {
+		return BreakerClosed
+	}
+	return c.breaker.current(c.breakerOpenDuration())
+}
+
+func (c *HostClient) breakerOpenDuration() time.Duration {
+	if c.BreakerOpenDuration <= 0 {
+		return DefaultBreakerOpenDuration
+	}
+	return c.BreakerOpenDuration
+}
+
+// allowRequest reports whether the circuit breaker lets a request go through, and whether it is a probe request.
+func (c *HostClient) allowRequest() (probe bool, err error) {
+	if c.BreakerThreshold <= 0 {
+		return false, nil
+	}
+
+	maxProbes := c.BreakerHalfOpenProbes
+	if maxProbes <= 0 {
+		maxProbes = DefaultBreakerHalfOpenProbes
+	}
+
+	return c.breaker.allow(c.Addr, c.breakerOpenDuration(), maxProbes)
+}
+
+// doneRequest reports the outcome of a request to the circuit breaker. Failures to dial are reported separately
+// by dialConn.
+func (c *HostClient) doneRequest(probe bool, err error, ioFailure bool) {
+	if c.BreakerThreshold <= 0 {
+		return
+	}
+
+	outcome := breakerNeutral
+	if err == nil {
+		outcome = breakerSuccess
+	} else if ioFailure {
+		outcome = breakerFailure
+	}
+
+	c.breaker.done(probe, outcome, c.BreakerThreshold)
+}
+
+// Shutdown stops this client from accepting new requests, fails all callers waiting for a connection with
+// ErrConnectionClosed, and waits for in-flight requests to complete before closing all open connections. Should ctx
+// be done before in-flight requests complete, all open connections are closed regardless and ctx.Err() is returned.
+// Connections still in use by in-flight requests are closed once the requests complete.
+func (c *HostClient) Shutdown(ctx context.Context) error {
+	var err error
+
+	// Stop the idle connection cleaner, and fail all callers waiting for a connection.
+
+	c.mu.Lock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.doneChanLocked())
+	}
+
+	for _, queue := range [...]*waitingCallerQueue{c.queue, c.muxQueue} {
+		if queue == nil {
+			continue
+		}
+		for queue.len() > 0 {
+			if caller := queue.popFront(); caller != nil && caller.waiting() {
+				caller.tryDeliver(nil, ErrConnectionClosed)
+			}
+		}
+	}
+
+	c.mu.Unlock()
+
+	// Wait for in-flight requests to complete.
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+wait:
+	for c.PendingRequests() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	// Close all idle and multiplexed connections.
+
+	c.mu.Lock()
+
+	conns := c.conns
+	c.conns = nil
+
+	mconns := append([]*muxConn(nil), c.mconns...)
+
+	c.mu.Unlock()
+
+	for i := range conns {
+		c.destroyClientConn(conns[i])
+	}
+
+	for i := range mconns {
+		c.destroyMuxConn(mconns[i], ErrConnectionClosed)
+	}
+
+	return err
+}
+
+// Close shuts down this client, waiting up to DefaultCloseTimeout for in-flight requests to complete.
+func (c *HostClient) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCloseTimeout)
+	defer cancel()
+
+	return c.Shutdown(ctx)
+}
+
+func (c *HostClient) doneChanLocked() chan struct{} {
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+	return c.done
+}
+
 func (c *HostClient) Do(dst []byte, req *Frame) ([]byte, error) {
+	return c.DoContext(context.Background(), dst, req)
+}
+
+// DoContext sends req and appends the response body to dst. Should ctx be done while waiting for a connection,
+// dialing, or writing the request and reading the response, DoContext returns ctx.Err(). A connection that is
+// interrupted mid-write or mid-read is destroyed.
+func (c *HostClient) DoContext(ctx context.Context, dst []byte, req *Frame) ([]byte, error) {
 	var (
 		err   error
 		retry bool
@@ -74,102 +382,213 @@ func (c *HostClient) Do(dst []byte, req *Frame) ([]byte, error) {
 		maxAttempts = DefaultMaxIdempotentCallAttempts
 	}
 
+	policy := c.RetryPolicy
+	if policy == nil {
+		policy = defaultRetryPolicy
+	}
+
+	budgetRatio := c.RetryBudgetRatio
+	if budgetRatio <= 0 {
+		budgetRatio = DefaultRetryBudgetRatio
+	}
+
+	budgetBurst := c.RetryBudgetBurst
+	if budgetBurst <= 0 {
+		budgetBurst = DefaultRetryBudgetBurst
+	}
+
+	c.retryBudget.deposit(budgetRatio, budgetBurst)
+
 	atomic.AddInt32(&c.pendingRequests, 1)
 
-	// Attempt to retry the request maxAttempts times should the request either be idempotent, or if the underlying
-	// connection that the request was being delivered on was closed.
+	start, retries := time.Now(), 0
+
+	// Attempt to retry the request up to maxAttempts times should the request have failed to be delivered, the retry
+	// policy allow for it, and there be enough budget left to retry it.
 
-	for attempts := 0; attempts < maxAttempts; maxAttempts++ {
-		dst, retry, err = c.do(dst, req)
-		if err == nil || !retry {
+	for attempts := 1; ; attempts++ {
+		probe, berr := c.allowRequest()
+		if berr != nil {
+			err = berr
 			break
 		}
 
-		if !req.Idempotent && errors.Is(err, io.EOF) {
+		dst, retry, err = c.do(ctx, dst, req)
+
+		c.doneRequest(probe, err, retry)
+
+		if err == nil || !retry || attempts >= maxAttempts || req.IsBodyStream() {
+			break
+		}
+
+		ok, backoff := policy.Retry(req, err, attempts)
+		if !ok || !c.retryBudget.withdraw(budgetBurst) {
 			break
 		}
+
+		if backoff > 0 && !sleepContext(ctx, backoff) {
+			err = ctx.Err()
+			break
+		}
+
+		retries++
 	}
 
 	atomic.AddInt32(&c.pendingRequests, -1)
 
-	if errors.Is(err, io.EOF) {
-		err = ErrConnectionClosed
-	}
+	c.metrics.recordRequest(time.Since(start), retries, err)
 
 	return dst, err
 }
 
-func (c *HostClient) do(dst []byte, req *Frame) ([]byte, bool, error) {
+func (c *HostClient) do(ctx context.Context, dst []byte, req *Frame) ([]byte, bool, error) {
 	atomic.StoreUint32(&c.lastUseTime, uint32(time.Now().Unix()-startTimeUnix))
 
-	cc, err := c.tryAcquireClientConn(req.Timeout)
+	// Send frames with a body stream over a dedicated connection, as the connection may not be written to by any
+	// other caller until the body stream has been fully written.
+
+	if c.multiplexed() && !req.IsBodyStream() {
+		return c.doMultiplexed(ctx, dst, req)
+	}
+
+	cc, err := c.tryAcquireClientConn(ctx, req)
 	if err != nil {
 		return dst, false, err
 	}
 
 	conn := cc.conn
 
-	// Set write timeout.
+	// Interrupt any pending reads or writes should ctx be done. A connection that has been interrupted may not be
+	// reused.
 
-	if c.WriteTimeout > 0 {
-		if err = conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout)); err != nil {
-			c.destroyClientConn(cc)
-			return dst, true, err
-		}
-	}
+	stop := interruptOnDone(ctx, conn)
 
-	// Write request data.
+	start := time.Now()
 
-	bw := c.acquireWriter(conn)
+	dst, retry, err := c.roundTrip(ctx, cc, dst, req)
+
+	stop()
 
-	err = req.WriteTo(bw)
 	if err == nil {
-		err = bw.Flush()
+		c.observeLatency(time.Since(start))
+	}
+
+	if err == nil && ctx.Err() != nil {
+		c.destroyClientConn(cc)
+		return dst, false, nil
 	}
+
 	if err != nil {
-		c.releaseWriter(bw)
 		c.destroyClientConn(cc)
-		return dst, true, err
+
+		if err := contextErr(ctx); err != nil {
+			return dst, false, err
+		}
+
+		return dst, retry, err
+	}
+
+	c.tryRecycleClientConn(cc)
+
+	return dst, false, nil
+}
+
+// roundTrip writes req to cc, and reads and appends the response body to dst.
+func (c *HostClient) roundTrip(ctx context.Context, cc *clientConn, dst []byte, req *Frame) ([]byte, bool, error) {
+	var err error
+
+	conn := cc.conn
+
+	if err = c.writeRequest(ctx, cc, req); err != nil {
+		return dst, true, c.wrapError(PhaseWrite, err, true)
 	}
-	c.releaseWriter(bw)
 
 	// Set read timeout.
 
-	if c.ReadTimeout > 0 {
-		if err = conn.SetReadDeadline(time.Now().Add(c.ReadTimeout)); err != nil {
-			c.destroyClientConn(cc)
-			return dst, true, err
-		}
+	if err = conn.SetReadDeadline(deadlineOf(ctx, c.ReadTimeout)); err != nil {
+		return dst, true, c.wrapError(PhaseRead, err, true)
 	}
 
-	// TODO(kenta): read response data.
+	// Read response data.
+
+	maxBodySize := c.MaxResponseBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxResponseBodySize
+	}
+
+	n := len(dst)
 
 	br := c.acquireReader(conn)
-	//if dst, err = br.ReadSlice('\n'); err != nil {
-	//	c.releaseReader(br)
-	//	c.destroyClientConn(cc)
-	//	return dst, false, err
-	//}
+	header, err := c.readResponseHeader(br, maxBodySize, cc.codec)
+	if err == nil {
+		dst, err = readDecodedFrameBody(br, header, dst, maxBodySize, cc.codec)
+	}
 	c.releaseReader(br)
+	if err != nil {
+		retry := !errors.Is(err, ErrBodyTooLarge)
+		return dst, retry, c.wrapError(PhaseRead, readErr(err), retry)
+	}
 
-	c.tryRecycleClientConn(cc)
+	c.metrics.recordTraffic(FrameHeaderSize+frameBodyWireSize(header, len(dst)-n), 0)
+
+	return dst, false, nil
+}
+
+// writeRequest writes req to cc.
+func (c *HostClient) writeRequest(ctx context.Context, cc *clientConn, req *Frame) error {
+	// Set write timeout.
+
+	if err := cc.conn.SetWriteDeadline(deadlineOf(ctx, c.WriteTimeout)); err != nil {
+		return err
+	}
+
+	// Write request data.
+
+	bw := c.acquireWriter(cc.conn)
+
+	n, err := req.writeTo(bw, 0, cc.codec, c.compressionThreshold())
+	if err == nil {
+		err = bw.Flush()
+	}
+	c.releaseWriter(bw)
+	if err != nil {
+		return err
+	}
 
-	return dst, false, err
+	c.metrics.recordTraffic(0, n)
+
+	return nil
 }
 
 func (c *HostClient) queueWaitingCaller(caller *waitingCaller) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.queue == nil {
-		c.queue = &waitingCallerQueue{}
+	// Fail the caller immediately should this client have been closed, as it otherwise would never be woken up.
+
+	if c.closed {
+		caller.tryDeliver(nil, ErrClientClosed)
+		return
+	}
+
+	queue := &c.queue
+	if caller.mux {
+		queue = &c.muxQueue
+	}
+
+	if *queue == nil {
+		agingInterval := c.PriorityAgingInterval
+		if agingInterval <= 0 {
+			agingInterval = DefaultPriorityAgingInterval
+		}
+
+		*queue = &waitingCallerQueue{agingInterval: agingInterval}
 	}
 
-	c.queue.clearFront()
-	c.queue.pushBack(caller)
+	(*queue).pushBack(caller)
 }
 
-func (c *HostClient) tryAcquireClientConn(timeout time.Duration) (cc *clientConn, err error) {
+func (c *HostClient) tryAcquireClientConn(ctx context.Context, req *Frame) (cc *clientConn, err error) {
 	var (
 		createConn   bool
 		startCleaner bool
@@ -179,15 +598,17 @@ func (c *HostClient) tryAcquireClientConn(timeout time.Duration) (cc *clientConn
 	// if we have not yet the max number of connections this client may create, establish a new one. If we are
 	// to establish a new connection and the idle connection cleanup worker is not running, run it.
 
+	maxConns := c.maxConns()
+
 	c.mu.Lock()
 
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+
 	n := len(c.conns)
 	if n == 0 {
-		maxConns := c.MaxConns
-		if maxConns <= 0 {
-			maxConns = DefaultMaxConnsPerHost
-		}
-
 		if c.count < maxConns {
 			createConn = true
 
@@ -204,9 +625,40 @@ func (c *HostClient) tryAcquireClientConn(timeout time.Duration) (cc *clientConn
 		c.conns = c.conns[:n]
 	}
 
+	// Establish connections in the background should fewer than MinIdleConns idle connections be available.
+
+	prewarm := c.prewarmLocked(maxConns)
+	if prewarm > 0 && !c.cleanerRunning {
+		c.cleanerRunning, startCleaner = true, true
+	}
+
 	c.mu.Unlock()
 
+	for i := 0; i < prewarm; i++ {
+		go c.prewarm()
+	}
+
+	// Start cleaning up idle connections.
+
+	if startCleaner {
+		go c.cleanupIdleConnections()
+	}
+
+	// Validate the idle connection before handing it out. Should it be dead, close it and try acquire another
+	// connection instead.
+
 	if cc != nil {
+		if err := c.validateIdleConn(ctx, cc); err != nil {
+			c.destroyClientConn(cc)
+			c.metrics.recordIdleConnDiscarded()
+
+			if err := contextErr(ctx); err != nil {
+				return nil, err
+			}
+
+			return c.tryAcquireClientConn(ctx, req)
+		}
+
 		return cc, nil
 	}
 
@@ -215,18 +667,25 @@ func (c *HostClient) tryAcquireClientConn(timeout time.Duration) (cc *clientConn
 
 	if !createConn {
 		// Wait for min(timeout waiting for available connection, request timeout) seconds for an available
-		// connection to perform a read/write against.
+		// connection to perform a read/write against. Should callers not be allowed to wait, grow the pool instead
+		// of denying the caller a connection should it be adaptively sized.
 
 		waitDuration := c.MaxConnWaitTimeout
 
+		if waitDuration <= 0 && c.growPool() {
+			return c.tryAcquireClientConn(ctx, req)
+		}
+
+		c.observeWait()
+
 		if waitDuration <= 0 {
-			return cc, ErrNoFreeConns
+			return cc, c.wrapError(PhasePoolWait, ErrNoFreeConns, true)
 		}
 
 		waitDurationOverridden := false
 
-		if waitDurationOverridden = timeout > 0 && timeout < waitDuration; waitDurationOverridden {
-			waitDuration = timeout
+		if waitDurationOverridden = req.Timeout > 0 && req.Timeout < waitDuration; waitDurationOverridden {
+			waitDuration = req.Timeout
 		}
 
 		timer := AcquireTimer(waitDuration)
@@ -234,7 +693,7 @@ func (c *HostClient) tryAcquireClientConn(timeout time.Duration) (cc *clientConn
 
 		// Enter the caller into the waiting queue.
 
-		caller := &waitingCaller{ready: make(chan struct{}, 1)}
+		caller := &waitingCaller{ready: make(chan struct{}, 1), priority: req.Priority, queuedAt: time.Now()}
 		defer func() {
 			if err != nil {
 				caller.cancel(c, err)
@@ -243,32 +702,29 @@ func (c *HostClient) tryAcquireClientConn(timeout time.Duration) (cc *clientConn
 
 		c.queueWaitingCaller(caller)
 
+		start := time.Now()
+		defer func() { c.metrics.recordConnWait(time.Since(start)) }()
+
 		// If a connection becomes available, return it to the caller. If the caller is waiting too long,
 		// then either timeout if the caller was making a request, or tell the caller they waited too long
 		// and that there are no free connections available for them.
 
 		select {
 		case <-caller.ready:
-			return caller.conn, caller.err
+			return caller.conn, c.wrapError(PhasePoolWait, caller.err, true)
+		case <-ctx.Done():
+			return cc, ctx.Err()
 		case <-timer.C:
 			if waitDurationOverridden {
-				return cc, ErrTimeout
+				return cc, c.wrapError(PhasePoolWait, ErrTimeout, false)
 			}
-			return cc, ErrNoFreeConns
+			return cc, c.wrapError(PhasePoolWait, ErrNoFreeConns, true)
 		}
 	}
 
-	// Start cleaning up idle connections.
-
-	if startCleaner {
-		go c.cleanupIdleConnections()
-	}
-
-	fmt.Println("dialing...")
-
 	// Initialize the connection.
 
-	conn, err := dialAddr(c.Addr, c.Dial, c.DialDualStack)
+	conn, codec, err := c.dialConn(ctx)
 	if err != nil {
 		// Either decrease total open/pending connections, or if a waiting caller is available, start dialing one
 		// for them.
@@ -277,37 +733,102 @@ func (c *HostClient) tryAcquireClientConn(timeout time.Duration) (cc *clientConn
 		return cc, err
 	}
 
-	cc = acquireClientConn(conn)
+	cc = acquireClientConn(conn, codec)
 
 	return cc, err
 }
 
+// dialConn establishes a new connection to c.Addr, keeping track of the number of connections that are pending to
+// be established and of the outcome of dialing. TCP keepalives are configured on the connection before any
+// handshakes are performed over it. Should TLSConfig, Codecs or OnConnect be set, the connection is only considered
+// to be established once its TLS handshake, codec negotiation and OnConnect have completed, in that order. The codec
+// negotiated for the connection is returned alongside it.
+func (c *HostClient) dialConn(ctx context.Context) (net.Conn, Codec, error) {
+	atomic.AddInt32(&c.dialing, 1)
+	defer atomic.AddInt32(&c.dialing, -1)
+
+	conn, err := dialAddr(ctx, c.Addr, c.Dial, c.DialContext, c.DialDualStack)
+	if err == nil {
+		if err = setKeepAlive(conn, c.KeepAlivePeriod); err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+	if err != nil {
+		err = c.wrapError(PhaseDial, err, !errors.Is(err, ErrProxyAuthFailed))
+	}
+	if err == nil && c.TLSConfig != nil {
+		if conn, err = c.handshakeTLS(ctx, conn); err != nil {
+			err = c.wrapError(PhaseHandshake, err, isTimeout(err))
+		}
+	}
+
+	var codec Codec
+
+	if err == nil && len(c.Codecs) > 0 {
+		if codec, err = c.negotiateCodec(ctx, conn); err != nil {
+			conn = nil
+			err = c.wrapError(PhaseHandshake, err, isTimeout(err))
+		}
+	}
+	if err == nil && c.OnConnect != nil {
+		if err = c.onConnect(ctx, conn); err != nil {
+			conn = nil
+			err = c.wrapError(PhaseHandshake, err, isTimeout(err))
+		}
+	}
+
+	c.metrics.recordDial(err)
+
+	if err != nil && ctx.Err() == nil && c.BreakerThreshold > 0 {
+		c.breaker.fail(c.BreakerThreshold)
+	}
+
+	if err == nil {
+		atomic.AddInt32(&c.open, 1)
+	}
+
+	if err == nil && c.MinIdleConns > 0 {
+		c.resetPrewarmBackoff()
+	}
+
+	return conn, codec, err
+}
+
 func (c *HostClient) tryRecycleClientConn(cc *clientConn) {
 	cc.lastUseTime = time.Now()
 
+	maxConns := c.maxConns()
+
+	c.mu.Lock()
+
+	// If this client has been closed, close the *clientConn rather than push it back to the list of available idle
+	// connections.
+
+	if c.closed {
+		c.mu.Unlock()
+		c.destroyClientConn(cc)
+		return
+	}
+
+	defer c.mu.Unlock()
+
 	// If no wait timeout is specified, immediately push the *clientConn to the list of available
 	// idle connections.
 
 	if c.MaxConnWaitTimeout <= 0 {
-		c.mu.Lock()
-		defer c.mu.Unlock()
-
-		c.conns = append(c.conns, cc)
-
+		c.pushIdleClientConnLocked(cc, maxConns)
 		return
 	}
 
 	// If there are callers waiting and timing out for an open connection, try deliver this *clientConn to them. Else,
 	// push it back to the list of available idle connections.
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	delivered := false
 
 	if queue := c.queue; queue != nil && queue.len() > 0 {
 		for queue.len() > 0 {
-			if caller := queue.popFront(); caller.waiting() {
+			if caller := queue.popFront(); caller != nil && caller.waiting() {
 				delivered = caller.tryDeliver(cc, nil)
 				break
 			}
@@ -315,12 +836,23 @@ func (c *HostClient) tryRecycleClientConn(cc *clientConn) {
 	}
 
 	if !delivered {
-		c.conns = append(c.conns, cc)
+		c.pushIdleClientConnLocked(cc, maxConns)
+	}
+}
+
+// pushIdleClientConnLocked pushes cc to the list of available idle connections. Should the pool have shrunk such that
+// there are more connections than the pool may hold, cc is closed in the background instead.
+func (c *HostClient) pushIdleClientConnLocked(cc *clientConn, maxConns int) {
+	if c.count > maxConns {
+		go c.destroyClientConn(cc)
+		return
 	}
+
+	c.conns = append(c.conns, cc)
 }
 
 func (c *HostClient) tryDialForWaitingCaller(caller *waitingCaller) {
-	conn, err := dialAddr(c.Addr, c.Dial, c.DialDualStack)
+	conn, codec, err := c.dialConn(context.Background())
 	if err != nil {
 		// Notify to the caller that there was an error dialing the connection.
 		caller.tryDeliver(nil, err)
@@ -332,7 +864,7 @@ func (c *HostClient) tryDialForWaitingCaller(caller *waitingCaller) {
 		return
 	}
 
-	cc := acquireClientConn(conn)
+	cc := acquireClientConn(conn, codec)
 
 	// Try deliver the acquired *clientConn to the caller. If somehow an error or *clientConn was already
 	// provided to the caller however, release this acquired *clientConn.
@@ -343,29 +875,26 @@ func (c *HostClient) tryDialForWaitingCaller(caller *waitingCaller) {
 }
 
 func (c *HostClient) decrementCountOrTryDialForWaitingCaller() {
-	// If no wait timeout is specified, which implies that there cannot be any waiting callers, immediately decrease
-	// the number of open/pending connections.
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	if c.MaxConnWaitTimeout <= 0 {
-		c.mu.Lock()
-		defer c.mu.Unlock()
+	// If no wait timeout is specified, which implies that there cannot be any waiting callers, or if this client has
+	// been closed, immediately decrease the number of open/pending connections.
 
+	if c.MaxConnWaitTimeout <= 0 || c.closed {
 		c.count--
-
 		return
 	}
 
-	// If there are callers waiting and timing out for a pending/open connection, try dial a connection for them. If
-	// there are no callers, decrease the number of open/pending connections.
-
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	// If there are callers waiting and timing out for a pending/open connection, try dial a connection for them.
+	// Otherwise, should there be callers waiting for a slot on a multiplexed connection, establish a multiplexed
+	// connection for them. If there are no callers, decrease the number of open/pending connections.
 
 	dialing := false
 
 	if queue := c.queue; queue != nil && queue.len() > 0 {
 		for queue.len() > 0 {
-			if caller := queue.popFront(); caller.waiting() {
+			if caller := queue.popFront(); caller != nil && caller.waiting() {
 				go c.tryDialForWaitingCaller(caller)
 				dialing = true
 				break
@@ -373,6 +902,10 @@ func (c *HostClient) decrementCountOrTryDialForWaitingCaller() {
 		}
 	}
 
+	if !dialing {
+		dialing = c.tryDialForWaitingMuxCallerLocked()
+	}
+
 	if !dialing {
 		c.count--
 	}
@@ -384,6 +917,7 @@ func (c *HostClient) destroyClientConn(cc *clientConn) {
 
 	// Close *clientConn's underlying connection.
 	cc.conn.Close()
+	atomic.AddInt32(&c.open, -1)
 
 	// Release resources.
 	releaseClientConn(cc)
@@ -433,6 +967,10 @@ func (c *HostClient) cleanupIdleConnections() {
 		maxIdleConnDuration = DefaultMaxIdleConnDuration
 	}
 
+	c.mu.Lock()
+	done := c.doneChanLocked()
+	c.mu.Unlock()
+
 	for {
 		currentTime := time.Now()
 
@@ -443,9 +981,10 @@ func (c *HostClient) cleanupIdleConnections() {
 		conns := c.conns
 		i, n := 0, len(conns)
 
-		// Find the first connection that has been idle more than the max idle duration.
+		// Find the first connection that has been idle more than the max idle duration, keeping at least
+		// MinIdleConns idle connections around.
 
-		for i < n && currentTime.Sub(conns[i].lastUseTime) > maxIdleConnDuration {
+		for i < n && i < n-c.MinIdleConns && currentTime.Sub(conns[i].lastUseTime) > maxIdleConnDuration {
 			i++
 		}
 
@@ -479,20 +1018,34 @@ func (c *HostClient) cleanupIdleConnections() {
 			scratch[i] = nil
 		}
 
-		// Stop this cleaning goroutine if no connections are left.
+		reaped := len(scratch) + c.cleanupIdleMuxConns(currentTime, maxIdleConnDuration)
+		if reaped > 0 {
+			c.metrics.recordReaped(reaped)
+		}
+
+		// Stop this cleaning goroutine if no connections are left, or if this client has been closed.
 
 		c.mu.Lock()
-		mustStop := c.count == 0
+		mustStop := c.count == 0 || c.closed
+		if mustStop {
+			c.cleanerRunning = false
+		}
 		c.mu.Unlock()
 
 		if mustStop {
-			c.cleanerRunning = false
 			break
 		}
 
 		// If this cleanup goroutine is to not stop, wait the duration we expect until a connection
-		// might possibly be idle and thus meant to be cleaned up.
+		// might possibly be idle and thus meant to be cleaned up, or until this client is closed.
+
+		timer := AcquireTimer(duration)
+
+		select {
+		case <-done:
+		case <-timer.C:
+		}
 
-		time.Sleep(duration)
+		ReleaseTimer(timer)
 	}
 }
@@ -0,0 +1,228 @@
+package sleepytcp
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHostClientDoContextCancelMidRead(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		<-release
+	})
+
+	c := &HostClient{Addr: addr}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := c.DoContext(ctx, nil, req)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// The interrupted connection should have been destroyed.
+
+	c.mu.Lock()
+	require.EqualValues(t, 0, c.count)
+	require.Len(t, c.conns, 0)
+	c.mu.Unlock()
+}
+
+func TestHostClientDoContextCancelWhileWaiting(t *testing.T) {
+	release := make(chan struct{})
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		<-release
+	})
+
+	c := &HostClient{Addr: addr, MaxConns: 1, MaxConnWaitTimeout: time.Minute}
+
+	done := make(chan error, 1)
+
+	go func() {
+		req := AcquireFrame()
+		defer ReleaseFrame(req)
+
+		_, err := c.Do(nil, req)
+		done <- err
+	}()
+
+	// Wait for the only connection to be occupied.
+
+	require.Eventually(t, func() bool { return c.PendingRequests() == 1 }, time.Second, time.Millisecond)
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err := c.DoContext(ctx, nil, req)
+	require.Equal(t, context.Canceled, err)
+
+	close(release)
+	require.NoError(t, <-done)
+}
+
+func TestHostClientDoContextCancelWhileDialing(t *testing.T) {
+	dialing := make(chan struct{})
+
+	c := &HostClient{
+		Addr: "peer",
+		DialContext: func(ctx context.Context, addr string) (net.Conn, error) {
+			close(dialing)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		<-dialing
+		cancel()
+	}()
+
+	_, err := c.DoContext(ctx, nil, req)
+	require.Equal(t, context.Canceled, err)
+
+	c.mu.Lock()
+	require.EqualValues(t, 0, c.count)
+	c.mu.Unlock()
+}
+
+func TestHostClientShutdown(t *testing.T) {
+	release := make(chan struct{})
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		<-release
+		resp.SetBody(req.Body())
+	})
+
+	c := &HostClient{Addr: addr, MaxConns: 1, MaxConnWaitTimeout: time.Minute}
+
+	inflight := make(chan error, 1)
+	go func() {
+		req := AcquireFrame()
+		defer ReleaseFrame(req)
+
+		_, err := c.Do(nil, req)
+		inflight <- err
+	}()
+
+	require.Eventually(t, func() bool { return c.PendingRequests() == 1 }, time.Second, time.Millisecond)
+
+	// Queue a caller behind the in-flight request.
+
+	queued := make(chan error, 1)
+	go func() {
+		req := AcquireFrame()
+		defer ReleaseFrame(req)
+
+		_, err := c.Do(nil, req)
+		queued <- err
+	}()
+
+	require.Eventually(t, func() bool { return c.Stats().WaitingCallers == 1 }, time.Second, time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- c.Shutdown(context.Background()) }()
+
+	// The queued caller should be failed immediately, while the in-flight request should be waited on.
+
+	require.True(t, errors.Is(<-queued, ErrConnectionClosed))
+
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned before in-flight request completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	require.NoError(t, <-inflight)
+	require.NoError(t, <-shutdown)
+
+	// All connections should have been closed, and new requests should be rejected.
+
+	c.mu.Lock()
+	require.EqualValues(t, 0, c.count)
+	require.Len(t, c.conns, 0)
+	c.mu.Unlock()
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	_, err := c.Do(nil, req)
+	require.Equal(t, ErrClientClosed, err)
+}
+
+func TestHostClientShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		<-release
+	})
+
+	c := &HostClient{Addr: addr}
+
+	go func() {
+		req := AcquireFrame()
+		defer ReleaseFrame(req)
+
+		c.Do(nil, req)
+	}()
+
+	require.Eventually(t, func() bool { return c.PendingRequests() == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	require.Equal(t, context.DeadlineExceeded, c.Shutdown(ctx))
+}
+
+func TestClientClose(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	c := &Client{}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.SetAddr(addr)
+	req.SetBody([]byte("hello"))
+
+	res, err := c.Do(nil, req)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	c.mu.Lock()
+	hc := c.clients[addr]
+	c.mu.Unlock()
+
+	require.NoError(t, c.Close())
+
+	// The idle connection should have been closed, and the cleaners should have stopped.
+
+	require.Eventually(t, func() bool {
+		hc.mu.Lock()
+		defer hc.mu.Unlock()
+
+		return hc.count == 0 && len(hc.conns) == 0 && !hc.cleanerRunning
+	}, time.Second, time.Millisecond)
+
+	_, err = c.Do(nil, req)
+	require.Equal(t, ErrClientClosed, err)
+}
@@ -0,0 +1,581 @@
+package sleepytcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// muxConn is a connection over which requests tagged with request IDs are multiplexed. Responses are read by a
+// single background goroutine, and matched back to their callers by request ID.
+type muxConn struct {
+	conn net.Conn
+
+	// Codec negotiated for conn. Like conn, it is set before ready is closed.
+	codec Codec
+
+	// Closed once conn has either been established, or failed to be established.
+	ready chan struct{}
+
+	// Number of in-flight requests, and the last time a request was completed. Protected by HostClient.mu.
+	inflight    int
+	lastUseTime time.Time
+
+	// Protects writes to conn.
+	wmu sync.Mutex
+
+	mu     sync.Mutex // protects calls, nextID, err
+	calls  map[uint32]*muxCall
+	nextID uint32
+	err    error
+}
+
+type muxCall struct {
+	dst  []byte
+	err  error
+	done chan struct{}
+}
+
+// register assigns a request ID to call, and reports an error should mc no longer be usable.
+func (mc *muxConn) register(call *muxCall) (uint32, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.err != nil {
+		return 0, mc.err
+	}
+
+	// Request IDs wrap around before they reach the bits that flag pushed, compressed and negotiation frames.
+
+	mc.nextID = (mc.nextID + 1) & frameIDMask
+	mc.calls[mc.nextID] = call
+
+	return mc.nextID, nil
+}
+
+// take removes and returns the call tagged with the request ID id. It returns nil if the call was either never
+// registered, or was abandoned by its caller.
+func (mc *muxConn) take(id uint32) *muxCall {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	call := mc.calls[id]
+	delete(mc.calls, id)
+
+	return call
+}
+
+// doMultiplexed sends req over a multiplexed connection. Should ctx be done while a request is being written, the
+// connection is destroyed. Should ctx be done while waiting for a response, the response is abandoned and the
+// connection is left open for other callers.
+func (c *HostClient) doMultiplexed(ctx context.Context, dst []byte, req *Frame) ([]byte, bool, error) {
+	mc, err := c.acquireMuxConn(ctx, req)
+	if err != nil {
+		return dst, false, err
+	}
+	defer c.releaseMuxConn(mc)
+
+	call := &muxCall{dst: dst, done: make(chan struct{})}
+
+	id, err := mc.register(call)
+	if err != nil {
+		return dst, true, c.wrapError(PhaseWrite, err, true)
+	}
+
+	start := time.Now()
+
+	// Write request data.
+
+	if err = c.writeMuxFrame(ctx, mc, id, req); err != nil {
+		err = c.wrapError(PhaseWrite, err, true)
+
+		c.destroyMuxConn(mc, err)
+		<-call.done
+
+		if err := contextErr(ctx); err != nil {
+			return dst, false, err
+		}
+
+		return dst, true, err
+	}
+
+	// Wait for the response to be read by the background reader. If the response is not already being read by the
+	// time we stop waiting, abandon the call. The response, should it arrive later, will be discarded.
+
+	var timeout <-chan time.Time
+
+	if c.ReadTimeout > 0 {
+		timer := AcquireTimer(c.ReadTimeout)
+		defer ReleaseTimer(timer)
+
+		timeout = timer.C
+	}
+
+	select {
+	case <-call.done:
+	case <-timeout:
+		if mc.take(id) != nil {
+			return dst, false, c.wrapError(PhaseRead, ErrTimeout, false)
+		}
+		<-call.done
+	case <-ctx.Done():
+		if mc.take(id) != nil {
+			return dst, false, ctx.Err()
+		}
+		<-call.done
+	}
+
+	if call.err != nil {
+		retry := !errors.Is(call.err, ErrBodyTooLarge)
+		return call.dst, retry, c.wrapError(PhaseRead, call.err, retry)
+	}
+
+	c.observeLatency(time.Since(start))
+
+	return call.dst, false, nil
+}
+
+func (c *HostClient) writeMuxFrame(ctx context.Context, mc *muxConn, id uint32, req *Frame) error {
+	mc.wmu.Lock()
+	defer mc.wmu.Unlock()
+
+	if err := mc.conn.SetWriteDeadline(deadlineOf(ctx, c.WriteTimeout)); err != nil {
+		return err
+	}
+
+	// Only interrupt writes should ctx be done. Pending reads are shared with other callers.
+
+	stop := interruptWithDeadline(ctx, mc.conn.SetWriteDeadline)
+	defer stop()
+
+	bw := c.acquireWriter(mc.conn)
+	defer c.releaseWriter(bw)
+
+	n, err := req.writeTo(bw, id, mc.codec, c.compressionThreshold())
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		c.metrics.recordTraffic(0, n)
+		err = c.extendMuxLiveness(mc)
+	}
+
+	return err
+}
+
+// extendMuxLiveness sets the read deadline of mc to MuxLivenessTimeout from now should mc have in-flight requests,
+// such that the goroutine reading responses off of mc destroys mc should the peer stop responding. The read deadline
+// is cleared should mc have no in-flight requests, as idle connections are closed by TCP keepalives and by the idle
+// connection cleaner instead.
+func (c *HostClient) extendMuxLiveness(mc *muxConn) error {
+	timeout := c.MuxLivenessTimeout
+	if timeout <= 0 {
+		timeout = DefaultMuxLivenessTimeout
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	var deadline time.Time
+	if len(mc.calls) > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	return mc.conn.SetReadDeadline(deadline)
+}
+
+// acquireMuxConn reserves a request slot on the least loaded multiplexed connection that has not yet hit
+// MaxInflightPerConn in-flight requests. Should all connections be at capacity, a new connection is established.
+// Should MaxConns connections already be established, the caller waits for a slot to free up.
+//
+// Connections are established in the background such that concurrent callers may share them. Should ctx be done
+// while waiting for a connection to be established, the caller stops waiting but the connection is still
+// established for future callers.
+func (c *HostClient) acquireMuxConn(ctx context.Context, req *Frame) (*muxConn, error) {
+	maxInflight := c.MaxInflightPerConn
+	if maxInflight <= 0 {
+		maxInflight = DefaultMaxInflightPerConn
+	}
+
+	maxConns := c.maxConns()
+
+	startCleaner := false
+
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+
+	var mc *muxConn
+
+	for _, candidate := range c.mconns {
+		if candidate.inflight >= maxInflight {
+			continue
+		}
+		if mc == nil || candidate.inflight < mc.inflight {
+			mc = candidate
+		}
+	}
+
+	// If no connection with a free slot is available, register a connection that is pending to be established such
+	// that concurrent callers may reserve slots on it rather than establish connections of their own.
+
+	if mc == nil && c.count < maxConns {
+		mc = c.newMuxConnLocked()
+		c.count++
+
+		if !c.cleanerRunning {
+			c.cleanerRunning, startCleaner = true, true
+		}
+	}
+
+	// Reserve a slot, and wait for the connection should it still be in the midst of being established.
+
+	if mc != nil {
+		mc.inflight++
+	}
+
+	c.mu.Unlock()
+
+	if startCleaner {
+		go c.cleanupIdleConnections()
+	}
+
+	if mc == nil {
+		var err error
+		if mc, err = c.waitMuxConn(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+
+	select {
+	case <-mc.ready:
+	case <-ctx.Done():
+		c.releaseMuxConn(mc)
+		return nil, ctx.Err()
+	}
+
+	if mc.conn == nil {
+		c.releaseMuxConn(mc)
+
+		mc.mu.Lock()
+		err := mc.err
+		mc.mu.Unlock()
+
+		return nil, err
+	}
+
+	return mc, nil
+}
+
+// waitMuxConn waits for up to MaxConnWaitTimeout for a slot on a multiplexed connection to be handed over to the
+// caller, either by a caller releasing its slot or by a connection being established in place of one that was
+// closed. Callers are handed slots in the same order of priority as callers waiting for pooled connections.
+func (c *HostClient) waitMuxConn(ctx context.Context, req *Frame) (mc *muxConn, err error) {
+	// Wait for min(timeout waiting for available connection, request timeout) seconds for a slot. Should callers not
+	// be allowed to wait, grow the pool instead of denying the caller a slot should it be adaptively sized.
+
+	waitDuration := c.MaxConnWaitTimeout
+
+	if waitDuration <= 0 && c.growPool() {
+		return c.acquireMuxConn(ctx, req)
+	}
+
+	c.observeWait()
+
+	if waitDuration <= 0 {
+		return nil, c.wrapError(PhasePoolWait, ErrNoFreeConns, true)
+	}
+
+	waitDurationOverridden := false
+
+	if waitDurationOverridden = req.Timeout > 0 && req.Timeout < waitDuration; waitDurationOverridden {
+		waitDuration = req.Timeout
+	}
+
+	timer := AcquireTimer(waitDuration)
+	defer ReleaseTimer(timer)
+
+	// Enter the caller into the waiting queue.
+
+	caller := &waitingCaller{ready: make(chan struct{}, 1), mux: true, priority: req.Priority, queuedAt: time.Now()}
+	defer func() {
+		if err != nil {
+			caller.cancel(c, err)
+		}
+	}()
+
+	c.queueWaitingCaller(caller)
+
+	start := time.Now()
+	defer func() { c.metrics.recordConnWait(time.Since(start)) }()
+
+	select {
+	case <-caller.ready:
+		if caller.err != nil {
+			return nil, c.wrapError(PhasePoolWait, caller.err, true)
+		}
+		return caller.mconn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		if waitDurationOverridden {
+			return nil, c.wrapError(PhasePoolWait, ErrTimeout, false)
+		}
+		return nil, c.wrapError(PhasePoolWait, ErrNoFreeConns, true)
+	}
+}
+
+// newMuxConnLocked registers a multiplexed connection that is pending to be established, and establishes it in the
+// background. The caller accounts for it in c.count.
+func (c *HostClient) newMuxConnLocked() *muxConn {
+	mc := &muxConn{
+		ready:       make(chan struct{}),
+		lastUseTime: time.Now(),
+		calls:       make(map[uint32]*muxCall),
+	}
+
+	c.mconns = append(c.mconns, mc)
+
+	go c.dialMuxConn(mc)
+
+	return mc
+}
+
+// tryDialForWaitingMuxCallerLocked establishes a multiplexed connection in place of one that was closed for the
+// first caller waiting for a slot on a multiplexed connection, and reports whether there was such a caller.
+func (c *HostClient) tryDialForWaitingMuxCallerLocked() bool {
+	queue := c.muxQueue
+	if queue == nil {
+		return false
+	}
+
+	for queue.len() > 0 {
+		caller := queue.popFront()
+		if caller == nil || !caller.waiting() {
+			continue
+		}
+
+		mc := c.newMuxConnLocked()
+		mc.inflight++
+
+		if !caller.tryDeliverMuxConn(mc) {
+			mc.inflight--
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func (c *HostClient) dialMuxConn(mc *muxConn) {
+	conn, codec, err := c.dialConn(context.Background())
+	if err != nil {
+		c.destroyMuxConn(mc, err)
+		close(mc.ready)
+		return
+	}
+
+	// Should mc have been destroyed while it was being established (i.e. should the client have been closed), close
+	// the connection.
+
+	mc.mu.Lock()
+	err = mc.err
+	if err == nil {
+		mc.conn = conn
+		mc.codec = codec
+	}
+	mc.mu.Unlock()
+
+	close(mc.ready)
+
+	if err != nil {
+		conn.Close()
+		atomic.AddInt32(&c.open, -1)
+		return
+	}
+
+	go c.readMuxConn(mc)
+}
+
+// releaseMuxConn releases a slot reserved on mc. Should mc still be open, the slot is handed over to the first caller
+// waiting for a slot on a multiplexed connection instead.
+func (c *HostClient) releaseMuxConn(mc *muxConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mc.lastUseTime = time.Now()
+
+	if queue := c.muxQueue; queue != nil && c.hasMuxConnLocked(mc) {
+		for queue.len() > 0 {
+			if caller := queue.popFront(); caller != nil && caller.waiting() && caller.tryDeliverMuxConn(mc) {
+				return
+			}
+		}
+	}
+
+	mc.inflight--
+}
+
+// hasMuxConnLocked reports whether mc is still open, or pending to be established.
+func (c *HostClient) hasMuxConnLocked(mc *muxConn) bool {
+	for _, candidate := range c.mconns {
+		if candidate == mc {
+			return true
+		}
+	}
+	return false
+}
+
+// readMuxConn reads responses from mc and delivers them to their callers until mc is destroyed.
+func (c *HostClient) readMuxConn(mc *muxConn) {
+	maxBodySize := c.MaxResponseBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxResponseBodySize
+	}
+
+	br := c.acquireReader(mc.conn)
+	defer c.releaseReader(br)
+
+	for {
+		// Fail all in-flight requests should the peer send nothing for MuxLivenessTimeout while requests are
+		// in-flight.
+
+		err := c.extendMuxLiveness(mc)
+		if err != nil {
+			c.destroyMuxConn(mc, c.wrapError(PhaseRead, err, true))
+			return
+		}
+
+		header, err := c.readResponseHeader(br, maxBodySize, mc.codec)
+		if err != nil {
+			c.destroyMuxConn(mc, c.wrapError(PhaseRead, readErr(err), true))
+			return
+		}
+
+		// Discard responses to calls that were abandoned, or that are too large.
+
+		call := mc.take(header.requestID())
+		if call == nil || (!header.chunked() && maxBodySize > 0 && int(header.size) > maxBodySize) {
+			if err = discardFrameBody(br, header); err != nil {
+				err = c.wrapError(PhaseRead, readErr(err), true)
+				if call != nil {
+					call.err = err
+					close(call.done)
+				}
+				c.destroyMuxConn(mc, err)
+				return
+			}
+
+			if call != nil {
+				call.err = errBodyTooLarge(int(header.size), maxBodySize)
+				close(call.done)
+			}
+
+			continue
+		}
+
+		n := len(call.dst)
+
+		call.dst, call.err = readDecodedFrameBody(br, header, call.dst, maxBodySize, mc.codec)
+		if call.err == nil {
+			c.metrics.recordTraffic(FrameHeaderSize+frameBodyWireSize(header, len(call.dst)-n), 0)
+		}
+		close(call.done)
+
+		// Should the body have failed to be read, only the call it was addressed to fails with the error it was read
+		// with. Other in-flight calls may be retried over another connection.
+
+		if call.err != nil {
+			err = readErr(call.err)
+			if errors.Is(err, ErrBodyTooLarge) {
+				err = ErrConnectionClosed
+			}
+			c.destroyMuxConn(mc, c.wrapError(PhaseRead, err, true))
+			return
+		}
+	}
+}
+
+// destroyMuxConn closes mc, and fails all of its in-flight calls with err.
+func (c *HostClient) destroyMuxConn(mc *muxConn, err error) {
+	mc.mu.Lock()
+	if mc.err != nil {
+		mc.mu.Unlock()
+		return
+	}
+
+	mc.err = err
+
+	calls := mc.calls
+	mc.calls = nil
+
+	conn := mc.conn
+	mc.mu.Unlock()
+
+	for _, call := range calls {
+		call.err = err
+		close(call.done)
+	}
+
+	if conn != nil {
+		conn.Close()
+		atomic.AddInt32(&c.open, -1)
+	}
+
+	c.mu.Lock()
+	for i := range c.mconns {
+		if c.mconns[i] != mc {
+			continue
+		}
+
+		n := len(c.mconns) - 1
+		c.mconns[i] = c.mconns[n]
+		c.mconns[n] = nil
+		c.mconns = c.mconns[:n]
+
+		break
+	}
+	c.mu.Unlock()
+
+	// Either decrease total open/pending connections, or if a waiting caller is available, start dialing one for them.
+	c.decrementCountOrTryDialForWaitingCaller()
+}
+
+// cleanupIdleMuxConns closes all multiplexed connections that have no in-flight requests and have been idle for
+// longer than maxIdleConnDuration. It returns the number of connections closed.
+func (c *HostClient) cleanupIdleMuxConns(currentTime time.Time, maxIdleConnDuration time.Duration) int {
+	var scratch []*muxConn
+
+	// Remove idle connections from the list of open connections first such that no caller may reserve a slot on
+	// them while they are being closed.
+
+	c.mu.Lock()
+
+	mconns := c.mconns[:0]
+	for _, mc := range c.mconns {
+		if mc.inflight == 0 && currentTime.Sub(mc.lastUseTime) > maxIdleConnDuration {
+			scratch = append(scratch, mc)
+			continue
+		}
+		mconns = append(mconns, mc)
+	}
+	for i := len(mconns); i < len(c.mconns); i++ {
+		c.mconns[i] = nil
+	}
+	c.mconns = mconns
+
+	c.mu.Unlock()
+
+	for i := range scratch {
+		c.destroyMuxConn(scratch[i], ErrConnectionClosed)
+	}
+
+	return len(scratch)
+}
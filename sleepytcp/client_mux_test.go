@@ -0,0 +1,223 @@
+package sleepytcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMultiplexedOutOfOrderResponses(t *testing.T) {
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		time.Sleep(time.Duration(rand.Intn(10)) * time.Millisecond)
+		resp.SetBody(req.Body())
+	})
+
+	c := &HostClient{Addr: addr, Multiplexed: true, MaxInflightPerConn: 16}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			req := AcquireFrame()
+			defer ReleaseFrame(req)
+
+			for j := 0; j < 10; j++ {
+				body := strconv.Itoa(i) + ":" + strconv.Itoa(j)
+				req.SetBody([]byte(body))
+
+				res, err := c.Do(nil, req)
+				require.NoError(t, err)
+				require.EqualValues(t, body, res)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	// At most 64 requests were in-flight at once, so at most 64 / 16 connections should have been established.
+
+	c.mu.Lock()
+	require.LessOrEqual(t, c.count, 4)
+	require.Len(t, c.mconns, c.count)
+	c.mu.Unlock()
+}
+
+func TestMultiplexedWaitForSlot(t *testing.T) {
+	release := make(chan struct{})
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		if string(req.Body()) == "block" {
+			<-release
+		}
+		resp.SetBody(req.Body())
+	})
+
+	c := &HostClient{
+		Addr:               addr,
+		Multiplexed:        true,
+		MaxConns:           1,
+		MaxInflightPerConn: 1,
+		MaxConnWaitTimeout: time.Minute,
+	}
+
+	do := func(body string, priority int, done chan<- string) {
+		req := AcquireFrame()
+		defer ReleaseFrame(req)
+
+		req.SetBody([]byte(body))
+		req.Priority = priority
+
+		res, err := c.Do(nil, req)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+
+		done <- string(res)
+	}
+
+	done := make(chan string, 3)
+
+	go do("block", 0, done)
+	require.Eventually(t, func() bool { return c.PendingRequests() == 1 }, time.Second, time.Millisecond)
+
+	// Callers should wait for a slot to free up on the only connection in order of priority.
+
+	go do("low", 0, done)
+	require.Eventually(t, func() bool { return c.Stats().WaitingCallers == 1 }, time.Second, time.Millisecond)
+
+	go do("high", 1, done)
+	require.Eventually(t, func() bool { return c.Stats().WaitingCallers == 2 }, time.Second, time.Millisecond)
+
+	close(release)
+
+	require.Equal(t, "block", <-done)
+	require.Equal(t, "high", <-done)
+	require.Equal(t, "low", <-done)
+
+	c.mu.Lock()
+	require.EqualValues(t, 1, c.count)
+	c.mu.Unlock()
+}
+
+func TestMultiplexedNoFreeConns(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		<-release
+	})
+
+	c := &HostClient{Addr: addr, Multiplexed: true, MaxConns: 1, MaxInflightPerConn: 1}
+
+	go func() {
+		req := AcquireFrame()
+		defer ReleaseFrame(req)
+
+		c.Do(nil, req)
+	}()
+	require.Eventually(t, func() bool { return c.PendingRequests() == 1 }, time.Second, time.Millisecond)
+
+	// Without MaxConnWaitTimeout, callers should not wait for a slot to free up.
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	_, err := c.Do(nil, req)
+	require.True(t, errors.Is(err, ErrNoFreeConns))
+}
+
+func TestMultiplexedLivenessTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		<-release
+	})
+
+	c := &HostClient{Addr: addr, Multiplexed: true, MuxLivenessTimeout: 50 * time.Millisecond}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	// Without ReadTimeout, in-flight requests should fail once the peer has sent nothing for MuxLivenessTimeout.
+
+	start := time.Now()
+
+	_, err := c.Do(nil, req)
+	require.Error(t, err)
+	require.True(t, isTimeout(err))
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	c.mu.Lock()
+	require.Len(t, c.mconns, 0)
+	c.mu.Unlock()
+}
+
+func TestMultiplexedBodyTooLarge(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	var slow int32
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		switch string(req.Body()) {
+		case "large":
+			resp.SetBodyStream(bytes.NewReader(make([]byte, 4096)), -1)
+		case "slow":
+			if atomic.AddInt32(&slow, 1) == 1 {
+				close(received)
+				<-release
+			}
+			resp.SetBody(req.Body())
+		}
+	})
+
+	c := &HostClient{Addr: addr, Multiplexed: true, MaxResponseBodySize: 1024}
+
+	done := make(chan error, 1)
+
+	go func() {
+		req := AcquireFrame()
+		defer ReleaseFrame(req)
+
+		req.SetBody([]byte("slow"))
+
+		res, err := c.Do(nil, req)
+		if err == nil && string(res) != "slow" {
+			err = errors.New("got response " + strconv.Quote(string(res)))
+		}
+		done <- err
+	}()
+
+	<-received
+
+	// Only the call whose response is too large should fail with ErrBodyTooLarge. Other calls in-flight on the same
+	// connection should be retried over a new connection.
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.SetBody([]byte("large"))
+
+	_, err := c.Do(nil, req)
+	require.True(t, errors.Is(err, ErrBodyTooLarge))
+
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, PhaseRead, e.Phase)
+
+	require.NoError(t, <-done)
+}
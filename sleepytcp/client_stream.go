@@ -0,0 +1,333 @@
+package sleepytcp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/valyala/bytebufferpool"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var errBodyStreamClosed = errors.New("read on closed body stream")
+
+// DoStream sends req, and returns the body of the response as a stream once the header of the response has been
+// read. The returned body must be closed. The connection the response is read from is returned to the pool once the
+// body has been fully read, or is closed should the body be closed before being fully read.
+//
+// Unlike DoContext, the response body is not limited by MaxResponseBodySize, and req is only ever attempted once.
+// Should the response body be compressed however, it is decompressed whole in memory, is limited by
+// MaxResponseBodySize, and the connection is returned to the pool as soon as it has been decompressed. Should c be
+// multiplexed, req is sent over a connection that is dedicated to it. Should ctx be done before the body
+// has been fully read, reading the body fails with ctx.Err().
+func (c *HostClient) DoStream(ctx context.Context, req *Frame) (io.ReadCloser, error) {
+	atomic.StoreUint32(&c.lastUseTime, uint32(time.Now().Unix()-startTimeUnix))
+	atomic.AddInt32(&c.pendingRequests, 1)
+
+	body := &responseBodyStream{c: c, ctx: ctx, start: time.Now()}
+
+	probe, err := c.allowRequest()
+	if err != nil {
+		body.done(err, false)
+		return nil, err
+	}
+
+	body.probe = probe
+
+	retry, err := c.doStream(ctx, req, body)
+	if err != nil {
+		body.done(err, retry)
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// doStream writes req, and reads the header of the response into body.
+func (c *HostClient) doStream(ctx context.Context, req *Frame, body *responseBodyStream) (bool, error) {
+	cc, err := c.tryAcquireClientConn(ctx, req)
+	if err != nil {
+		return false, err
+	}
+
+	conn := cc.conn
+
+	// Interrupt any pending reads or writes should ctx be done. The connection is interrupted until the body has
+	// been fully read or closed.
+
+	stop := interruptOnDone(ctx, conn)
+
+	if err = c.writeRequest(ctx, cc, req); err != nil {
+		err = c.wrapError(PhaseWrite, err, true)
+	}
+
+	// Read response header.
+
+	var (
+		br    *bufio.Reader
+		retry = true
+	)
+
+	if err == nil {
+		err = conn.SetReadDeadline(deadlineOf(ctx, c.ReadTimeout))
+	}
+	if err == nil {
+		br = c.acquireReader(conn)
+
+		maxBodySize := c.MaxResponseBodySize
+		if maxBodySize <= 0 {
+			maxBodySize = DefaultMaxResponseBodySize
+		}
+
+		var header FrameHeader
+		if header, err = c.readResponseHeader(br, maxBodySize, cc.codec); err == nil {
+			body.chunked = header.chunked()
+			if !body.chunked {
+				body.remaining = int(header.size)
+			}
+		}
+
+		// Decompress compressed bodies whole, as they may only be decompressed once they have been fully read.
+
+		if err == nil && header.compressed() {
+			buf := frameBodyPool.Get()
+			if buf.B, err = readDecodedFrameBody(br, header, buf.B[:0], maxBodySize, cc.codec); err == nil {
+				body.decoded = buf
+				body.remaining = 0
+				body.read += int(header.size)
+			} else {
+				frameBodyPool.Put(buf)
+				retry = !errors.Is(err, ErrBodyTooLarge)
+			}
+		}
+	}
+	if err != nil {
+		err = c.wrapError(PhaseRead, readErr(err), retry)
+	}
+
+	if err != nil {
+		stop()
+
+		if br != nil {
+			c.releaseReader(br)
+		}
+
+		c.destroyClientConn(cc)
+
+		if err := contextErr(ctx); err != nil {
+			return false, err
+		}
+
+		return retry, err
+	}
+
+	body.cc, body.br, body.stop = cc, br, stop
+	body.read += FrameHeaderSize
+
+	// Should the response have no body, release the connection immediately.
+
+	if body.decoded != nil {
+		body.releaseConn(true)
+		if len(body.decoded.B) == 0 {
+			body.releaseDecoded(io.EOF)
+		}
+	} else if !body.chunked && body.remaining == 0 {
+		body.release(nil)
+	}
+
+	return false, nil
+}
+
+// responseBodyStream is the body of a response returned by DoStream.
+type responseBodyStream struct {
+	c   *HostClient
+	ctx context.Context
+
+	// Connection the body is read from, and the function to call to stop interrupting it should ctx be done. They
+	// are nil once the connection has been released.
+	cc   *clientConn
+	br   *bufio.Reader
+	stop func()
+
+	// Whether or not the body is chunked, and the number of bytes left to be read in the body or current chunk.
+	chunked   bool
+	remaining int
+
+	// Number of bytes read from the connection.
+	read int
+
+	// Decompressed body of a compressed response, and the number of bytes of it that have been read. The body is
+	// read from decoded rather than from the connection should it not be nil.
+	decoded *bytebufferpool.ByteBuffer
+	offset  int
+
+	// Error that all subsequent reads fail with. It is io.EOF once the body has been fully read.
+	err error
+
+	probe bool
+	start time.Time
+}
+
+func (s *responseBodyStream) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if s.decoded != nil {
+		n := copy(p, s.decoded.B[s.offset:])
+		s.offset += n
+
+		if s.offset == len(s.decoded.B) {
+			s.releaseDecoded(io.EOF)
+		}
+
+		return n, nil
+	}
+
+	// Extend the read timeout such that it applies to each read rather than to the body as a whole. As doing so
+	// overrides any interruption should ctx have been done beforehand, check ctx afterwards.
+
+	if s.c.ReadTimeout > 0 {
+		if err := s.cc.conn.SetReadDeadline(deadlineOf(s.ctx, s.c.ReadTimeout)); err != nil {
+			return 0, s.fail(err)
+		}
+		if err := contextErr(s.ctx); err != nil {
+			return 0, s.fail(err)
+		}
+	}
+
+	// Read the length of the next chunk should the current chunk have been fully read. The body ends with an empty
+	// chunk.
+
+	if s.chunked && s.remaining == 0 {
+		size, err := readChunkSize(s.br)
+		if err != nil {
+			return 0, s.fail(err)
+		}
+
+		s.read += 4
+
+		if size == 0 {
+			s.release(nil)
+			return 0, io.EOF
+		}
+
+		s.remaining = size
+	}
+
+	if len(p) > s.remaining {
+		p = p[:s.remaining]
+	}
+
+	n, err := s.br.Read(p)
+
+	s.remaining -= n
+	s.read += n
+
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, s.fail(err)
+	}
+
+	// Release the connection as soon as the body has been fully read.
+
+	if !s.chunked && s.remaining == 0 {
+		s.release(nil)
+	}
+
+	return n, nil
+}
+
+// Close releases the connection the body is read from. Should the body not have been fully read, the connection is
+// closed, and the request is recorded as having failed rather than succeeded.
+func (s *responseBodyStream) Close() error {
+	if s.cc != nil {
+		s.release(errBodyStreamClosed)
+	} else if s.decoded != nil {
+		s.releaseDecoded(errBodyStreamClosed)
+	}
+	return nil
+}
+
+// fail releases the connection the body is read from after failing to read from it with err, and returns the error
+// that all subsequent reads fail with.
+func (s *responseBodyStream) fail(err error) error {
+	if cerr := contextErr(s.ctx); cerr != nil {
+		err = cerr
+	} else {
+		err = s.c.wrapError(PhaseRead, err, false)
+	}
+
+	s.c.releaseReader(s.br)
+	s.stop()
+	s.c.destroyClientConn(s.cc)
+	s.cc, s.br, s.stop = nil, nil, nil
+
+	s.done(err, !errors.Is(err, s.ctx.Err()))
+
+	return s.err
+}
+
+// release releases the connection the body is read from. Should the body have been fully read, the connection is
+// returned to the pool. Otherwise, it is closed, the request is recorded as having failed with err, and all
+// subsequent reads fail with err.
+func (s *responseBodyStream) release(err error) {
+	s.releaseConn(err == nil)
+
+	s.done(err, false)
+
+	if err == nil {
+		err = io.EOF
+	}
+
+	s.err = err
+}
+
+// releaseConn returns the connection the body is read from to the pool should recycle be true. Otherwise, it is
+// closed.
+func (s *responseBodyStream) releaseConn(recycle bool) {
+	s.c.releaseReader(s.br)
+	s.stop()
+
+	if recycle {
+		s.c.tryRecycleClientConn(s.cc)
+	} else {
+		s.c.destroyClientConn(s.cc)
+	}
+
+	s.cc, s.br, s.stop = nil, nil, nil
+}
+
+// releaseDecoded releases the decompressed body of a compressed response, and fails all subsequent reads with err.
+// Should err not be io.EOF, the request is recorded as having failed with err.
+func (s *responseBodyStream) releaseDecoded(err error) {
+	frameBodyPool.Put(s.decoded)
+	s.decoded, s.offset = nil, 0
+
+	if err == io.EOF {
+		s.done(nil, false)
+	} else {
+		s.done(err, false)
+	}
+
+	s.err = err
+}
+
+// done reports the outcome of the request once the body has either been fully read, closed, or failed to be read.
+func (s *responseBodyStream) done(err error, ioFailure bool) {
+	s.err = err
+
+	s.c.metrics.recordTraffic(s.read, 0)
+	s.c.doneRequest(s.probe, err, ioFailure)
+
+	atomic.AddInt32(&s.c.pendingRequests, -1)
+
+	s.c.metrics.recordRequest(time.Since(s.start), 0, err)
+}
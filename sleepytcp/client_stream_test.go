@@ -0,0 +1,243 @@
+package sleepytcp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// streamHandler responds with a body of the size requested by the request body, which is streamed back chunked
+// should the request body be "chunked".
+func streamHandler(body []byte) FrameHandlerFunc {
+	return func(ctx context.Context, req *Frame, resp *Frame) {
+		size := len(body)
+		if string(req.Body()) == "chunked" {
+			size = -1
+		}
+		resp.SetBodyStream(bytes.NewReader(body), size)
+	}
+}
+
+func TestHostClientDoStream(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 1024*1024)
+
+	_, addr := newTestServer(t, streamHandler(body))
+
+	for _, mode := range []string{"sized", "chunked"} {
+		t.Run(mode, func(t *testing.T) {
+			c := &HostClient{Addr: addr}
+
+			req := AcquireFrame()
+			defer ReleaseFrame(req)
+
+			req.SetBody([]byte(mode))
+
+			res, err := c.DoStream(context.Background(), req)
+			require.NoError(t, err)
+
+			// The connection should only be returned to the pool once the body has been fully read.
+
+			c.mu.Lock()
+			require.Len(t, c.conns, 0)
+			c.mu.Unlock()
+
+			require.EqualValues(t, 1, c.PendingRequests())
+
+			dst, err := ioutil.ReadAll(res)
+			require.NoError(t, err)
+			require.EqualValues(t, body, dst)
+
+			c.mu.Lock()
+			require.Len(t, c.conns, 1)
+			c.mu.Unlock()
+
+			require.EqualValues(t, 0, c.PendingRequests())
+			require.NoError(t, res.Close())
+
+			// The connection should be reusable.
+
+			req.SetBody([]byte(mode))
+
+			res, err = c.DoStream(context.Background(), req)
+			require.NoError(t, err)
+
+			dst, err = ioutil.ReadAll(res)
+			require.NoError(t, err)
+			require.EqualValues(t, body, dst)
+			require.NoError(t, res.Close())
+
+			c.mu.Lock()
+			require.EqualValues(t, 1, c.count)
+			c.mu.Unlock()
+		})
+	}
+}
+
+func TestHostClientDoStreamClose(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 1024*1024)
+
+	_, addr := newTestServer(t, streamHandler(body))
+
+	c := &HostClient{Addr: addr, BreakerThreshold: 1}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	res, err := c.DoStream(context.Background(), req)
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(res, make([]byte, 1024))
+	require.NoError(t, err)
+
+	// Closing the body before it has been fully read should close the connection.
+
+	require.NoError(t, res.Close())
+
+	_, err = res.Read(make([]byte, 1))
+	require.Error(t, err)
+
+	c.mu.Lock()
+	require.EqualValues(t, 0, c.count)
+	require.Len(t, c.conns, 0)
+	c.mu.Unlock()
+
+	require.EqualValues(t, 0, c.PendingRequests())
+
+	// The abandoned request should be recorded as having failed, without tripping the circuit breaker.
+
+	stats := c.Stats()
+	require.EqualValues(t, 1, stats.Requests)
+	require.EqualValues(t, 1, stats.RequestFailures)
+	require.Equal(t, BreakerClosed, c.BreakerState())
+}
+
+func TestHostClientDoStreamContext(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		resp.SetBodyStream(pr, -1)
+	})
+
+	c := &HostClient{Addr: addr}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	// Write the first chunk of the body, and stall.
+
+	go pw.Write([]byte("hello"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	res, err := c.DoStream(ctx, req)
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+
+	_, err = io.ReadFull(res, buf)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", buf)
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err = res.Read(buf)
+	require.Equal(t, context.Canceled, err)
+	require.NoError(t, res.Close())
+
+	c.mu.Lock()
+	require.EqualValues(t, 0, c.count)
+	c.mu.Unlock()
+}
+
+func TestHostClientDoRequestBodyStream(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	body := bytes.Repeat([]byte("0123456789"), 1024)
+
+	for _, multiplexed := range []bool{false, true} {
+		c := &HostClient{Addr: addr, Multiplexed: multiplexed}
+
+		for _, size := range []int{len(body), -1} {
+			req := AcquireFrame()
+			req.SetBodyStream(bytes.NewReader(body), size)
+
+			res, err := c.Do(nil, req)
+			require.NoError(t, err)
+			require.EqualValues(t, body, res)
+
+			ReleaseFrame(req)
+		}
+	}
+}
+
+func TestHostClientDoMultiplexedChunkedResponse(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 16*1024)
+
+	_, addr := newTestServer(t, streamHandler(body))
+
+	c := &HostClient{Addr: addr, Multiplexed: true}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	for i := 0; i < 3; i++ {
+		req.SetBody([]byte("chunked"))
+
+		res, err := c.Do(nil, req)
+		require.NoError(t, err)
+		require.EqualValues(t, body, res)
+	}
+}
+
+func TestHostClientDoMultiplexedSlowRequestBodyStream(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	c := &HostClient{Addr: addr, Multiplexed: true}
+
+	// A body stream that is slow to be produced should not hold up other multiplexed requests.
+
+	pr, pw := io.Pipe()
+
+	streamed := make(chan error, 1)
+
+	go func() {
+		req := AcquireFrame()
+		defer ReleaseFrame(req)
+
+		req.SetBodyStream(pr, -1)
+
+		res, err := c.Do(nil, req)
+		if err == nil && string(res) != "slow" {
+			err = fmt.Errorf("got response %q", res)
+		}
+		streamed <- err
+	}()
+
+	_, err := pw.Write([]byte("sl"))
+	require.NoError(t, err)
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.SetBody([]byte("fast"))
+
+	res, err := c.Do(nil, req)
+	require.NoError(t, err)
+	require.EqualValues(t, "fast", res)
+
+	// The request ID a frame is sent with over the wire should not be set on the caller's frame.
+
+	require.EqualValues(t, 0, req.id)
+
+	_, err = pw.Write([]byte("ow"))
+	require.NoError(t, err)
+	require.NoError(t, pw.Close())
+
+	require.NoError(t, <-streamed)
+}
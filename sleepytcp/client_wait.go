@@ -1,12 +1,24 @@
 package sleepytcp
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 type waitingCaller struct {
 	ready chan struct{}
-	mu    sync.Mutex // protects conn, err, close(ready)
+	mu    sync.Mutex // protects conn, mconn, err, close(ready)
 	conn  *clientConn
 	err   error
+
+	// Whether the caller is waiting for a slot on a multiplexed connection rather than for a pooled connection, and
+	// the multiplexed connection a slot was reserved on for the caller.
+	mux   bool
+	mconn *muxConn
+
+	// Priority of the frame the caller is waiting to send, and the time the caller started waiting.
+	priority int
+	queuedAt time.Time
 }
 
 // waiting reports whether w is still waiting for an answer (connection or error).
@@ -24,7 +36,7 @@ func (w *waitingCaller) tryDeliver(conn *clientConn, err error) bool {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	if w.conn != nil || w.err != nil {
+	if w.conn != nil || w.mconn != nil || w.err != nil {
 		return false
 	}
 
@@ -36,25 +48,46 @@ func (w *waitingCaller) tryDeliver(conn *clientConn, err error) bool {
 	return true
 }
 
+// tryDeliverMuxConn attempts to deliver a slot reserved on mc to w and reports whether it succeeded.
+func (w *waitingCaller) tryDeliverMuxConn(mc *muxConn) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn != nil || w.mconn != nil || w.err != nil {
+		return false
+	}
+
+	w.mconn = mc
+
+	close(w.ready)
+
+	return true
+}
+
 // cancel marks w as no longer wanting a result (for example, due to cancellation).
-// If a connection has been delivered already, cancel returns it with c.tryRecycleClientConn.
+// If a connection has been delivered already, cancel returns it with c.tryRecycleClientConn. If a slot on a
+// multiplexed connection has been delivered already, cancel releases it with c.releaseMuxConn.
 func (w *waitingCaller) cancel(c *HostClient, err error) {
 	w.mu.Lock()
-	if w.conn == nil && w.err == nil {
+	if w.conn == nil && w.mconn == nil && w.err == nil {
 		close(w.ready) // catch misbehavior in future delivery
 	}
 
-	conn := w.conn
-	w.conn = nil
+	conn, mconn := w.conn, w.mconn
+	w.conn, w.mconn = nil, nil
 	w.err = err
 	w.mu.Unlock()
 
 	if conn != nil {
 		c.tryRecycleClientConn(conn)
 	}
+	if mconn != nil {
+		c.releaseMuxConn(mconn)
+	}
 }
 
-type waitingCallerQueue struct {
+// waitingCallerFIFO is a FIFO queue of callers waiting for a connection.
+type waitingCallerFIFO struct {
 	// This is a queue, not a deque.
 	// It is split into two stages - head[headPos:] and tail.
 	// popFront is trivial (headPos++) on the first stage, and
@@ -71,17 +104,32 @@ type waitingCallerQueue struct {
 }
 
 // len returns the number of items in the queue.
-func (q *waitingCallerQueue) len() int {
+func (q *waitingCallerFIFO) len() int {
 	return len(q.head) - q.headPos + len(q.tail)
 }
 
+// waiting returns the number of callers in the queue that are still waiting.
+func (q *waitingCallerFIFO) waiting() (n int) {
+	for _, w := range q.head[q.headPos:] {
+		if w.waiting() {
+			n++
+		}
+	}
+	for _, w := range q.tail {
+		if w.waiting() {
+			n++
+		}
+	}
+	return n
+}
+
 // pushBack adds w to the back of the queue.
-func (q *waitingCallerQueue) pushBack(w *waitingCaller) {
+func (q *waitingCallerFIFO) pushBack(w *waitingCaller) {
 	q.tail = append(q.tail, w)
 }
 
 // popFront removes and returns the waitingCaller at the front of the queue.
-func (q *waitingCallerQueue) popFront() *waitingCaller {
+func (q *waitingCallerFIFO) popFront() *waitingCaller {
 	if q.headPos >= len(q.head) {
 		if len(q.tail) == 0 {
 			return nil
@@ -100,7 +148,7 @@ func (q *waitingCallerQueue) popFront() *waitingCaller {
 }
 
 // peekFront returns the waitingCaller at the front of the queue without removing it.
-func (q *waitingCallerQueue) peekFront() *waitingCaller {
+func (q *waitingCallerFIFO) peekFront() *waitingCaller {
 	if q.headPos < len(q.head) {
 		return q.head[q.headPos]
 	}
@@ -112,7 +160,7 @@ func (q *waitingCallerQueue) peekFront() *waitingCaller {
 
 // cleanFront pops any wantConns that are no longer waiting from the head of the
 // queue, reporting whether any were popped.
-func (q *waitingCallerQueue) clearFront() (cleaned bool) {
+func (q *waitingCallerFIFO) clearFront() (cleaned bool) {
 	for {
 		w := q.peekFront()
 		if w == nil || w.waiting() {
@@ -122,3 +170,94 @@ func (q *waitingCallerQueue) clearFront() (cleaned bool) {
 		cleaned = true
 	}
 }
+
+// waitingCallerQueue is a queue of callers waiting for a connection that is ordered by priority. Callers of equal
+// priority are dequeued in FIFO order. To prevent callers of low priority from starving, the priority of a caller is
+// raised by one level for every agingInterval it has been waiting for.
+type waitingCallerQueue struct {
+	agingInterval time.Duration
+
+	// Callers waiting at each priority level. Levels with no callers are removed.
+	levels map[int]*waitingCallerFIFO
+}
+
+// len returns the number of items in the queue.
+func (q *waitingCallerQueue) len() (n int) {
+	for _, level := range q.levels {
+		n += level.len()
+	}
+	return n
+}
+
+// waiting returns the number of callers in the queue that are still waiting.
+func (q *waitingCallerQueue) waiting() (n int) {
+	for _, level := range q.levels {
+		n += level.waiting()
+	}
+	return n
+}
+
+// waitingByPriority returns the number of callers in the queue that are still waiting at each priority level. Levels
+// with no waiting callers are omitted.
+func (q *waitingCallerQueue) waitingByPriority() map[int]int {
+	depths := make(map[int]int, len(q.levels))
+	for priority, level := range q.levels {
+		if n := level.waiting(); n > 0 {
+			depths[priority] = n
+		}
+	}
+	return depths
+}
+
+// pushBack adds w to the back of the queue at its priority level.
+func (q *waitingCallerQueue) pushBack(w *waitingCaller) {
+	if q.levels == nil {
+		q.levels = make(map[int]*waitingCallerFIFO)
+	}
+
+	level := q.levels[w.priority]
+	if level == nil {
+		level = &waitingCallerFIFO{}
+		q.levels[w.priority] = level
+	}
+
+	level.clearFront()
+	level.pushBack(w)
+}
+
+// popFront removes and returns the waitingCaller with the highest aged priority. Ties are broken in favor of the
+// caller that has been waiting the longest.
+func (q *waitingCallerQueue) popFront() *waitingCaller {
+	var (
+		best      *waitingCallerFIFO
+		bestIndex int
+		bestFront *waitingCaller
+	)
+
+	now := time.Now()
+
+	for priority, level := range q.levels {
+		level.clearFront()
+
+		front := level.peekFront()
+		if front == nil {
+			delete(q.levels, priority)
+			continue
+		}
+
+		index := priority
+		if q.agingInterval > 0 {
+			index += int(now.Sub(front.queuedAt) / q.agingInterval)
+		}
+
+		if best == nil || index > bestIndex || (index == bestIndex && front.queuedAt.Before(bestFront.queuedAt)) {
+			best, bestIndex, bestFront = level, index, front
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	return best.popFront()
+}
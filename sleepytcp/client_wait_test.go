@@ -0,0 +1,105 @@
+package sleepytcp
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func newTestWaitingCaller(priority int, queuedAt time.Time) *waitingCaller {
+	return &waitingCaller{ready: make(chan struct{}, 1), priority: priority, queuedAt: queuedAt}
+}
+
+func TestWaitingCallerQueuePriority(t *testing.T) {
+	q := &waitingCallerQueue{agingInterval: time.Hour}
+
+	now := time.Now()
+
+	low1 := newTestWaitingCaller(0, now)
+	low2 := newTestWaitingCaller(0, now.Add(time.Millisecond))
+	high := newTestWaitingCaller(1, now.Add(2*time.Millisecond))
+	cancelled := newTestWaitingCaller(2, now)
+
+	for _, w := range []*waitingCaller{low1, low2, high, cancelled} {
+		q.pushBack(w)
+	}
+
+	cancelled.tryDeliver(nil, ErrTimeout)
+
+	require.EqualValues(t, 3, q.waiting())
+	require.EqualValues(t, map[int]int{0: 2, 1: 1}, q.waitingByPriority())
+
+	require.Equal(t, high, q.popFront())
+	require.Equal(t, low1, q.popFront())
+	require.Equal(t, low2, q.popFront())
+	require.Nil(t, q.popFront())
+
+	require.EqualValues(t, 0, q.len())
+}
+
+func TestWaitingCallerQueueAging(t *testing.T) {
+	q := &waitingCallerQueue{agingInterval: time.Second}
+
+	now := time.Now()
+
+	// A low priority caller that has waited long enough should be dequeued before a high priority caller that just
+	// started waiting.
+
+	starving := newTestWaitingCaller(0, now.Add(-3*time.Second))
+	high := newTestWaitingCaller(2, now)
+
+	q.pushBack(high)
+	q.pushBack(starving)
+
+	require.Equal(t, starving, q.popFront())
+	require.Equal(t, high, q.popFront())
+}
+
+func TestHostClientPriority(t *testing.T) {
+	release := make(chan struct{})
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		if string(req.Body()) == "block" {
+			<-release
+		}
+		resp.SetBody(req.Body())
+	})
+
+	c := &HostClient{Addr: addr, MaxConns: 1, MaxConnWaitTimeout: time.Minute}
+
+	do := func(body string, priority int, done chan<- string) {
+		req := AcquireFrame()
+		defer ReleaseFrame(req)
+
+		req.SetBody([]byte(body))
+		req.Priority = priority
+
+		res, err := c.Do(nil, req)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+
+		done <- string(res)
+	}
+
+	done := make(chan string, 3)
+
+	go do("block", 0, done)
+	require.Eventually(t, func() bool { return c.PendingRequests() == 1 }, time.Second, time.Millisecond)
+
+	go do("low", 0, done)
+	require.Eventually(t, func() bool { return c.Stats().WaitingCallers == 1 }, time.Second, time.Millisecond)
+
+	go do("high", 1, done)
+	require.Eventually(t, func() bool { return c.Stats().WaitingCallers == 2 }, time.Second, time.Millisecond)
+
+	require.EqualValues(t, map[int]int{0: 1, 1: 1}, c.Stats().WaitingCallersByPriority)
+
+	close(release)
+
+	require.Equal(t, "block", <-done)
+	require.Equal(t, "high", <-done)
+	require.Equal(t, "low", <-done)
+}
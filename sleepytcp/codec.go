@@ -0,0 +1,336 @@
+package sleepytcp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+)
+
+// DefaultCompressionThreshold is the min size in bytes a frame body must have for it to be compressed.
+const DefaultCompressionThreshold = 1024
+
+// Max size in bytes of the list of codec names a client may offer during negotiation.
+const maxNegotiationBodySize = 1024
+
+// Codec compresses and decompresses frame bodies. A codec is negotiated per connection: the client offers the names
+// of the codecs it supports in order of preference, and the server picks the first one it also supports. Codecs must
+// be safe for concurrent use.
+type Codec interface {
+	// Name identifies the codec during negotiation. It may not contain commas.
+	Name() string
+
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress appends the decompressed form of src to dst. Should the decompressed form of src exceed maxSize
+	// bytes, decompression must stop, and an error that wraps ErrBodyTooLarge must be returned. The decompressed
+	// size is not limited should maxSize not be positive.
+	Decompress(dst, src []byte, maxSize int) ([]byte, error)
+}
+
+// NewFlateCodec returns a Codec named "flate" that compresses frame bodies with DEFLATE (RFC 1951) at the given
+// compression level, as defined by compress/flate.
+func NewFlateCodec(level int) (Codec, error) {
+	return newStreamCodec("flate",
+		func(w io.Writer) (io.WriteCloser, error) { return flate.NewWriter(w, level) },
+		func(zw io.WriteCloser, w io.Writer) { zw.(*flate.Writer).Reset(w) },
+		func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil },
+		func(zr io.ReadCloser, r io.Reader) error { return zr.(flate.Resetter).Reset(r, nil) },
+	)
+}
+
+// NewGzipCodec returns a Codec named "gzip" that compresses frame bodies with gzip (RFC 1952) at the given
+// compression level, as defined by compress/gzip.
+func NewGzipCodec(level int) (Codec, error) {
+	return newStreamCodec("gzip",
+		func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriterLevel(w, level) },
+		func(zw io.WriteCloser, w io.Writer) { zw.(*gzip.Writer).Reset(w) },
+		func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		func(zr io.ReadCloser, r io.Reader) error { return zr.(*gzip.Reader).Reset(r) },
+	)
+}
+
+// streamCodec adapts a streaming compression format into a Codec, pooling its writers and readers as they are
+// expensive to allocate.
+type streamCodec struct {
+	name string
+
+	newWriter   func(w io.Writer) (io.WriteCloser, error)
+	resetWriter func(zw io.WriteCloser, w io.Writer)
+
+	newReader   func(r io.Reader) (io.ReadCloser, error)
+	resetReader func(zr io.ReadCloser, r io.Reader) error
+
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func newStreamCodec(
+	name string,
+	newWriter func(w io.Writer) (io.WriteCloser, error),
+	resetWriter func(zw io.WriteCloser, w io.Writer),
+	newReader func(r io.Reader) (io.ReadCloser, error),
+	resetReader func(zr io.ReadCloser, r io.Reader) error,
+) (Codec, error) {
+	c := &streamCodec{
+		name:        name,
+		newWriter:   newWriter,
+		resetWriter: resetWriter,
+		newReader:   newReader,
+		resetReader: resetReader,
+	}
+
+	// Create a writer upfront such that an invalid compression level is reported immediately.
+
+	zw, err := newWriter(ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+	c.writers.Put(zw)
+
+	return c, nil
+}
+
+func (c *streamCodec) Name() string {
+	return c.name
+}
+
+func (c *streamCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	var (
+		zw  io.WriteCloser
+		err error
+	)
+
+	if v := c.writers.Get(); v != nil {
+		zw = v.(io.WriteCloser)
+		c.resetWriter(zw, buf)
+	} else if zw, err = c.newWriter(buf); err != nil {
+		return dst, err
+	}
+
+	_, err = zw.Write(src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+
+	c.resetWriter(zw, ioutil.Discard)
+	c.writers.Put(zw)
+
+	if err != nil {
+		return dst, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *streamCodec) Decompress(dst, src []byte, maxSize int) ([]byte, error) {
+	var (
+		zr  io.ReadCloser
+		err error
+	)
+
+	if v := c.readers.Get(); v != nil {
+		zr = v.(io.ReadCloser)
+		err = c.resetReader(zr, bytes.NewReader(src))
+	} else {
+		zr, err = c.newReader(bytes.NewReader(src))
+	}
+	if err != nil {
+		return dst, err
+	}
+	defer c.readers.Put(zr)
+
+	// Read at most one byte past maxSize, such that bodies that exceed maxSize are detected without being fully
+	// decompressed.
+
+	var r io.Reader = zr
+	if maxSize > 0 {
+		r = io.LimitReader(zr, int64(maxSize)+1)
+	}
+
+	n := len(dst)
+	buf := bytes.NewBuffer(dst)
+
+	if _, err = buf.ReadFrom(r); err == nil {
+		err = zr.Close()
+	}
+	if err != nil {
+		return dst[:n], err
+	}
+
+	if size := buf.Len() - n; maxSize > 0 && size > maxSize {
+		return dst[:n], errBodyTooLarge(size, maxSize)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// errUnknownCodec is returned should a peer pick a codec during negotiation that was not offered to it.
+var errUnknownCodec = errors.New("peer picked a codec that was not offered")
+
+// errUnexpectedNegotiationReply is returned should a peer reply to a codec negotiation frame with any other frame.
+var errUnexpectedNegotiationReply = errors.New("peer replied to codec negotiation with an unexpected frame")
+
+// errUnexpectedCompressedFrame is returned should a compressed frame be read over a connection that has no codec.
+var errUnexpectedCompressedFrame = errors.New("read a compressed frame over a connection without a codec")
+
+// codecNames returns the names of codecs separated by commas.
+func codecNames(codecs []Codec) string {
+	names := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		names = append(names, codec.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// pickCodec returns the first codec named in offered, a list of codec names separated by commas, that is in codecs.
+// It returns nil should there be none.
+func pickCodec(codecs []Codec, offered string) Codec {
+	for _, name := range strings.Split(offered, ",") {
+		if codec := findCodec(codecs, name); codec != nil {
+			return codec
+		}
+	}
+	return nil
+}
+
+func findCodec(codecs []Codec, name string) Codec {
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec
+		}
+	}
+	return nil
+}
+
+// negotiateCodec offers Codecs to the peer over conn within OnConnectTimeout, or until ctx is done, and returns the
+// codec the peer picked. It returns a nil codec should the peer have picked none. conn is closed should negotiation
+// fail.
+func (c *HostClient) negotiateCodec(ctx context.Context, conn net.Conn) (Codec, error) {
+	timeout := c.OnConnectTimeout
+	if timeout <= 0 {
+		timeout = DefaultOnConnectTimeout
+	}
+
+	var codec Codec
+
+	err := withDialDeadline(ctx, conn, timeout, func() (err error) {
+		codec, err = c.exchangeCodecNames(conn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codec, nil
+}
+
+// exchangeCodecNames writes the names of Codecs to conn in a negotiation frame, and reads back the name of the codec
+// the peer picked.
+func (c *HostClient) exchangeCodecNames(conn net.Conn) (Codec, error) {
+	offer := AcquireFrame()
+	defer ReleaseFrame(offer)
+
+	offer.SetBody([]byte(codecNames(c.Codecs)))
+
+	bw := c.acquireWriter(conn)
+	_, err := offer.writeTo(bw, frameNegotiateFlag, nil, 0)
+	if err == nil {
+		err = bw.Flush()
+	}
+	c.releaseWriter(bw)
+	if err != nil {
+		return nil, err
+	}
+
+	br := c.acquireReader(conn)
+	defer c.releaseReader(br)
+
+	header, err := readFrameHeader(br)
+	if err != nil {
+		return nil, readErr(err)
+	}
+	if !header.negotiate() {
+		return nil, errUnexpectedNegotiationReply
+	}
+
+	buf := frameBodyPool.Get()
+	defer frameBodyPool.Put(buf)
+
+	if buf.B, err = readFrameBody(br, header, buf.B[:0], maxNegotiationBodySize); err != nil {
+		return nil, readErr(err)
+	}
+
+	if len(buf.B) == 0 {
+		return nil, nil
+	}
+
+	codec := findCodec(c.Codecs, string(buf.B))
+	if codec == nil {
+		return nil, errUnknownCodec
+	}
+
+	return codec, nil
+}
+
+// compressionThreshold returns the min size in bytes a frame body must have for it to be compressed.
+func (c *HostClient) compressionThreshold() int {
+	if c.CompressionThreshold <= 0 {
+		return DefaultCompressionThreshold
+	}
+	return c.CompressionThreshold
+}
+
+// negotiateCodec reads the names of the codecs offered by a client from br, and picks the first one that is in
+// Codecs for sc. The name of the picked codec is written back to the client, or an empty name should none have been
+// picked.
+func (s *Server) negotiateCodec(sc *serverConn, br *bufio.Reader, header FrameHeader) error {
+	buf := frameBodyPool.Get()
+	defer frameBodyPool.Put(buf)
+
+	offered, err := readFrameBody(br, header, buf.B[:0], maxNegotiationBodySize)
+	buf.B = offered
+	if err != nil {
+		return err
+	}
+
+	codec := pickCodec(s.Codecs, string(offered))
+
+	reply := AcquireFrame()
+	defer ReleaseFrame(reply)
+
+	if codec != nil {
+		reply.SetBody([]byte(codec.Name()))
+	}
+
+	// Only compress frames with the picked codec once the reply has been written, as the reply itself is never
+	// compressed.
+
+	if err := sc.writeFrame(reply, frameNegotiateFlag); err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	sc.codec = codec
+	sc.mu.Unlock()
+
+	return nil
+}
+
+// compressionThreshold returns the min size in bytes a response body must have for it to be compressed.
+func (s *Server) compressionThreshold() int {
+	if s.CompressionThreshold <= 0 {
+		return DefaultCompressionThreshold
+	}
+	return s.CompressionThreshold
+}
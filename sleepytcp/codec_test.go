@@ -0,0 +1,228 @@
+package sleepytcp
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func newCodecTestServer(t *testing.T, handler FrameHandlerFunc, codecs ...Codec) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &Server{Handler: handler, Codecs: codecs}
+
+	go s.Serve(ln)
+
+	t.Cleanup(func() { s.Close() })
+
+	return ln.Addr().String()
+}
+
+func newTestCodecs(t *testing.T) (Codec, Codec) {
+	t.Helper()
+
+	flateCodec, err := NewFlateCodec(flate.DefaultCompression)
+	require.NoError(t, err)
+
+	gzipCodec, err := NewGzipCodec(flate.DefaultCompression)
+	require.NoError(t, err)
+
+	return flateCodec, gzipCodec
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	flateCodec, gzipCodec := newTestCodecs(t)
+
+	body := bytes.Repeat([]byte("hello world "), 1000)
+
+	for _, codec := range []Codec{flateCodec, gzipCodec} {
+		compressed, err := codec.Compress([]byte("prefix"), body)
+		require.NoError(t, err)
+		require.EqualValues(t, "prefix", compressed[:6])
+		require.Less(t, len(compressed), len(body))
+
+		decompressed, err := codec.Decompress([]byte("prefix"), compressed[6:], len(body))
+		require.NoError(t, err)
+		require.EqualValues(t, append([]byte("prefix"), body...), decompressed)
+	}
+
+	_, err := NewFlateCodec(100)
+	require.Error(t, err)
+}
+
+func TestCodecDecompressionBomb(t *testing.T) {
+	flateCodec, gzipCodec := newTestCodecs(t)
+
+	bomb := make([]byte, 10*1024*1024)
+
+	for _, codec := range []Codec{flateCodec, gzipCodec} {
+		compressed, err := codec.Compress(nil, bomb)
+		require.NoError(t, err)
+
+		// Decompression should stop once the max size is exceeded.
+
+		_, err = codec.Decompress(nil, compressed, 1024*1024)
+		require.True(t, errors.Is(err, ErrBodyTooLarge))
+	}
+}
+
+func TestHostClientCompression(t *testing.T) {
+	flateCodec, gzipCodec := newTestCodecs(t)
+
+	addr := newCodecTestServer(t, echoHandler, gzipCodec)
+
+	body := bytes.Repeat([]byte("hello world "), 1000)
+
+	for _, multiplexed := range []bool{false, true} {
+		plain := &HostClient{Addr: addr, Multiplexed: multiplexed}
+		compressed := &HostClient{Addr: addr, Multiplexed: multiplexed, Codecs: []Codec{flateCodec, gzipCodec}}
+
+		for _, c := range []*HostClient{plain, compressed} {
+			req := AcquireFrame()
+			req.SetBody(body)
+
+			res, err := c.Do(nil, req)
+			require.NoError(t, err)
+			require.EqualValues(t, body, res)
+
+			ReleaseFrame(req)
+			c.Close()
+		}
+
+		// Requests and responses sent by the client that negotiated gzip should have been compressed.
+
+		require.Less(t, compressed.Stats().BytesWritten*4, plain.Stats().BytesWritten)
+		require.Less(t, compressed.Stats().BytesRead*4, plain.Stats().BytesRead)
+	}
+}
+
+func TestHostClientCompressionThreshold(t *testing.T) {
+	_, gzipCodec := newTestCodecs(t)
+
+	addr := newCodecTestServer(t, echoHandler, gzipCodec)
+
+	c := &HostClient{Addr: addr, Codecs: []Codec{gzipCodec}}
+	defer c.Close()
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	// Bodies smaller than the threshold should not be compressed.
+
+	req.SetBody(bytes.Repeat([]byte("a"), DefaultCompressionThreshold-1))
+
+	res, err := c.Do(nil, req)
+	require.NoError(t, err)
+	require.EqualValues(t, req.Body(), res)
+
+	require.EqualValues(t, FrameHeaderSize+DefaultCompressionThreshold-1, c.Stats().BytesRead)
+}
+
+func TestHostClientNoCommonCodec(t *testing.T) {
+	flateCodec, gzipCodec := newTestCodecs(t)
+
+	addr := newCodecTestServer(t, echoHandler, flateCodec)
+
+	c := &HostClient{Addr: addr, Codecs: []Codec{gzipCodec}}
+	defer c.Close()
+
+	body := bytes.Repeat([]byte("hello world "), 1000)
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.SetBody(body)
+
+	// Frames should be sent uncompressed should no codec have been picked.
+
+	res, err := c.Do(nil, req)
+	require.NoError(t, err)
+	require.EqualValues(t, body, res)
+
+	require.EqualValues(t, FrameHeaderSize+len(body), c.Stats().BytesRead)
+}
+
+func TestHostClientCompressedStream(t *testing.T) {
+	_, gzipCodec := newTestCodecs(t)
+
+	body := bytes.Repeat([]byte("hello world "), 1000)
+
+	addr := newCodecTestServer(t, func(_ context.Context, req *Frame, resp *Frame) {
+		resp.SetBody(body)
+	}, gzipCodec)
+
+	c := &HostClient{Addr: addr, Codecs: []Codec{gzipCodec}}
+	defer c.Close()
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	stream, err := c.DoStream(context.Background(), req)
+	require.NoError(t, err)
+
+	// The connection should have been returned to the pool as soon as the body was decompressed.
+
+	require.EqualValues(t, 1, c.Stats().IdleConns)
+
+	res, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	require.EqualValues(t, body, res)
+	require.NoError(t, stream.Close())
+
+	// Compressed bodies should still be limited by MaxResponseBodySize.
+
+	c.MaxResponseBodySize = len(body) - 1
+
+	_, err = c.DoStream(context.Background(), req)
+	require.True(t, errors.Is(err, ErrBodyTooLarge))
+}
+
+func TestHostClientCompressedPush(t *testing.T) {
+	_, gzipCodec := newTestCodecs(t)
+
+	body := bytes.Repeat([]byte("hello world "), 1000)
+
+	addr := newCodecTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		push := AcquireFrame()
+		defer ReleaseFrame(push)
+
+		push.SetBody(body)
+		if err := Push(ctx, push); err != nil {
+			t.Error(err)
+		}
+
+		resp.SetBody(req.Body())
+	}, gzipCodec)
+
+	pushes := make(chan []byte, 1)
+
+	c := &HostClient{
+		Addr:   addr,
+		Codecs: []Codec{gzipCodec},
+		PushHandler: PushHandlerFunc(func(push *Frame) {
+			pushes <- append([]byte(nil), push.Body()...)
+		}),
+	}
+	defer c.Close()
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.SetBody([]byte("hello"))
+
+	_, err := c.Do(nil, req)
+	require.NoError(t, err)
+	require.EqualValues(t, body, <-pushes)
+
+	// The compressed size of the push should have been recorded rather than its decompressed size.
+
+	require.Less(t, c.Stats().BytesRead*4, uint64(len(body)))
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !solaris
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!solaris
+
+package sleepytcp
+
+import "net"
+
+// connCheck is a no-op on platforms that do not support non-blocking reads against a connection's underlying file
+// descriptor. Connections are assumed to be alive.
+func connCheck(conn net.Conn) error {
+	return nil
+}
@@ -0,0 +1,54 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build linux darwin dragonfly freebsd netbsd openbsd solaris
+
+package sleepytcp
+
+import (
+	"io"
+	"net"
+	"syscall"
+)
+
+// connCheck performs a non-blocking peek against conn to detect whether its peer has closed it. Connections that do
+// not expose their underlying file descriptor, such as TLS connections, are assumed to be alive.
+//
+// Data pending on conn leaves it alive, as peers may push frames over idle connections. The data is only peeked at,
+// such that pushed frames are left intact to be read and discarded once the next response is read off of conn.
+func connCheck(conn net.Conn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var checkErr error
+
+	err = rc.Read(func(fd uintptr) bool {
+		var buf [1]byte
+
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK)
+		switch {
+		case n == 0 && err == nil:
+			checkErr = io.EOF
+		case n > 0:
+			checkErr = nil
+		case err == syscall.EAGAIN || err == syscall.EWOULDBLOCK:
+			checkErr = nil
+		default:
+			checkErr = err
+		}
+
+		// Return true such that rc.Read does not wait for conn to become readable.
+
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	return checkErr
+}
@@ -0,0 +1,24 @@
+package sleepytcp
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const DefaultOnConnectTimeout = 10 * time.Second
+
+// OnConnectFunc performs a handshake, such as authenticating with the peer, over a newly established connection
+// before it may be used to send requests. Reads and writes against conn time out after OnConnectTimeout.
+type OnConnectFunc func(conn net.Conn) error
+
+// onConnect runs c.OnConnect over conn within OnConnectTimeout, or until ctx is done. conn is closed should the
+// handshake fail.
+func (c *HostClient) onConnect(ctx context.Context, conn net.Conn) error {
+	timeout := c.OnConnectTimeout
+	if timeout <= 0 {
+		timeout = DefaultOnConnectTimeout
+	}
+
+	return withDialDeadline(ctx, conn, timeout, func() error { return c.OnConnect(conn) })
+}
@@ -0,0 +1,148 @@
+package sleepytcp
+
+import (
+	"bufio"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostClientOnConnect(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	var handshakes int32
+
+	c := &HostClient{
+		Addr: addr,
+		OnConnect: func(conn net.Conn) error {
+			atomic.AddInt32(&handshakes, 1)
+
+			// Authenticate by having the peer echo back a token.
+
+			req := AcquireFrame()
+			defer ReleaseFrame(req)
+
+			req.SetBody([]byte("token"))
+
+			bw := bufio.NewWriter(conn)
+			if err := req.WriteTo(bw); err != nil {
+				return err
+			}
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+
+			res, err := readFrame(bufio.NewReader(conn), nil, DefaultMaxResponseBodySize)
+			if err != nil {
+				return err
+			}
+			if string(res) != "token" {
+				return errors.New("bad token")
+			}
+
+			return nil
+		},
+	}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	for i := 0; i < 10; i++ {
+		req.SetBody([]byte("hello"))
+
+		res, err := c.Do(nil, req)
+		require.NoError(t, err)
+		require.EqualValues(t, "hello", res)
+	}
+
+	require.EqualValues(t, 1, atomic.LoadInt32(&handshakes))
+	require.EqualValues(t, 1, c.Stats().DialSuccesses)
+}
+
+func TestHostClientOnConnectFailure(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	errAuth := errors.New("auth failed")
+
+	c := &HostClient{
+		Addr:      addr,
+		OnConnect: func(conn net.Conn) error { return errAuth },
+	}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	_, err := c.Do(nil, req)
+	require.True(t, errors.Is(err, errAuth))
+
+	// The connection should not have joined the pool, and should have counted as a failure to dial.
+
+	c.mu.Lock()
+	require.EqualValues(t, 0, c.count)
+	require.Len(t, c.conns, 0)
+	c.mu.Unlock()
+
+	require.EqualValues(t, 1, c.Stats().DialFailures)
+}
+
+func TestHostClientOnConnectFailureWakesWaitingCallers(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	errAuth := errors.New("auth failed")
+	release := make(chan struct{})
+
+	c := &HostClient{
+		Addr:               addr,
+		MaxConns:           1,
+		MaxConnWaitTimeout: time.Minute,
+		OnConnect: func(conn net.Conn) error {
+			<-release
+			return errAuth
+		},
+	}
+
+	errs := make(chan error, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			req := AcquireFrame()
+			defer ReleaseFrame(req)
+
+			_, err := c.Do(nil, req)
+			errs <- err
+		}()
+	}
+
+	require.Eventually(t, func() bool { return c.Stats().WaitingCallers == 1 }, time.Second, time.Millisecond)
+
+	close(release)
+
+	require.True(t, errors.Is(<-errs, errAuth))
+	require.True(t, errors.Is(<-errs, errAuth))
+}
+
+func TestHostClientOnConnectTimeout(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	c := &HostClient{
+		Addr:             addr,
+		OnConnectTimeout: 50 * time.Millisecond,
+		OnConnect: func(conn net.Conn) error {
+			// The peer never sends anything unprompted.
+			_, err := conn.Read(make([]byte, 1))
+			return err
+		},
+	}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	_, err := c.Do(nil, req)
+
+	var nerr net.Error
+	require.True(t, errors.As(err, &nerr))
+	require.True(t, nerr.Timeout())
+}
@@ -0,0 +1,80 @@
+package sleepytcp
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// A deadline in the past that is used to interrupt any pending reads and writes on a connection.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// deadlineOf returns the earlier of now+timeout and ctx's deadline. It returns the zero time if timeout is not
+// positive and ctx has no deadline.
+func deadlineOf(ctx context.Context, timeout time.Duration) time.Time {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return deadline
+}
+
+// contextErr returns ctx.Err(). Should ctx's deadline have passed but ctx not yet be marked as done, it returns
+// context.DeadlineExceeded. This way, an operation that was interrupted by a deadline derived from ctx reports the
+// same error regardless of whether the operation or ctx noticed the deadline first.
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// interruptOnDone interrupts any pending reads and writes on conn should ctx be done before stop is called. Once
+// stop returns, conn will no longer be interrupted.
+func interruptOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	return interruptWithDeadline(ctx, conn.SetDeadline)
+}
+
+// interruptWithDeadline calls setDeadline with a deadline in the past should ctx be done before stop is called.
+func interruptWithDeadline(ctx context.Context, setDeadline func(time.Time) error) (stop func()) {
+	done := ctx.Done()
+	if done == nil {
+		return func() {}
+	}
+
+	stopped, finished := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		select {
+		case <-done:
+			setDeadline(aLongTimeAgo)
+		case <-stopped:
+		}
+	}()
+
+	return func() {
+		close(stopped)
+		<-finished
+	}
+}
+
+// sleepContext sleeps for d, and reports false should ctx be done before d has elapsed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := AcquireTimer(d)
+	defer ReleaseTimer(timer)
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
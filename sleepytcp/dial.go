@@ -1,19 +1,28 @@
 package sleepytcp
 
-import "net"
+import (
+	"context"
+	"net"
+	"time"
+)
 
 type DialFunc func(addr string) (net.Conn, error)
 
-func dialAddr(addr string, dial DialFunc, dialDualStack bool) (net.Conn, error) {
-	if dial == nil {
-		if dialDualStack {
-			dial = DialDualStack
+// DialContextFunc dials addr, and aborts dialing should ctx be done before a connection is established.
+type DialContextFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+func dialAddr(ctx context.Context, addr string, dial DialFunc, dialContext DialContextFunc, dialDualStack bool) (net.Conn, error) {
+	if dialContext == nil {
+		if dial != nil {
+			dialContext = withContext(dial)
+		} else if dialDualStack {
+			dialContext = defaultDialer.DialDualStackContext
 		} else {
-			dial = Dial
+			dialContext = defaultDialer.DialContext
 		}
 	}
 
-	conn, err := dial(addr)
+	conn, err := dialContext(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -24,3 +33,63 @@ func dialAddr(addr string, dial DialFunc, dialDualStack bool) (net.Conn, error)
 
 	return conn, nil
 }
+
+// withContext adapts dial into a DialContextFunc. As dial may not be cancelled, should ctx be done before dial
+// returns, the caller stops waiting for dial and any connection it later establishes is closed.
+func withContext(dial DialFunc) DialContextFunc {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		if ctx.Done() == nil {
+			return dial(addr)
+		}
+
+		ch := make(chan dialResult, 1)
+
+		go func() {
+			var dr dialResult
+			dr.conn, dr.err = dial(addr)
+			ch <- dr
+		}()
+
+		select {
+		case dr := <-ch:
+			return dr.conn, dr.err
+		case <-ctx.Done():
+			go func() {
+				if dr := <-ch; dr.conn != nil {
+					dr.conn.Close()
+				}
+			}()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// withDialDeadline runs fn against conn, a connection that is in the midst of being established, such that fn must
+// complete within timeout and is interrupted should ctx be done. Should fn fail or ctx be done, conn is closed, and
+// either ctx's error or the error fn failed with is returned.
+func withDialDeadline(ctx context.Context, conn net.Conn, timeout time.Duration, fn func() error) error {
+	if err := conn.SetDeadline(deadlineOf(ctx, timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	stop := interruptOnDone(ctx, conn)
+	err := fn()
+	stop()
+
+	if err == nil && ctx.Err() == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+
+	if err == nil && ctx.Err() == nil {
+		return nil
+	}
+
+	conn.Close()
+
+	if cerr := contextErr(ctx); cerr != nil {
+		return cerr
+	}
+
+	return err
+}
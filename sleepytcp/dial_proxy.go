@@ -0,0 +1,313 @@
+package sleepytcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/lithdew/bytesutil"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrProxyAuthFailed is returned when a proxy rejects the credentials it was provided.
+var ErrProxyAuthFailed = errors.New("proxy authentication failed")
+
+// ProxyAuth holds the credentials to authenticate with a proxy with.
+type ProxyAuth struct {
+	Username string
+	Password string
+}
+
+// SOCKS5Dial returns a DialFunc that dials addresses through the SOCKS5 proxy at proxyAddr. Should auth not be nil,
+// the proxy is authenticated with using username/password authentication (RFC 1929). Connecting to the proxy and
+// having the proxy connect to the address must complete within timeout, or else ErrDialTimeout is returned. Defaults
+// to DefaultDialTimeout should timeout not be positive.
+func SOCKS5Dial(proxyAddr string, auth *ProxyAuth, timeout time.Duration) DialFunc {
+	return withoutContext(SOCKS5DialContext(proxyAddr, auth, timeout))
+}
+
+// SOCKS5DialContext is like SOCKS5Dial, though aborts dialing should ctx be done before a connection is established.
+func SOCKS5DialContext(proxyAddr string, auth *ProxyAuth, timeout time.Duration) DialContextFunc {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialProxy(ctx, proxyAddr, addr, timeout, func(conn net.Conn) (net.Conn, error) {
+			return conn, handshakeSOCKS5(conn, auth, addr)
+		})
+	}
+}
+
+// HTTPProxyDial returns a DialFunc that dials addresses through the HTTP proxy at proxyAddr using the CONNECT method.
+// Should auth not be nil, the proxy is authenticated with using basic authentication. Connecting to the proxy and
+// having the proxy connect to the address must complete within timeout, or else ErrDialTimeout is returned. Defaults
+// to DefaultDialTimeout should timeout not be positive.
+func HTTPProxyDial(proxyAddr string, auth *ProxyAuth, timeout time.Duration) DialFunc {
+	return withoutContext(HTTPProxyDialContext(proxyAddr, auth, timeout))
+}
+
+// HTTPProxyDialContext is like HTTPProxyDial, though aborts dialing should ctx be done before a connection is
+// established.
+func HTTPProxyDialContext(proxyAddr string, auth *ProxyAuth, timeout time.Duration) DialContextFunc {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialProxy(ctx, proxyAddr, addr, timeout, func(conn net.Conn) (net.Conn, error) {
+			return handshakeHTTPProxy(conn, auth, addr)
+		})
+	}
+}
+
+func withoutContext(dial DialContextFunc) DialFunc {
+	return func(addr string) (net.Conn, error) {
+		return dial(context.Background(), addr)
+	}
+}
+
+// dialProxy connects to proxyAddr, and performs handshake over the connection to have the proxy connect to addr.
+// Both must complete within timeout, or until ctx is done. The connection is closed should the handshake fail.
+func dialProxy(ctx context.Context, proxyAddr, addr string, timeout time.Duration, handshake func(conn net.Conn) (net.Conn, error)) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	conn, err := defaultDialer.dial(ctx, proxyAddr, false, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	stop := interruptOnDone(ctx, conn)
+	pconn, err := handshake(conn)
+	stop()
+
+	if err == nil && ctx.Err() == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+
+	if err != nil || ctx.Err() != nil {
+		conn.Close()
+
+		if err := contextErr(ctx); err != nil {
+			return nil, err
+		}
+
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			return nil, ErrDialTimeout
+		}
+
+		return nil, fmt.Errorf("failed to connect to %q through proxy %q: %w", addr, proxyAddr, err)
+	}
+
+	return pconn, nil
+}
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+
+	socks5PasswordVersion = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+var socks5Replies = [...]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// handshakeSOCKS5 has the SOCKS5 proxy conn is connected to connect to addr (RFC 1928).
+func handshakeSOCKS5(conn net.Conn, auth *ProxyAuth, addr string) error {
+	host, portS, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portS, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad port %q: %w", portS, err)
+	}
+
+	buf := make([]byte, 0, 6+len(host))
+
+	// Negotiate an authentication method.
+
+	method := byte(socks5AuthNone)
+	if auth != nil {
+		method = socks5AuthPassword
+	}
+
+	if _, err = conn.Write(append(buf[:0], socks5Version, 1, method)); err != nil {
+		return err
+	}
+
+	buf = buf[:2]
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("unexpected socks version %d", buf[0])
+	}
+	if buf[1] != method {
+		return fmt.Errorf("socks proxy does not support authentication method %d", method)
+	}
+
+	// Authenticate with a username and password should they be provided (RFC 1929).
+
+	if method == socks5AuthPassword {
+		if len(auth.Username) > 255 || len(auth.Password) > 255 {
+			return errors.New("socks username and password must be at most 255 bytes")
+		}
+
+		buf = append(buf[:0], socks5PasswordVersion, byte(len(auth.Username)))
+		buf = append(buf, auth.Username...)
+		buf = append(buf, byte(len(auth.Password)))
+		buf = append(buf, auth.Password...)
+
+		if _, err = conn.Write(buf); err != nil {
+			return err
+		}
+
+		buf = buf[:2]
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return ErrProxyAuthFailed
+		}
+	}
+
+	// Request for the proxy to connect to addr.
+
+	buf = append(buf[:0], socks5Version, socks5CmdConnect, 0x00)
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, socks5AddrIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, socks5AddrIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("socks host %q must be at most 255 bytes", host)
+		}
+		buf = append(buf, socks5AddrDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+
+	buf = append(buf, byte(port>>8), byte(port))
+
+	if _, err = conn.Write(buf); err != nil {
+		return err
+	}
+
+	// Read the reply, and discard the address the proxy bound to.
+
+	buf = bytesutil.ExtendSlice(buf, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("unexpected socks version %d", buf[0])
+	}
+	if rep := buf[1]; rep != 0x00 {
+		if int(rep) < len(socks5Replies) {
+			return fmt.Errorf("socks proxy failed to connect: %s", socks5Replies[rep])
+		}
+		return fmt.Errorf("socks proxy failed to connect: unknown reply %d", rep)
+	}
+
+	var n int
+
+	switch buf[3] {
+	case socks5AddrIPv4:
+		n = net.IPv4len
+	case socks5AddrIPv6:
+		n = net.IPv6len
+	case socks5AddrDomain:
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		n = int(buf[0])
+	default:
+		return fmt.Errorf("unknown socks address type %d", buf[3])
+	}
+
+	buf = bytesutil.ExtendSlice(buf, n+2)
+	_, err = io.ReadFull(conn, buf)
+
+	return err
+}
+
+// handshakeHTTPProxy has the HTTP proxy conn is connected to connect to addr using the CONNECT method.
+func handshakeHTTPProxy(conn net.Conn, auth *ProxyAuth, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+
+	if auth != nil {
+		credentials := base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+		req += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+
+	req += "\r\n"
+
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusProxyAuthRequired:
+		return nil, ErrProxyAuthFailed
+	default:
+		return nil, fmt.Errorf("http proxy failed to connect: %s", resp.Status)
+	}
+
+	// Should the proxy have sent data past its response, have it be read before any further data from conn.
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, br: br}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose reads are served from br before being served from the net.Conn itself.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if c.br.Buffered() > 0 {
+		return c.br.Read(b)
+	}
+	return c.Conn.Read(b)
+}
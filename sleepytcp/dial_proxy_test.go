@@ -0,0 +1,217 @@
+package sleepytcp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestProxy starts a proxy stand-in that serves each accepted connection with serve.
+func newTestProxy(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// pipeConns copies data between a and b until either is closed.
+func pipeConns(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+
+	go func() { io.Copy(a, b); done <- struct{}{} }()
+	go func() { io.Copy(b, a); done <- struct{}{} }()
+
+	<-done
+}
+
+// serveSOCKS5 is a minimal SOCKS5 proxy that only supports connecting to IPv4 addresses, and authenticating with
+// auth should it not be nil.
+func serveSOCKS5(auth *ProxyAuth) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		buf := make([]byte, 512)
+
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		methods := buf[2 : 2+buf[1]]
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+
+		want := byte(socks5AuthNone)
+		if auth != nil {
+			want = socks5AuthPassword
+		}
+
+		supported := false
+		for _, method := range methods {
+			supported = supported || method == want
+		}
+		if !supported {
+			conn.Write([]byte{socks5Version, 0xFF})
+			return
+		}
+
+		conn.Write([]byte{socks5Version, want})
+
+		if auth != nil {
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return
+			}
+			username := make([]byte, buf[1])
+			if _, err := io.ReadFull(conn, username); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+				return
+			}
+			password := make([]byte, buf[0])
+			if _, err := io.ReadFull(conn, password); err != nil {
+				return
+			}
+
+			if string(username) != auth.Username || string(password) != auth.Password {
+				conn.Write([]byte{socks5PasswordVersion, 0x01})
+				return
+			}
+
+			conn.Write([]byte{socks5PasswordVersion, 0x00})
+		}
+
+		if _, err := io.ReadFull(conn, buf[:10]); err != nil || buf[3] != socks5AddrIPv4 {
+			return
+		}
+
+		addr := net.JoinHostPort(net.IP(buf[4:8]).String(), strconv.Itoa(int(buf[8])<<8|int(buf[9])))
+
+		target, err := net.Dial("tcp", addr)
+		if err != nil {
+			conn.Write([]byte{socks5Version, 0x05, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+
+		conn.Write([]byte{socks5Version, 0x00, 0x00, socks5AddrIPv4, 127, 0, 0, 1, 0, 0})
+
+		pipeConns(conn, target)
+	}
+}
+
+// serveHTTPProxy is a minimal HTTP proxy that only supports the CONNECT method, and authenticating with auth should it
+// not be nil.
+func serveHTTPProxy(auth *ProxyAuth) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+
+		if auth != nil {
+			credentials := base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+			if req.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				return
+			}
+		}
+
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer target.Close()
+
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+		pipeConns(conn, target)
+	}
+}
+
+func TestProxyDial(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	auth := &ProxyAuth{Username: "user", Password: "pass"}
+
+	tests := []struct {
+		name  string
+		dial  func(proxyAddr string, auth *ProxyAuth, timeout time.Duration) DialFunc
+		serve func(auth *ProxyAuth) func(conn net.Conn)
+	}{
+		{name: "socks5", dial: SOCKS5Dial, serve: serveSOCKS5},
+		{name: "http", dial: HTTPProxyDial, serve: serveHTTPProxy},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			for _, auth := range []*ProxyAuth{nil, auth} {
+				proxyAddr := newTestProxy(t, test.serve(auth))
+
+				c := &HostClient{Addr: addr, Dial: test.dial(proxyAddr, auth, time.Second)}
+
+				req := AcquireFrame()
+				req.SetBody([]byte("hello"))
+
+				res, err := c.Do(nil, req)
+				require.NoError(t, err)
+				require.EqualValues(t, "hello", res)
+
+				ReleaseFrame(req)
+			}
+		})
+	}
+}
+
+func TestProxyDialAuthFailed(t *testing.T) {
+	auth := &ProxyAuth{Username: "user", Password: "pass"}
+	bad := &ProxyAuth{Username: "user", Password: "wrong"}
+
+	_, err := SOCKS5Dial(newTestProxy(t, serveSOCKS5(auth)), bad, time.Second)("127.0.0.1:1")
+	require.True(t, errors.Is(err, ErrProxyAuthFailed))
+
+	_, err = HTTPProxyDial(newTestProxy(t, serveHTTPProxy(auth)), bad, time.Second)("127.0.0.1:1")
+	require.True(t, errors.Is(err, ErrProxyAuthFailed))
+}
+
+func TestProxyDialTimeout(t *testing.T) {
+	// The proxy accepts connections, but never responds.
+
+	proxyAddr := newTestProxy(t, func(conn net.Conn) { io.Copy(ioutil.Discard, conn) })
+
+	for _, dial := range []DialFunc{
+		SOCKS5Dial(proxyAddr, nil, 50*time.Millisecond),
+		HTTPProxyDial(proxyAddr, nil, 50*time.Millisecond),
+	} {
+		start := time.Now()
+
+		_, err := dial("127.0.0.1:1")
+		require.Equal(t, ErrDialTimeout, err)
+		require.Less(t, int64(time.Since(start)), int64(time.Second))
+	}
+}
@@ -68,9 +68,11 @@ func DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
 //
 //   * It reduces load on DNS resolver by caching resolved TCP addressed
 //     for DefaultDNSCacheDuration.
-//   * It dials all the resolved TCP addresses in round-robin manner until
-//     connection is established. This may be useful if certain addresses
-//     are temporarily unreachable.
+//   * It races connection attempts to the resolved TCP addresses in
+//     round-robin manner, alternating between IPv4 and IPv6 addresses and
+//     starting a new attempt every FallbackDelay until a connection is
+//     established (RFC 8305). This may be useful if certain addresses
+//     or an entire address family are temporarily unreachable.
 //   * It returns ErrDialTimeout if connection cannot be established during
 //     DefaultDialTimeout seconds. Use DialDualStackTimeout for custom dial
 //     timeout.
@@ -97,9 +99,11 @@ func DialDualStack(addr string) (net.Conn, error) {
 //
 //   * It reduces load on DNS resolver by caching resolved TCP addressed
 //     for DefaultDNSCacheDuration.
-//   * It dials all the resolved TCP addresses in round-robin manner until
-//     connection is established. This may be useful if certain addresses
-//     are temporarily unreachable.
+//   * It races connection attempts to the resolved TCP addresses in
+//     round-robin manner, alternating between IPv4 and IPv6 addresses and
+//     starting a new attempt every FallbackDelay until a connection is
+//     established (RFC 8305). This may be useful if certain addresses
+//     or an entire address family are temporarily unreachable.
 //
 // This dialer is intended for custom code wrapping before passing
 // to Client.Dial or HostClient.Dial.
@@ -153,6 +157,13 @@ type TCPDialer struct {
 	// }
 	Resolver Resolver
 
+	// FallbackDelay is the delay after which a dual-stack dial starts
+	// a connection attempt to the next resolved TCP address should the
+	// previous attempt not yet have completed, as described by
+	// RFC 8305 (Happy Eyeballs).
+	// If zero, a delay of DefaultFallbackDelay is used.
+	FallbackDelay time.Duration
+
 	tcpAddrsLock sync.Mutex
 	tcpAddrsMap  map[string]*tcpAddrEntry
 
@@ -185,7 +196,7 @@ type TCPDialer struct {
 //     * foo.bar:80
 //     * aaa.com:8080
 func (d *TCPDialer) Dial(addr string) (net.Conn, error) {
-	return d.dial(addr, false, DefaultDialTimeout)
+	return d.dial(context.Background(), addr, false, DefaultDialTimeout)
 }
 
 // DialTimeout dials the given TCP addr using tcp4 using the given timeout.
@@ -210,7 +221,7 @@ func (d *TCPDialer) Dial(addr string) (net.Conn, error) {
 //     * foo.bar:80
 //     * aaa.com:8080
 func (d *TCPDialer) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
-	return d.dial(addr, false, timeout)
+	return d.dial(context.Background(), addr, false, timeout)
 }
 
 // DialDualStack dials the given TCP addr using both tcp4 and tcp6.
@@ -219,9 +230,11 @@ func (d *TCPDialer) DialTimeout(addr string, timeout time.Duration) (net.Conn, e
 //
 //   * It reduces load on DNS resolver by caching resolved TCP addressed
 //     for DefaultDNSCacheDuration.
-//   * It dials all the resolved TCP addresses in round-robin manner until
-//     connection is established. This may be useful if certain addresses
-//     are temporarily unreachable.
+//   * It races connection attempts to the resolved TCP addresses in
+//     round-robin manner, alternating between IPv4 and IPv6 addresses and
+//     starting a new attempt every FallbackDelay until a connection is
+//     established (RFC 8305). This may be useful if certain addresses
+//     or an entire address family are temporarily unreachable.
 //   * It returns ErrDialTimeout if connection cannot be established during
 //     DefaultDialTimeout seconds. Use DialDualStackTimeout for custom dial
 //     timeout.
@@ -238,7 +251,7 @@ func (d *TCPDialer) DialTimeout(addr string, timeout time.Duration) (net.Conn, e
 //     * foo.bar:80
 //     * aaa.com:8080
 func (d *TCPDialer) DialDualStack(addr string) (net.Conn, error) {
-	return d.dial(addr, true, DefaultDialTimeout)
+	return d.dial(context.Background(), addr, true, DefaultDialTimeout)
 }
 
 // DialDualStackTimeout dials the given TCP addr using both tcp4 and tcp6
@@ -248,9 +261,11 @@ func (d *TCPDialer) DialDualStack(addr string) (net.Conn, error) {
 //
 //   * It reduces load on DNS resolver by caching resolved TCP addressed
 //     for DefaultDNSCacheDuration.
-//   * It dials all the resolved TCP addresses in round-robin manner until
-//     connection is established. This may be useful if certain addresses
-//     are temporarily unreachable.
+//   * It races connection attempts to the resolved TCP addresses in
+//     round-robin manner, alternating between IPv4 and IPv6 addresses and
+//     starting a new attempt every FallbackDelay until a connection is
+//     established (RFC 8305). This may be useful if certain addresses
+//     or an entire address family are temporarily unreachable.
 //
 // This dialer is intended for custom code wrapping before passing
 // to Client.Dial or HostClient.Dial.
@@ -264,10 +279,62 @@ func (d *TCPDialer) DialDualStack(addr string) (net.Conn, error) {
 //     * foo.bar:80
 //     * aaa.com:8080
 func (d *TCPDialer) DialDualStackTimeout(addr string, timeout time.Duration) (net.Conn, error) {
-	return d.dial(addr, true, timeout)
+	return d.dial(context.Background(), addr, true, timeout)
+}
+
+// DialContext dials the given TCP addr using tcp4, and aborts dialing
+// should ctx be done before the connection is established.
+//
+// This function has the following additional features comparing to net.Dial:
+//
+//   * It reduces load on DNS resolver by caching resolved TCP addressed
+//     for DefaultDNSCacheDuration.
+//   * It dials all the resolved TCP addresses in round-robin manner until
+//     connection is established. This may be useful if certain addresses
+//     are temporarily unreachable.
+//   * It returns ErrDialTimeout if connection cannot be established during
+//     DefaultDialTimeout seconds.
+//
+// This dialer is intended for custom code wrapping before passing
+// to Client.DialContext or HostClient.DialContext.
+//
+// The addr passed to the function must contain port. Example addr values:
+//
+//     * foobar.baz:443
+//     * foo.bar:80
+//     * aaa.com:8080
+func (d *TCPDialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	return d.dial(ctx, addr, false, DefaultDialTimeout)
+}
+
+// DialDualStackContext dials the given TCP addr using both tcp4 and tcp6,
+// and aborts dialing should ctx be done before the connection is established.
+//
+// This function has the following additional features comparing to net.Dial:
+//
+//   * It reduces load on DNS resolver by caching resolved TCP addressed
+//     for DefaultDNSCacheDuration.
+//   * It races connection attempts to the resolved TCP addresses in
+//     round-robin manner, alternating between IPv4 and IPv6 addresses and
+//     starting a new attempt every FallbackDelay until a connection is
+//     established (RFC 8305). This may be useful if certain addresses
+//     or an entire address family are temporarily unreachable.
+//   * It returns ErrDialTimeout if connection cannot be established during
+//     DefaultDialTimeout seconds.
+//
+// This dialer is intended for custom code wrapping before passing
+// to Client.DialContext or HostClient.DialContext.
+//
+// The addr passed to the function must contain port. Example addr values:
+//
+//     * foobar.baz:443
+//     * foo.bar:80
+//     * aaa.com:8080
+func (d *TCPDialer) DialDualStackContext(ctx context.Context, addr string) (net.Conn, error) {
+	return d.dial(ctx, addr, true, DefaultDialTimeout)
 }
 
-func (d *TCPDialer) dial(addr string, dualStack bool, timeout time.Duration) (net.Conn, error) {
+func (d *TCPDialer) dial(ctx context.Context, addr string, dualStack bool, timeout time.Duration) (net.Conn, error) {
 	d.once.Do(func() {
 		if d.Concurrency > 0 {
 			d.concurrencyCh = make(chan struct{}, d.Concurrency)
@@ -276,24 +343,31 @@ func (d *TCPDialer) dial(addr string, dualStack bool, timeout time.Duration) (ne
 		go d.tcpAddrsClean()
 	})
 
-	addrs, idx, err := d.getTCPAddrs(addr, dualStack)
+	addrs, idx, err := d.getTCPAddrs(ctx, addr, dualStack)
 	if err != nil {
-		return nil, err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, resolveError(addr, err)
 	}
 	network := "tcp4"
 	if dualStack {
 		network = "tcp"
 	}
 
+	deadline := time.Now().Add(timeout)
+	if dualStack && len(addrs) > 1 {
+		return d.dialParallel(ctx, network, interleaveTCPAddrs(addrs, idx), deadline)
+	}
+
 	var conn net.Conn
 	n := uint32(len(addrs))
-	deadline := time.Now().Add(timeout)
 	for n > 0 {
-		conn, err = d.tryDial(network, &addrs[idx%n], deadline, d.concurrencyCh)
+		conn, err = d.tryDial(ctx, network, &addrs[idx%n], deadline, d.concurrencyCh)
 		if err == nil {
 			return conn, nil
 		}
-		if err == ErrDialTimeout {
+		if err == ErrDialTimeout || ctx.Err() != nil {
 			return nil, err
 		}
 		idx++
@@ -302,7 +376,7 @@ func (d *TCPDialer) dial(addr string, dualStack bool, timeout time.Duration) (ne
 	return nil, err
 }
 
-func (d *TCPDialer) tryDial(network string, addr *net.TCPAddr, deadline time.Time, concurrencyCh chan struct{}) (net.Conn, error) {
+func (d *TCPDialer) tryDial(ctx context.Context, network string, addr *net.TCPAddr, deadline time.Time, concurrencyCh chan struct{}) (net.Conn, error) {
 	timeout := -time.Since(deadline)
 	if timeout <= 0 {
 		return nil, ErrDialTimeout
@@ -313,53 +387,159 @@ func (d *TCPDialer) tryDial(network string, addr *net.TCPAddr, deadline time.Tim
 		case concurrencyCh <- struct{}{}:
 		default:
 			tc := AcquireTimer(timeout)
-			isTimeout := false
+			var err error
 			select {
 			case concurrencyCh <- struct{}{}:
 			case <-tc.C:
-				isTimeout = true
+				err = ErrDialTimeout
+			case <-ctx.Done():
+				err = ctx.Err()
 			}
 			ReleaseTimer(tc)
-			if isTimeout {
-				return nil, ErrDialTimeout
+			if err != nil {
+				return nil, err
 			}
 		}
+		defer func() { <-concurrencyCh }()
+	}
+
+	dialCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	dialer := net.Dialer{}
+	if d.LocalAddr != nil {
+		dialer.LocalAddr = d.LocalAddr
+	}
+
+	conn, err := dialer.DialContext(dialCtx, network, addr.String())
+	if err != nil {
+		if err := contextErr(ctx); err != nil {
+			return nil, err
+		}
+		if contextErr(dialCtx) != nil {
+			return nil, ErrDialTimeout
+		}
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// dialParallel races connection attempts to addrs as described by RFC 8305
+// (Happy Eyeballs). Attempts are started in order of addrs, each once the
+// previous attempt has either failed or has not completed within
+// FallbackDelay. The first connection established is returned, and all
+// other attempts are aborted.
+func (d *TCPDialer) dialParallel(ctx context.Context, network string, addrs []net.TCPAddr, deadline time.Time) (net.Conn, error) {
+	fallbackDelay := d.FallbackDelay
+	if fallbackDelay <= 0 {
+		fallbackDelay = DefaultFallbackDelay
 	}
 
-	chv := dialResultChanPool.Get()
-	if chv == nil {
-		chv = make(chan dialResult, 1)
+	dialCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+
+	next, pending := 0, 0
+
+	startAttempt := func() {
+		addr := &addrs[next]
+		next++
+		pending++
+
+		go func() {
+			var dr dialResult
+			dr.conn, dr.err = d.tryDial(dialCtx, network, addr, deadline, d.concurrencyCh)
+			results <- dr
+		}()
 	}
-	ch := chv.(chan dialResult)
-	go func() {
-		var dr dialResult
-		dr.conn, dr.err = net.DialTCP(network, d.LocalAddr, addr)
-		ch <- dr
-		if concurrencyCh != nil {
-			<-concurrencyCh
+
+	startAttempt()
+
+	var firstErr error
+	for pending > 0 {
+		var (
+			timer    *time.Timer
+			fallback <-chan time.Time
+		)
+		if next < len(addrs) {
+			timer = AcquireTimer(fallbackDelay)
+			fallback = timer.C
+		}
+
+		select {
+		case <-fallback:
+			startAttempt()
+		case dr := <-results:
+			pending--
+			if dr.err == nil {
+				if timer != nil {
+					ReleaseTimer(timer)
+				}
+				cancel()
+				go closeDialResults(results, pending)
+				return dr.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = dr.err
+			}
+
+			// Start the next attempt right away should this attempt
+			// have failed for reasons other than running out of time.
+			if next < len(addrs) && dr.err != ErrDialTimeout && ctx.Err() == nil {
+				startAttempt()
+			}
+		}
+
+		if timer != nil {
+			ReleaseTimer(timer)
 		}
-	}()
-
-	var (
-		conn net.Conn
-		err  error
-	)
-
-	tc := AcquireTimer(timeout)
-	select {
-	case dr := <-ch:
-		conn = dr.conn
-		err = dr.err
-		dialResultChanPool.Put(ch)
-	case <-tc.C:
-		err = ErrDialTimeout
 	}
-	ReleaseTimer(tc)
 
-	return conn, err
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return nil, firstErr
+}
+
+// closeDialResults closes all connections established by the remaining
+// n attempts of a parallel dial that was already won by another attempt.
+func closeDialResults(results <-chan dialResult, n int) {
+	for ; n > 0; n-- {
+		if dr := <-results; dr.conn != nil {
+			dr.conn.Close()
+		}
+	}
 }
 
-var dialResultChanPool sync.Pool
+// interleaveTCPAddrs orders addrs such that their address families
+// alternate, starting with the address family of the first address, as
+// described by RFC 8305. Addresses of each address family are rotated by idx
+// such that they are dialed in round-robin manner.
+func interleaveTCPAddrs(addrs []net.TCPAddr, idx uint32) []net.TCPAddr {
+	isIPv4 := addrs[0].IP.To4() != nil
+
+	var primary, fallback []net.TCPAddr
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == isIPv4 {
+			primary = append(primary, addr)
+		} else {
+			fallback = append(fallback, addr)
+		}
+	}
+
+	interleaved := make([]net.TCPAddr, 0, len(addrs))
+	for i := 0; i < len(primary) || i < len(fallback); i++ {
+		if i < len(primary) {
+			interleaved = append(interleaved, primary[(idx+uint32(i))%uint32(len(primary))])
+		}
+		if i < len(fallback) {
+			interleaved = append(interleaved, fallback[(idx+uint32(i))%uint32(len(fallback))])
+		}
+	}
+	return interleaved
+}
 
 type dialResult struct {
 	conn net.Conn
@@ -373,6 +553,10 @@ var ErrDialTimeout = errors.New("dialing to the given TCP address timed out")
 // for establishing TCP connections.
 const DefaultDialTimeout = 3 * time.Second
 
+// DefaultFallbackDelay is the delay used by DialDualStack between staggered
+// connection attempts to the resolved TCP addresses.
+const DefaultFallbackDelay = 250 * time.Millisecond
+
 type tcpAddrEntry struct {
 	addrs    []net.TCPAddr
 	addrsIdx uint32
@@ -401,7 +585,7 @@ func (d *TCPDialer) tcpAddrsClean() {
 	}
 }
 
-func (d *TCPDialer) getTCPAddrs(addr string, dualStack bool) ([]net.TCPAddr, uint32, error) {
+func (d *TCPDialer) getTCPAddrs(ctx context.Context, addr string, dualStack bool) ([]net.TCPAddr, uint32, error) {
 	d.tcpAddrsLock.Lock()
 	e := d.tcpAddrsMap[addr]
 	if e != nil && !e.pending && time.Since(e.resolveTime) > DefaultDNSCacheDuration {
@@ -411,7 +595,7 @@ func (d *TCPDialer) getTCPAddrs(addr string, dualStack bool) ([]net.TCPAddr, uin
 	d.tcpAddrsLock.Unlock()
 
 	if e == nil {
-		addrs, err := resolveTCPAddrs(addr, dualStack, d.Resolver)
+		addrs, err := resolveTCPAddrs(ctx, addr, dualStack, d.Resolver)
 		if err != nil {
 			d.tcpAddrsLock.Lock()
 			e = d.tcpAddrsMap[addr]
@@ -436,7 +620,7 @@ func (d *TCPDialer) getTCPAddrs(addr string, dualStack bool) ([]net.TCPAddr, uin
 	return e.addrs, idx, nil
 }
 
-func resolveTCPAddrs(addr string, dualStack bool, resolver Resolver) ([]net.TCPAddr, error) {
+func resolveTCPAddrs(ctx context.Context, addr string, dualStack bool, resolver Resolver) ([]net.TCPAddr, error) {
 	host, portS, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
@@ -450,7 +634,6 @@ func resolveTCPAddrs(addr string, dualStack bool, resolver Resolver) ([]net.TCPA
 		resolver = net.DefaultResolver
 	}
 
-	ctx := context.Background()
 	ipAddrs, err := resolver.LookupIPAddr(ctx, host)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,151 @@
+//go:build linux
+// +build linux
+
+package sleepytcp
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	ips     []net.IPAddr
+	lookups int32
+}
+
+func (r *fakeResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	return r.ips, nil
+}
+
+// newBlackholedListener returns a listener bound to ip:port whose accept queue is full, such that connection attempts
+// to it hang until they time out.
+func newBlackholedListener(t *testing.T, ip net.IP, port int) {
+	t.Helper()
+
+	family, sa := syscall.AF_INET6, syscall.Sockaddr(&syscall.SockaddrInet6{Port: port})
+	if ip4 := ip.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		family, sa = syscall.AF_INET, sa4
+	} else {
+		copy(sa.(*syscall.SockaddrInet6).Addr[:], ip.To16())
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { syscall.Close(fd) })
+
+	require.NoError(t, syscall.Bind(fd, sa))
+	require.NoError(t, syscall.Listen(fd, 0))
+
+	// Fill up the accept queue until connection attempts start to hang.
+
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+
+	for i := 0; ; i++ {
+		require.Less(t, i, 16, "failed to blackhole %s", addr)
+
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			break
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+}
+
+func TestTCPDialerDialDualStackHappyEyeballs(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	// IPv6 is blackholed, and is preferred by the resolver.
+
+	if _, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip(err)
+	}
+
+	newBlackholedListener(t, net.IPv6loopback, port)
+
+	r := &fakeResolver{ips: []net.IPAddr{
+		{IP: net.IPv6loopback},
+		{IP: net.IPv6loopback},
+		{IP: net.IPv4(127, 0, 0, 1)},
+	}}
+
+	d := &TCPDialer{Resolver: r, FallbackDelay: 50 * time.Millisecond}
+
+	addr := net.JoinHostPort("peer", strconv.Itoa(port))
+
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+
+		conn, err := d.DialDualStackTimeout(addr, 5*time.Second)
+		require.NoError(t, err)
+		require.EqualValues(t, ln.Addr().String(), conn.RemoteAddr().String())
+		require.Less(t, int64(time.Since(start)), int64(time.Second))
+
+		conn.Close()
+	}
+
+	// Resolved addresses should have been cached.
+
+	require.EqualValues(t, 1, atomic.LoadInt32(&r.lookups))
+}
+
+func TestTCPDialerDialDualStackTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+
+	newBlackholedListener(t, net.IPv4(127, 0, 0, 1), port)
+
+	r := &fakeResolver{ips: []net.IPAddr{
+		{IP: net.IPv4(127, 0, 0, 1)},
+		{IP: net.IPv4(127, 0, 0, 1)},
+	}}
+
+	d := &TCPDialer{Resolver: r, FallbackDelay: 10 * time.Millisecond}
+
+	start := time.Now()
+
+	_, err = d.DialDualStackTimeout(net.JoinHostPort("peer", strconv.Itoa(port)), 200*time.Millisecond)
+	require.Equal(t, ErrDialTimeout, err)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestInterleaveTCPAddrs(t *testing.T) {
+	v4a, v4b := net.TCPAddr{IP: net.IPv4(1, 1, 1, 1)}, net.TCPAddr{IP: net.IPv4(2, 2, 2, 2)}
+	v6a, v6b := net.TCPAddr{IP: net.ParseIP("::1")}, net.TCPAddr{IP: net.ParseIP("::2")}
+
+	addrs := []net.TCPAddr{v6a, v6b, v4a, v4b}
+
+	require.EqualValues(t, []net.TCPAddr{v6a, v4a, v6b, v4b}, interleaveTCPAddrs(addrs, 0))
+	require.EqualValues(t, []net.TCPAddr{v6b, v4b, v6a, v4a}, interleaveTCPAddrs(addrs, 1))
+
+	addrs = []net.TCPAddr{v4a, v6a, v6b}
+
+	require.EqualValues(t, []net.TCPAddr{v4a, v6a, v6b}, interleaveTCPAddrs(addrs, 0))
+}
@@ -0,0 +1,125 @@
+package sleepytcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Phase is the phase of delivering a frame, or of reading its response, that an *Error occurred in.
+type Phase int
+
+const (
+	// Waiting for a connection to become available.
+	PhasePoolWait Phase = iota
+
+	// Resolving the address of the peer.
+	PhaseResolve
+
+	// Establishing a connection to the peer.
+	PhaseDial
+
+	// Performing the TLS handshake or OnConnect over a newly established connection.
+	PhaseHandshake
+
+	// Writing the frame to the peer.
+	PhaseWrite
+
+	// Reading the response to the frame from the peer.
+	PhaseRead
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhasePoolWait:
+		return "pool wait"
+	case PhaseResolve:
+		return "resolve"
+	case PhaseDial:
+		return "dial"
+	case PhaseHandshake:
+		return "handshake"
+	case PhaseWrite:
+		return "write"
+	case PhaseRead:
+		return "read"
+	default:
+		return fmt.Sprintf("Phase(%d)", int(p))
+	}
+}
+
+// Error describes a failure to deliver a frame to a peer, or to read its response. It wraps the error that caused
+// the failure, such that errors.Is(err, ErrNoFreeConns) and the like hold for it. Errors not caused by the peer, such
+// as ctx.Err() and ErrClientClosed, are returned as is rather than as an *Error.
+//
+// Error implements net.Error.
+type Error struct {
+	Addr  string
+	Phase Phase
+
+	// Whether or not the failure is transient, such that the frame may be attempted again. Frames that failed in
+	// any phase prior to PhaseWrite were never written to the peer, and may be sent to another peer regardless of
+	// whether or not they are idempotent.
+	Retryable bool
+
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Phase, e.Addr, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the failure was caused by a timeout or a deadline being exceeded.
+func (e *Error) Timeout() bool {
+	return isTimeout(e.Err)
+}
+
+// Temporary reports whether the failure is transient. It is equivalent to e.Retryable.
+func (e *Error) Temporary() bool {
+	return e.Retryable
+}
+
+// wrapError wraps err into an *Error that occurred in phase while communicating with c.Addr. Errors that are not
+// caused by the peer, and errors that already are an *Error, are returned as is.
+func (c *HostClient) wrapError(phase Phase, err error, retryable bool) error {
+	if err == nil || err == ErrClientClosed || err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+
+	return &Error{Addr: c.Addr, Phase: phase, Retryable: retryable, Err: err}
+}
+
+// readErr maps io.EOF, which is returned should the peer have closed the connection before a response started to
+// be read, to ErrConnectionClosed.
+func readErr(err error) error {
+	if errors.Is(err, io.EOF) {
+		return ErrConnectionClosed
+	}
+	return err
+}
+
+// resolveError wraps err, returned while resolving addr, into an *Error. Only temporary failures to resolve addr
+// are retryable.
+func resolveError(addr string, err error) error {
+	var dnsErr *net.DNSError
+	retryable := isTimeout(err) || (errors.As(err, &dnsErr) && dnsErr.IsTemporary)
+
+	return &Error{Addr: addr, Phase: PhaseResolve, Retryable: retryable, Err: err}
+}
+
+// unsent reports whether err denotes a failure that occurred before a frame was written to its peer.
+func unsent(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Phase < PhaseWrite
+}
@@ -0,0 +1,142 @@
+package sleepytcp
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+type errResolver struct {
+	err error
+}
+
+func (r errResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	return nil, r.err
+}
+
+func requireError(t *testing.T, err error, addr string, phase Phase, retryable bool) *Error {
+	t.Helper()
+
+	var e *Error
+	require.True(t, errors.As(err, &e), "expected *Error, got %T: %v", err, err)
+	require.EqualValues(t, addr, e.Addr)
+	require.EqualValues(t, phase, e.Phase)
+	require.EqualValues(t, retryable, e.Retryable)
+
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr))
+	require.EqualValues(t, retryable, netErr.Temporary())
+
+	return e
+}
+
+func TestErrorPhases(t *testing.T) {
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	// Resolve.
+
+	dnsErr := &net.DNSError{Err: "server misbehaving", Name: "peer", IsTemporary: true}
+
+	c := &HostClient{Addr: "peer:80", Dial: (&TCPDialer{Resolver: errResolver{err: dnsErr}}).Dial}
+
+	_, err := c.Do(nil, req)
+	requireError(t, err, "peer:80", PhaseResolve, true)
+	require.True(t, errors.Is(err, dnsErr))
+
+	// Dial.
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+
+	c = &HostClient{Addr: ln.Addr().String()}
+
+	_, err = c.Do(nil, req)
+	requireError(t, err, c.Addr, PhaseDial, true)
+
+	// Handshake.
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		if string(req.Body()) == "hang" {
+			<-ctx.Done()
+		}
+	})
+
+	errAuth := errors.New("auth failed")
+
+	c = &HostClient{Addr: addr, OnConnect: func(net.Conn) error { return errAuth }}
+
+	_, err = c.Do(nil, req)
+	requireError(t, err, addr, PhaseHandshake, false)
+	require.True(t, errors.Is(err, errAuth))
+
+	// Pool wait.
+
+	c = &HostClient{Addr: addr, MaxConns: 1}
+
+	go func() {
+		req := AcquireFrame()
+		defer ReleaseFrame(req)
+
+		req.SetBody([]byte("hang"))
+
+		c.DoContext(context.Background(), nil, req)
+	}()
+
+	require.Eventually(t, func() bool { return c.Stats().OpenConns == 1 }, time.Second, time.Millisecond)
+
+	_, err = c.Do(nil, req)
+	requireError(t, err, addr, PhasePoolWait, true)
+	require.True(t, errors.Is(err, ErrNoFreeConns))
+
+	// Read.
+
+	c = &HostClient{Addr: addr, ReadTimeout: 10 * time.Millisecond, MaxIdempotentCallAttempts: 1}
+
+	req.SetBody([]byte("hang"))
+
+	_, err = c.Do(nil, req)
+	e := requireError(t, err, addr, PhaseRead, true)
+	require.True(t, e.Timeout())
+
+	closed, _ := newClosingListener(t)
+
+	c = &HostClient{Addr: closed, MaxIdempotentCallAttempts: 1}
+
+	_, err = c.Do(nil, req)
+	requireError(t, err, closed, PhaseRead, true)
+	require.True(t, errors.Is(err, ErrConnectionClosed))
+
+	// Errors not caused by the peer should be returned as is.
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = c.DoContext(ctx, nil, req)
+	require.Equal(t, context.Canceled, err)
+
+	require.NoError(t, c.Close())
+
+	_, err = c.Do(nil, req)
+	require.Equal(t, ErrClientClosed, err)
+}
+
+func TestCanFailOverUnsent(t *testing.T) {
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	c := &HostClient{Addr: "peer:80"}
+
+	require.True(t, canFailOver(req, c.wrapError(PhaseDial, errors.New("refused"), true)))
+	require.True(t, canFailOver(req, c.wrapError(PhasePoolWait, ErrNoFreeConns, true)))
+	require.False(t, canFailOver(req, c.wrapError(PhaseWrite, errors.New("broken pipe"), true)))
+	require.False(t, canFailOver(req, c.wrapError(PhaseRead, ErrConnectionClosed, true)))
+
+	req.Idempotent = true
+
+	require.True(t, canFailOver(req, c.wrapError(PhaseRead, ErrConnectionClosed, true)))
+}
@@ -0,0 +1,265 @@
+package sleepytcp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/lithdew/bytesutil"
+	"io"
+	"math"
+)
+
+// FrameHeaderSize is the size in bytes of the header that prefixes every frame written over the wire.
+const FrameHeaderSize = 8
+
+// chunkedFrameSize is the body length a frame header denotes should the body of the frame be chunked.
+const chunkedFrameSize = math.MaxUint32
+
+const (
+	// framePushFlag is set in the request ID of a frame header should the frame have been pushed by a server
+	// unsolicited, rather than be a response to a request.
+	framePushFlag = 1 << 31
+
+	// frameCompressedFlag is set in the request ID of a frame header should the body of the frame be compressed with
+	// the codec negotiated for the connection it is sent over.
+	frameCompressedFlag = 1 << 30
+
+	// frameNegotiateFlag is set in the request ID of a frame header should the frame either offer codecs to a server,
+	// or denote the codec picked by a server.
+	frameNegotiateFlag = 1 << 29
+
+	// frameIDMask masks the bits of the request ID of a frame header that make up the request ID itself.
+	frameIDMask = frameNegotiateFlag - 1
+)
+
+// ErrBodyTooLarge is returned when a frame is read whose body exceeds the maximum allowed body size.
+var ErrBodyTooLarge = errors.New("frame body too large")
+
+// FrameHeader prefixes every frame written over the wire. A frame is laid out as a 4-byte big-endian body length,
+// a 4-byte big-endian request ID, followed by the body itself.
+//
+// Responses carry the request ID of the request they are responding to, such that responses to requests
+// multiplexed over a single connection may arrive out of order.
+//
+// Should the body length be 0xFFFFFFFF, the body is chunked. A chunked body is laid out as a sequence of chunks, each
+// prefixed with its 4-byte big-endian length, and is terminated by an empty chunk.
+//
+// The three most significant bits of the request ID are flags. From most to least significant, they denote that the
+// frame was pushed by a server unsolicited, that the body of the frame is compressed with the codec negotiated for
+// the connection, and that the frame negotiates a codec. The remaining bits make up the request ID itself.
+type FrameHeader struct {
+	size uint32
+	id   uint32
+}
+
+// chunked reports whether the body of the frame is chunked.
+func (h FrameHeader) chunked() bool {
+	return h.size == chunkedFrameSize
+}
+
+// push reports whether the frame was pushed by a server unsolicited.
+func (h FrameHeader) push() bool {
+	return h.id&framePushFlag != 0
+}
+
+// compressed reports whether the body of the frame is compressed.
+func (h FrameHeader) compressed() bool {
+	return h.id&frameCompressedFlag != 0
+}
+
+// negotiate reports whether the frame negotiates a codec.
+func (h FrameHeader) negotiate() bool {
+	return h.id&frameNegotiateFlag != 0
+}
+
+// requestID returns the request ID of the frame, stripped of its flags.
+func (h FrameHeader) requestID() uint32 {
+	return h.id & frameIDMask
+}
+
+func (h FrameHeader) AppendTo(dst []byte) []byte {
+	dst = bytesutil.AppendUint32BE(dst, h.size)
+	dst = bytesutil.AppendUint32BE(dst, h.id)
+	return dst
+}
+
+func UnmarshalFrameHeader(buf []byte) (header FrameHeader, leftover []byte, err error) {
+	if len(buf) < FrameHeaderSize {
+		return header, buf, fmt.Errorf("got %d byte(s), expected at least %d byte(s): %w",
+			len(buf),
+			FrameHeaderSize,
+			io.ErrUnexpectedEOF,
+		)
+	}
+
+	header.size, buf = bytesutil.Uint32BE(buf[:4]), buf[4:]
+	header.id, buf = bytesutil.Uint32BE(buf[:4]), buf[4:]
+
+	return header, buf, nil
+}
+
+// readFrameHeader reads and decodes a single frame header from br.
+func readFrameHeader(br *bufio.Reader) (FrameHeader, error) {
+	buf, err := br.Peek(FrameHeaderSize)
+	if err != nil {
+		if len(buf) > 0 && errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return FrameHeader{}, err
+	}
+
+	header, _, err := UnmarshalFrameHeader(buf)
+	if err != nil {
+		return header, err
+	}
+
+	if _, err = br.Discard(FrameHeaderSize); err != nil {
+		return header, err
+	}
+
+	return header, nil
+}
+
+// readFrameBody reads a frame body of the size denoted by header from br, and appends it to dst. It returns
+// ErrBodyTooLarge should the body be larger than maxBodySize bytes.
+func readFrameBody(br *bufio.Reader, header FrameHeader, dst []byte, maxBodySize int) ([]byte, error) {
+	if header.chunked() {
+		return readChunkedFrameBody(br, dst, maxBodySize)
+	}
+
+	size := int(header.size)
+
+	if maxBodySize > 0 && size > maxBodySize {
+		return dst, errBodyTooLarge(size, maxBodySize)
+	}
+
+	n := len(dst)
+	dst = bytesutil.ExtendSlice(dst, n+size)
+
+	if _, err := io.ReadFull(br, dst[n:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return dst[:n], err
+	}
+
+	return dst, nil
+}
+
+// readChunkedFrameBody reads a chunked frame body from br, and appends it to dst. It returns ErrBodyTooLarge should
+// the body be larger than maxBodySize bytes.
+func readChunkedFrameBody(br *bufio.Reader, dst []byte, maxBodySize int) ([]byte, error) {
+	n := len(dst)
+
+	for {
+		size, err := readChunkSize(br)
+		if err != nil {
+			return dst[:n], err
+		}
+
+		if size == 0 {
+			return dst, nil
+		}
+
+		if maxBodySize > 0 && len(dst)-n+size > maxBodySize {
+			return dst[:n], errBodyTooLarge(len(dst)-n+size, maxBodySize)
+		}
+
+		m := len(dst)
+		dst = bytesutil.ExtendSlice(dst, m+size)
+
+		if _, err := io.ReadFull(br, dst[m:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return dst[:n], err
+		}
+	}
+}
+
+// readChunkSize reads the length prefix of a chunk of a chunked frame body from br.
+func readChunkSize(br *bufio.Reader) (int, error) {
+	var buf [4]byte
+
+	if _, err := io.ReadFull(br, buf[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+
+	return int(bytesutil.Uint32BE(buf[:])), nil
+}
+
+// discardFrameBody discards a frame body of the size denoted by header from br.
+func discardFrameBody(br *bufio.Reader, header FrameHeader) error {
+	if !header.chunked() {
+		_, err := br.Discard(int(header.size))
+		return err
+	}
+
+	for {
+		size, err := readChunkSize(br)
+		if err != nil {
+			return err
+		}
+
+		if size == 0 {
+			return nil
+		}
+
+		if _, err = br.Discard(size); err != nil {
+			return err
+		}
+	}
+}
+
+func errBodyTooLarge(size, maxBodySize int) error {
+	return fmt.Errorf("got a %d byte(s) body, but the max body size is %d byte(s): %w",
+		size,
+		maxBodySize,
+		ErrBodyTooLarge,
+	)
+}
+
+// readDecodedFrameBody reads a frame body of the size denoted by header from br, and appends it to dst. Should the body
+// be compressed, it is decompressed with codec. It returns ErrBodyTooLarge should the body, compressed or not, be
+// larger than maxBodySize bytes.
+func readDecodedFrameBody(br *bufio.Reader, header FrameHeader, dst []byte, maxBodySize int, codec Codec) ([]byte, error) {
+	if !header.compressed() {
+		return readFrameBody(br, header, dst, maxBodySize)
+	}
+
+	if codec == nil {
+		return dst, errUnexpectedCompressedFrame
+	}
+
+	buf := frameBodyPool.Get()
+	defer frameBodyPool.Put(buf)
+
+	compressed, err := readFrameBody(br, header, buf.B[:0], maxBodySize)
+	buf.B = compressed
+	if err != nil {
+		return dst, err
+	}
+
+	return codec.Decompress(dst, compressed, maxBodySize)
+}
+
+// frameBodyWireSize returns the number of bytes a frame body of the size denoted by header, that is n bytes once
+// decoded, took over the wire.
+func frameBodyWireSize(header FrameHeader, n int) int {
+	if header.compressed() {
+		return int(header.size)
+	}
+	return n
+}
+
+// readFrame reads a single frame from br, and appends its body to dst.
+func readFrame(br *bufio.Reader, dst []byte, maxBodySize int) ([]byte, error) {
+	header, err := readFrameHeader(br)
+	if err != nil {
+		return dst, err
+	}
+	return readFrameBody(br, header, dst, maxBodySize)
+}
@@ -0,0 +1,107 @@
+package sleepytcp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/bytebufferpool"
+	"io"
+	"testing"
+	"testing/quick"
+)
+
+func TestEncodeDecodeFrameHeader(t *testing.T) {
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+
+	f := func(size, id uint32) bool {
+		header := FrameHeader{size: size, id: id}
+		recovered, leftover, err := UnmarshalFrameHeader(header.AppendTo(buf.B[:0]))
+		return assert.NoError(t, err) && assert.Len(t, leftover, 0) && assert.EqualValues(t, header, recovered)
+	}
+
+	require.NoError(t, quick.Check(f, &quick.Config{MaxCount: 1000}))
+}
+
+func TestWriteReadFrame(t *testing.T) {
+	var b bytes.Buffer
+
+	f := AcquireFrame()
+	defer ReleaseFrame(f)
+
+	bw := bufio.NewWriter(&b)
+
+	f.SetBody([]byte("hello"))
+	require.NoError(t, f.WriteTo(bw))
+
+	f.SetBody(nil)
+	require.NoError(t, f.WriteTo(bw))
+
+	f.SetBody([]byte("too large"))
+	require.NoError(t, f.WriteTo(bw))
+
+	require.NoError(t, bw.Flush())
+
+	br := bufio.NewReader(&b)
+
+	dst, err := readFrame(br, []byte("prefix:"), 16)
+	require.NoError(t, err)
+	require.EqualValues(t, "prefix:hello", dst)
+
+	dst, err = readFrame(br, nil, 16)
+	require.NoError(t, err)
+	require.Len(t, dst, 0)
+
+	_, err = readFrame(br, nil, 4)
+	require.True(t, errors.Is(err, ErrBodyTooLarge))
+}
+
+func TestWriteReadFrameBodyStream(t *testing.T) {
+	var b bytes.Buffer
+
+	f := AcquireFrame()
+	defer ReleaseFrame(f)
+
+	bw := bufio.NewWriter(&b)
+
+	body := bytes.Repeat([]byte("0123456789"), frameChunkSize/4)
+
+	f.SetBodyStream(bytes.NewReader(body), len(body))
+	require.NoError(t, f.WriteTo(bw))
+
+	f.SetBodyStream(bytes.NewReader(body), -1)
+	require.NoError(t, f.WriteTo(bw))
+
+	f.SetBodyStream(bytes.NewReader(body), -1)
+	require.NoError(t, f.WriteTo(bw))
+
+	f.SetBodyStream(bytes.NewReader(body), -1)
+	require.NoError(t, f.WriteTo(bw))
+
+	require.NoError(t, bw.Flush())
+
+	br := bufio.NewReader(&b)
+
+	dst, err := readFrame(br, nil, 0)
+	require.NoError(t, err)
+	require.EqualValues(t, body, dst)
+
+	dst, err = readFrame(br, nil, 0)
+	require.NoError(t, err)
+	require.EqualValues(t, body, dst)
+
+	header, err := readFrameHeader(br)
+	require.NoError(t, err)
+	require.True(t, header.chunked())
+	require.NoError(t, discardFrameBody(br, header))
+
+	_, err = readFrame(br, nil, len(body)-1)
+	require.True(t, errors.Is(err, ErrBodyTooLarge))
+
+	// A body stream that is shorter than its declared size should fail to be written.
+
+	f.SetBodyStream(bytes.NewReader(body), len(body)+1)
+	require.True(t, errors.Is(f.WriteTo(bw), io.ErrUnexpectedEOF))
+}
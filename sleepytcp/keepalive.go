@@ -0,0 +1,81 @@
+package sleepytcp
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const (
+	DefaultKeepAlivePeriod    = 15 * time.Second
+	DefaultIdleCheckThreshold = 1 * time.Second
+	DefaultIdlePingTimeout    = 1 * time.Second
+)
+
+// setKeepAlive enables TCP keepalives on conn with the given period, or disables them should period be negative.
+// Connections that do not support TCP keepalives, such as connections established through a custom DialFunc that
+// wrap a TCP connection, are left as is.
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	tc, ok := conn.(interface {
+		SetKeepAlive(keepalive bool) error
+		SetKeepAlivePeriod(d time.Duration) error
+	})
+	if !ok {
+		return nil
+	}
+
+	if period < 0 {
+		return tc.SetKeepAlive(false)
+	}
+
+	if period == 0 {
+		period = DefaultKeepAlivePeriod
+	}
+
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+
+	return tc.SetKeepAlivePeriod(period)
+}
+
+// validateIdleConn checks that cc is still alive before it is handed out to a caller should it have idled for at
+// least IdleCheckThreshold. Should IdlePing be set, it is sent over cc and must be responded to within
+// IdlePingTimeout. Otherwise, cc is checked with a non-blocking peek that detects whether the peer has closed it.
+// Frames pushed by the peer while cc idled do not fail the check, and are discarded by the next request sent over cc.
+func (c *HostClient) validateIdleConn(ctx context.Context, cc *clientConn) error {
+	threshold := c.IdleCheckThreshold
+	if threshold < 0 {
+		return nil
+	}
+	if threshold == 0 {
+		threshold = DefaultIdleCheckThreshold
+	}
+
+	if time.Since(cc.lastUseTime) < threshold {
+		return nil
+	}
+
+	if c.IdlePing != nil {
+		return c.pingConn(ctx, cc)
+	}
+
+	return connCheck(cc.conn)
+}
+
+// pingConn sends IdlePing over cc, and discards its response.
+func (c *HostClient) pingConn(ctx context.Context, cc *clientConn) error {
+	timeout := c.IdlePingTimeout
+	if timeout <= 0 {
+		timeout = DefaultIdlePingTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stop := interruptOnDone(ctx, cc.conn)
+	_, _, err := c.roundTrip(ctx, cc, nil, c.IdlePing)
+	stop()
+
+	return err
+}
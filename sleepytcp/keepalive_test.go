@@ -0,0 +1,196 @@
+//go:build linux
+// +build linux
+
+package sleepytcp
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHostClientKeepAlive(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	for _, period := range []time.Duration{0, 5 * time.Second, -1} {
+		var conn net.Conn
+
+		c := &HostClient{
+			Addr:            addr,
+			KeepAlivePeriod: period,
+			OnConnect:       func(c net.Conn) error { conn = c; return nil },
+		}
+
+		req := AcquireFrame()
+
+		_, err := c.Do(nil, req)
+		require.NoError(t, err)
+
+		ReleaseFrame(req)
+
+		rc, err := conn.(syscall.Conn).SyscallConn()
+		require.NoError(t, err)
+
+		var enabled, idle int
+
+		require.NoError(t, rc.Control(func(fd uintptr) {
+			enabled, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+			require.NoError(t, err)
+
+			idle, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+			require.NoError(t, err)
+		}))
+
+		switch {
+		case period < 0:
+			require.Zero(t, enabled)
+		case period == 0:
+			require.NotZero(t, enabled)
+			require.EqualValues(t, DefaultKeepAlivePeriod/time.Second, idle)
+		default:
+			require.NotZero(t, enabled)
+			require.EqualValues(t, period/time.Second, idle)
+		}
+
+		require.NoError(t, c.Close())
+	}
+}
+
+func TestHostClientValidatesIdleConns(t *testing.T) {
+	// The server closes connections as soon as they idle.
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &Server{Handler: FrameHandlerFunc(echoHandler), IdleTimeout: 10 * time.Millisecond}
+	go s.Serve(ln)
+	defer s.Close()
+
+	c := &HostClient{Addr: ln.Addr().String(), IdleCheckThreshold: time.Nanosecond}
+	defer c.Close()
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	for i := 0; i < 3; i++ {
+		req.SetBody([]byte("hello"))
+
+		res, err := c.Do(nil, req)
+		require.NoError(t, err)
+		require.EqualValues(t, "hello", res)
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// The dead connection should have been discarded before being handed out rather than failing requests.
+
+	stats := c.Stats()
+	require.EqualValues(t, 2, stats.IdleConnsDiscarded)
+	require.EqualValues(t, 3, stats.DialSuccesses)
+	require.Zero(t, stats.Retries)
+	require.Zero(t, stats.RequestFailures)
+}
+
+func TestHostClientValidatesIdleConnsWithPushes(t *testing.T) {
+	contexts := make(chan context.Context, 1)
+
+	_, addr := newTestServer(t, pushHandler(t, 0, contexts))
+
+	c := &HostClient{Addr: addr, IdleCheckThreshold: time.Nanosecond}
+	defer c.Close()
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.SetBody([]byte("hello"))
+
+	_, err := c.Do(nil, req)
+	require.NoError(t, err)
+
+	// Push a frame over the connection while it idles.
+
+	push := AcquireFrame()
+	defer ReleaseFrame(push)
+
+	push.SetBody([]byte("push"))
+	require.NoError(t, Push(<-contexts, push))
+
+	time.Sleep(10 * time.Millisecond)
+
+	// The connection should be found to be alive, and the push discarded rather than mistaken for the response.
+
+	for i := 0; i < 3; i++ {
+		res, err := c.Do(nil, req)
+		require.NoError(t, err)
+		require.EqualValues(t, "hello", res)
+
+		<-contexts
+	}
+
+	stats := c.Stats()
+	require.Zero(t, stats.IdleConnsDiscarded)
+	require.EqualValues(t, 1, stats.DialSuccesses)
+}
+
+func TestHostClientIdlePing(t *testing.T) {
+	var pings, hang int32
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		if string(req.Body()) != "ping" {
+			resp.SetBody(req.Body())
+			return
+		}
+
+		atomic.AddInt32(&pings, 1)
+
+		if atomic.LoadInt32(&hang) == 1 {
+			<-ctx.Done()
+		}
+	})
+
+	ping := AcquireFrame()
+	defer ReleaseFrame(ping)
+
+	ping.SetBody([]byte("ping"))
+
+	c := &HostClient{
+		Addr:               addr,
+		IdleCheckThreshold: time.Nanosecond,
+		IdlePing:           ping,
+		IdlePingTimeout:    50 * time.Millisecond,
+	}
+	defer c.Close()
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	for i := 0; i < 3; i++ {
+		req.SetBody([]byte("hello"))
+
+		res, err := c.Do(nil, req)
+		require.NoError(t, err)
+		require.EqualValues(t, "hello", res)
+	}
+
+	require.EqualValues(t, 2, atomic.LoadInt32(&pings))
+	require.EqualValues(t, 1, c.Stats().DialSuccesses)
+
+	// Should the peer fail to respond to the ping in time, the connection should be discarded and another should be
+	// established.
+
+	atomic.StoreInt32(&hang, 1)
+
+	req.SetBody([]byte("hello"))
+
+	res, err := c.Do(nil, req)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	require.EqualValues(t, 3, atomic.LoadInt32(&pings))
+	require.EqualValues(t, 1, c.Stats().IdleConnsDiscarded)
+	require.EqualValues(t, 2, c.Stats().DialSuccesses)
+}
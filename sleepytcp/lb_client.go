@@ -0,0 +1,148 @@
+package sleepytcp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+)
+
+// ErrNoHealthyClients is returned by LBClient should none of its clients be healthy.
+var ErrNoHealthyClients = errors.New("no healthy clients are available")
+
+// BalancingClient is a client that LBClient may balance frames across. *HostClient implements BalancingClient.
+type BalancingClient interface {
+	DoContext(ctx context.Context, dst []byte, req *Frame) ([]byte, error)
+	PendingRequests() int
+}
+
+var _ BalancingClient = (*HostClient)(nil)
+
+// LBStrategy decides which client an LBClient sends a frame through.
+type LBStrategy int
+
+const (
+	// Pick the client with the least number of pending requests.
+	LeastPending LBStrategy = iota
+
+	// Pick two clients at random, and pick the one of the two with the least number of pending requests.
+	PowerOfTwoChoices
+)
+
+// LBClient balances frames across several clients that are connected to replicas of a single logical peer.
+type LBClient struct {
+	Clients []BalancingClient
+
+	Strategy LBStrategy
+
+	// Reports whether or not a client may be picked. Defaults to skipping HostClients whose circuit breaker is
+	// open.
+	HealthCheck func(c BalancingClient) bool
+
+	// Max number of clients a frame may be attempted on. Only idempotent frames without a body stream, or frames
+	// that failed without being sent, are attempted on another client should they fail. Defaults to the number of
+	// clients.
+	MaxAttempts int
+
+	// Offset from which LeastPending starts scanning clients to break ties.
+	offset uint32
+}
+
+func (c *LBClient) Do(dst []byte, req *Frame) ([]byte, error) {
+	return c.DoContext(context.Background(), dst, req)
+}
+
+// DoContext sends req through a healthy client picked by c.Strategy, and appends the response body to dst. Should
+// the client fail to deliver req, req is failed over to another client should it be safe to do so.
+func (c *LBClient) DoContext(ctx context.Context, dst []byte, req *Frame) ([]byte, error) {
+	maxAttempts := c.MaxAttempts
+	if maxAttempts <= 0 || maxAttempts > len(c.Clients) {
+		maxAttempts = len(c.Clients)
+	}
+
+	tried := make([]bool, len(c.Clients))
+
+	err := ErrNoHealthyClients
+
+	for attempts := 0; attempts < maxAttempts; attempts++ {
+		i := c.pick(tried)
+		if i < 0 {
+			break
+		}
+		tried[i] = true
+
+		n := len(dst)
+
+		dst, err = c.Clients[i].DoContext(ctx, dst, req)
+		if err == nil || ctx.Err() != nil || !canFailOver(req, err) {
+			break
+		}
+
+		dst = dst[:n]
+	}
+
+	return dst, err
+}
+
+// canFailOver reports whether req may be sent through another client after failing with err. Frames that were never
+// written to their peer may always be sent through another client.
+func canFailOver(req *Frame, err error) bool {
+	return (req.Idempotent && !req.IsBodyStream()) || unsent(err) || errors.Is(err, ErrNoFreeConns) ||
+		errors.Is(err, ErrCircuitOpen)
+}
+
+func (c *LBClient) healthy(client BalancingClient) bool {
+	if c.HealthCheck != nil {
+		return c.HealthCheck(client)
+	}
+	if hc, ok := client.(*HostClient); ok {
+		return hc.BreakerState() != BreakerOpen
+	}
+	return true
+}
+
+// pick returns the index of a healthy client that has not been tried yet, or -1 should there be none.
+func (c *LBClient) pick(tried []bool) int {
+	candidates := make([]int, 0, len(c.Clients))
+
+	for i, client := range c.Clients {
+		if !tried[i] && c.healthy(client) {
+			candidates = append(candidates, i)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return -1
+	}
+
+	if c.Strategy == PowerOfTwoChoices {
+		if len(candidates) == 1 {
+			return candidates[0]
+		}
+
+		a := rand.Intn(len(candidates))
+		b := rand.Intn(len(candidates) - 1)
+		if b >= a {
+			b++
+		}
+
+		a, b = candidates[a], candidates[b]
+
+		if c.Clients[b].PendingRequests() < c.Clients[a].PendingRequests() {
+			return b
+		}
+		return a
+	}
+
+	offset := int(atomic.AddUint32(&c.offset, 1))
+
+	best, min := -1, 0
+	for j := range candidates {
+		i := candidates[(j+offset)%len(candidates)]
+		if pending := c.Clients[i].PendingRequests(); best < 0 || pending < min {
+			best, min = i, pending
+		}
+	}
+
+	return best
+}
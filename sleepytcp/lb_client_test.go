@@ -0,0 +1,87 @@
+package sleepytcp
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLBClientFailsOver(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	// An address nobody is listening on.
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+
+	dead := &HostClient{Addr: ln.Addr().String(), BreakerThreshold: 1}
+	alive := &HostClient{Addr: addr}
+
+	for _, strategy := range []LBStrategy{LeastPending, PowerOfTwoChoices} {
+		lb := &LBClient{Clients: []BalancingClient{dead, alive}, Strategy: strategy}
+
+		req := AcquireFrame()
+		req.Idempotent = true
+		req.SetBody([]byte("hello"))
+
+		for i := 0; i < 10; i++ {
+			res, err := lb.Do(nil, req)
+			require.NoError(t, err)
+			require.EqualValues(t, "hello", res)
+		}
+
+		ReleaseFrame(req)
+	}
+
+	// The dead client should have been skipped once its circuit breaker opened.
+
+	require.Equal(t, BreakerOpen, dead.BreakerState())
+	require.EqualValues(t, 1, dead.Stats().DialFailures)
+}
+
+type countingClient struct {
+	pending int
+	calls   int32
+}
+
+func (c *countingClient) DoContext(_ context.Context, dst []byte, _ *Frame) ([]byte, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return dst, nil
+}
+
+func (c *countingClient) PendingRequests() int {
+	return c.pending
+}
+
+func TestLBClientLeastPending(t *testing.T) {
+	busy, idle := &countingClient{pending: 10}, &countingClient{}
+
+	lb := &LBClient{Clients: []BalancingClient{busy, idle}}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	for i := 0; i < 10; i++ {
+		_, err := lb.Do(nil, req)
+		require.NoError(t, err)
+	}
+
+	require.EqualValues(t, 0, busy.calls)
+	require.EqualValues(t, 10, idle.calls)
+}
+
+func TestLBClientNoHealthyClients(t *testing.T) {
+	lb := &LBClient{
+		Clients:     []BalancingClient{&countingClient{}},
+		HealthCheck: func(BalancingClient) bool { return false },
+	}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	_, err := lb.Do(nil, req)
+	require.Equal(t, ErrNoHealthyClients, err)
+}
@@ -0,0 +1,280 @@
+package sleepytcp
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Initial number of connections an adaptively sized pool may establish.
+const DefaultAdaptiveInitialConns = 16
+
+const (
+	// Smoothing factors of the short-term and long-term moving averages of request latency.
+	poolShortLatencyAlpha = 0.1
+	poolLongLatencyAlpha  = 0.01
+
+	// Smoothing factor applied when moving the pool size towards a newly estimated size.
+	poolSizeSmoothing = 0.2
+
+	// Lower bound of the ratio of long-term to short-term latency, bounding how quickly the pool may shrink.
+	poolMinGradient = 0.5
+
+	// Bounds of the duration to stop establishing connections in the background for after failing to establish one.
+	// The duration doubles with each consecutive failure.
+	poolMinPrewarmBackoff = 100 * time.Millisecond
+	poolMaxPrewarmBackoff = 10 * time.Second
+)
+
+// poolLimiter adapts the max number of connections a HostClient may establish from observed request latency and
+// connection wait times.
+//
+// Should the short-term latency of requests rise above its long-term latency, the peer is assumed to be overloaded
+// and the pool shrinks proportionally. Should callers have had to wait for a connection, the pool grows by the
+// square root of its size such that it grows quickly while small, and cautiously while large.
+type poolLimiter struct {
+	mu sync.Mutex
+
+	// Current max number of connections. It is zero until the first observation is made.
+	limit float64
+
+	// Short-term and long-term moving averages of request latency, in nanoseconds.
+	shortLatency float64
+	longLatency  float64
+
+	// Number of callers that have had to wait for a connection which have yet to be accounted for. Each observed
+	// request accounts for one of them.
+	waits int
+}
+
+// current returns the current max number of connections, bounded by [min, max].
+func (l *poolLimiter) current(min, max int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.currentLocked(min, max))
+}
+
+func (l *poolLimiter) currentLocked(min, max int) float64 {
+	if l.limit == 0 {
+		l.limit = DefaultAdaptiveInitialConns
+	}
+	return clampFloat(l.limit, float64(min), float64(max))
+}
+
+// wait records that a caller had to wait for a connection, or was denied one.
+func (l *poolLimiter) wait() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.waits++
+}
+
+// grow raises the max number of connections by its square root should a caller have been denied a connection rather
+// than have waited for one, and reports whether the max number of connections was raised.
+func (l *poolLimiter) grow(min, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.currentLocked(min, max)
+	l.limit = clampFloat(limit+math.Sqrt(limit), float64(min), float64(max))
+
+	return int(l.limit) > int(limit)
+}
+
+// observe records the latency of a request, excluding the time spent waiting for a connection, and adapts the max
+// number of connections.
+func (l *poolLimiter) observe(latency time.Duration, min, max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.currentLocked(min, max)
+
+	sample := float64(latency)
+	if l.shortLatency == 0 {
+		l.shortLatency, l.longLatency = sample, sample
+	}
+
+	l.shortLatency += poolShortLatencyAlpha * (sample - l.shortLatency)
+	l.longLatency += poolLongLatencyAlpha * (sample - l.longLatency)
+
+	gradient := 1.0
+	if l.shortLatency > 0 {
+		gradient = clampFloat(l.longLatency/l.shortLatency, poolMinGradient, 1)
+	}
+
+	headroom := 0.0
+	if l.waits > 0 {
+		headroom = math.Sqrt(limit)
+		l.waits--
+	}
+
+	estimate := limit*gradient + headroom
+
+	l.limit = clampFloat(limit+poolSizeSmoothing*(estimate-limit), float64(min), float64(max))
+}
+
+func clampFloat(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// maxConns returns the max number of connections this client may establish. Should AdaptivePoolSize be set, it is
+// adapted between max(MinIdleConns, 1) and MaxConns.
+func (c *HostClient) maxConns() int {
+	maxConns := c.MaxConns
+	if maxConns <= 0 {
+		maxConns = DefaultMaxConnsPerHost
+	}
+
+	if !c.AdaptivePoolSize {
+		return maxConns
+	}
+
+	return c.poolLimiter.current(c.minConns(maxConns), maxConns)
+}
+
+func (c *HostClient) minConns(maxConns int) int {
+	minConns := c.MinIdleConns
+	if minConns < 1 {
+		minConns = 1
+	}
+	if minConns > maxConns {
+		minConns = maxConns
+	}
+	return minConns
+}
+
+// observeLatency reports the latency of a request to the adaptive pool limiter.
+func (c *HostClient) observeLatency(latency time.Duration) {
+	if !c.AdaptivePoolSize {
+		return
+	}
+
+	maxConns := c.MaxConns
+	if maxConns <= 0 {
+		maxConns = DefaultMaxConnsPerHost
+	}
+
+	c.poolLimiter.observe(latency, c.minConns(maxConns), maxConns)
+}
+
+// growPool raises the max number of connections this client may establish should AdaptivePoolSize be set, and reports
+// whether it was raised. It is called in place of denying a caller a connection should MaxConnWaitTimeout not be set.
+func (c *HostClient) growPool() bool {
+	if !c.AdaptivePoolSize {
+		return false
+	}
+
+	maxConns := c.MaxConns
+	if maxConns <= 0 {
+		maxConns = DefaultMaxConnsPerHost
+	}
+
+	return c.poolLimiter.grow(c.minConns(maxConns), maxConns)
+}
+
+// observeWait reports to the adaptive pool limiter that a caller had to wait for a connection, or was denied one.
+func (c *HostClient) observeWait() {
+	if c.AdaptivePoolSize {
+		c.poolLimiter.wait()
+	}
+}
+
+// Prewarm establishes connections in the background such that MinIdleConns idle connections are available before
+// the first request is sent. Otherwise, they are only established once the first request is sent.
+func (c *HostClient) Prewarm() error {
+	startCleaner := false
+
+	maxConns := c.maxConns()
+
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+
+	prewarm := c.prewarmLocked(maxConns)
+	if prewarm > 0 && !c.cleanerRunning {
+		c.cleanerRunning, startCleaner = true, true
+	}
+
+	c.mu.Unlock()
+
+	for i := 0; i < prewarm; i++ {
+		go c.prewarm()
+	}
+
+	if startCleaner {
+		go c.cleanupIdleConnections()
+	}
+
+	return nil
+}
+
+// prewarmLocked reserves connections to be established in the background such that at least MinIdleConns idle
+// connections are available, and returns the number of connections reserved. The caller must then call
+// prewarm for each of them once c.mu is unlocked.
+func (c *HostClient) prewarmLocked(maxConns int) int {
+	if c.MinIdleConns <= 0 || c.closed || c.multiplexed() || time.Now().Before(c.prewarmRetryTime) {
+		return 0
+	}
+
+	n := c.MinIdleConns - len(c.conns) - c.prewarming
+	if room := maxConns - c.count; n > room {
+		n = room
+	}
+	if n <= 0 {
+		return 0
+	}
+
+	c.count += n
+	c.prewarming += n
+
+	return n
+}
+
+// prewarm establishes a connection reserved by prewarmLocked, and either hands it to a waiting caller or pushes it to
+// the list of available idle connections. Should it fail, no connections are established in the background until
+// either a connection is established or a backoff expires, such that a peer that is down is not flooded with dials.
+func (c *HostClient) prewarm() {
+	conn, codec, err := c.dialConn(context.Background())
+
+	c.mu.Lock()
+	c.prewarming--
+	if err != nil {
+		backoff := poolMaxPrewarmBackoff
+		if c.prewarmFailures < 16 {
+			backoff = poolMinPrewarmBackoff << c.prewarmFailures
+		}
+		if backoff > poolMaxPrewarmBackoff {
+			backoff = poolMaxPrewarmBackoff
+		}
+
+		c.prewarmFailures++
+		c.prewarmRetryTime = time.Now().Add(backoff)
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		c.decrementCountOrTryDialForWaitingCaller()
+		return
+	}
+
+	c.tryRecycleClientConn(acquireClientConn(conn, codec))
+}
+
+// resetPrewarmBackoff resumes establishing connections in the background once a connection has been established.
+func (c *HostClient) resetPrewarmBackoff() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.prewarmFailures, c.prewarmRetryTime = 0, time.Time{}
+}
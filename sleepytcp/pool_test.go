@@ -0,0 +1,219 @@
+package sleepytcp
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolLimiter(t *testing.T) {
+	var l poolLimiter
+
+	require.EqualValues(t, DefaultAdaptiveInitialConns, l.current(1, 512))
+	require.EqualValues(t, 8, l.current(1, 8))
+
+	// The pool should grow while callers have to wait for connections, and latency is stable.
+
+	for i := 0; i < 100; i++ {
+		l.wait()
+		l.observe(10*time.Millisecond, 1, 512)
+	}
+
+	grown := l.current(1, 512)
+	require.Greater(t, grown, DefaultAdaptiveInitialConns)
+
+	// The pool should not grow past its max size.
+
+	for i := 0; i < 1000; i++ {
+		l.wait()
+		l.observe(10*time.Millisecond, 1, 512)
+	}
+
+	require.EqualValues(t, 512, l.current(1, 512))
+
+	// The pool should shrink should latency rise, though not past its min size.
+
+	for i := 0; i < 100; i++ {
+		l.observe(100*time.Millisecond, 4, 512)
+	}
+
+	require.Less(t, l.current(4, 512), 512)
+
+	for i := 0; i < 1000; i++ {
+		l.observe(time.Second+time.Duration(i)*time.Second, 4, 512)
+	}
+
+	require.EqualValues(t, 4, l.current(4, 512))
+}
+
+func TestHostClientAdaptivePoolSize(t *testing.T) {
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		time.Sleep(20 * time.Millisecond)
+	})
+
+	c := &HostClient{
+		Addr:               addr,
+		MaxConns:           64,
+		MaxConnWaitTimeout: time.Minute,
+		AdaptivePoolSize:   true,
+	}
+	defer c.Close()
+
+	require.EqualValues(t, DefaultAdaptiveInitialConns, c.Stats().TargetConns)
+
+	// Saturate the pool such that callers have to wait for connections.
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < DefaultAdaptiveInitialConns*2; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			req := AcquireFrame()
+			defer ReleaseFrame(req)
+
+			c.Do(nil, req)
+		}()
+	}
+
+	wg.Wait()
+
+	stats := c.Stats()
+	require.NotZero(t, stats.ConnWait.Count)
+	require.Greater(t, stats.TargetConns, DefaultAdaptiveInitialConns)
+	require.LessOrEqual(t, stats.TargetConns, 64)
+}
+
+func TestHostClientAdaptivePoolSizeNoWait(t *testing.T) {
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		time.Sleep(20 * time.Millisecond)
+	})
+
+	for _, multiplexed := range []bool{false, true} {
+		c := &HostClient{Addr: addr, MaxConns: 64, AdaptivePoolSize: true, Multiplexed: multiplexed, MaxInflightPerConn: 1}
+
+		// Without MaxConnWaitTimeout, callers past the initial max number of connections should have the pool grow
+		// rather than be denied a connection.
+
+		var wg sync.WaitGroup
+
+		errs := make(chan error, DefaultAdaptiveInitialConns*2)
+
+		for i := 0; i < DefaultAdaptiveInitialConns*2; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				req := AcquireFrame()
+				defer ReleaseFrame(req)
+
+				_, err := c.Do(nil, req)
+				errs <- err
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
+
+		stats := c.Stats()
+		require.Zero(t, stats.NoFreeConns)
+		require.Greater(t, stats.TargetConns, DefaultAdaptiveInitialConns)
+		require.LessOrEqual(t, stats.TargetConns, 64)
+
+		require.NoError(t, c.Close())
+	}
+}
+
+func TestHostClientMinIdleConns(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	c := &HostClient{Addr: addr, MinIdleConns: 3, MaxIdleConnDuration: 20 * time.Millisecond}
+	defer c.Close()
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	_, err := c.Do(nil, req)
+	require.NoError(t, err)
+
+	// Idle connections should have been established in the background.
+
+	require.Eventually(t, func() bool { return c.Stats().IdleConns >= 3 }, time.Second, time.Millisecond)
+
+	// Idle connections should not be reaped past MinIdleConns.
+
+	time.Sleep(100 * time.Millisecond)
+
+	require.Eventually(t, func() bool { return c.Stats().IdleConns == 3 }, time.Second, time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+
+	require.EqualValues(t, 3, c.Stats().IdleConns)
+}
+
+func TestHostClientPrewarm(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	c := &HostClient{Addr: addr, MinIdleConns: 3}
+	defer c.Close()
+
+	// Idle connections should be established before the first request is sent.
+
+	require.NoError(t, c.Prewarm())
+	require.Eventually(t, func() bool { return c.Stats().IdleConns == 3 }, time.Second, time.Millisecond)
+	require.EqualValues(t, 3, c.Stats().DialSuccesses)
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.SetBody([]byte("hello"))
+
+	res, err := c.Do(nil, req)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	// The first request should have been sent over a prewarmed connection, which is replaced in the background.
+
+	require.Eventually(t, func() bool { return c.Stats().IdleConns == 4 }, time.Second, time.Millisecond)
+	require.EqualValues(t, 4, c.Stats().DialSuccesses)
+
+	require.NoError(t, c.Close())
+	require.Equal(t, ErrClientClosed, c.Prewarm())
+}
+
+func TestHostClientPrewarmBackoff(t *testing.T) {
+	// Reserve an address that nothing is listening on.
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	c := &HostClient{Addr: addr, MinIdleConns: 3}
+	defer c.Close()
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	for i := 0; i < 20; i++ {
+		_, err := c.Do(nil, req)
+		require.Error(t, err)
+	}
+
+	// Once connections fail to be established in the background, requests should not start any more of them until a
+	// backoff expires.
+
+	require.Eventually(t, func() bool { return c.Stats().DialingConns == 0 }, time.Second, time.Millisecond)
+	require.Less(t, c.Stats().DialFailures, uint64(30))
+}
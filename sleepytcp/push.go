@@ -0,0 +1,88 @@
+package sleepytcp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+)
+
+// errNoServerConn is returned by Push should the context it was given not be derived from a context passed to
+// FrameHandler.ServeFrame.
+var errNoServerConn = errors.New("context was not derived from a connection served by a Server")
+
+// PushHandler handles frames pushed by a peer, unsolicited, over connections established by a HostClient. The
+// address of the peer may be retrieved with push.Addr(). push may not be retained after ServePush returns.
+//
+// ServePush is called by the goroutine reading responses off of the connection push arrived on, such that pushes
+// are handled in the order the peer sent them. Responses to requests sent over the connection are not read until
+// ServePush returns.
+type PushHandler interface {
+	ServePush(push *Frame)
+}
+
+// PushHandlerFunc is an adapter that allows ordinary functions to be used as a PushHandler.
+type PushHandlerFunc func(push *Frame)
+
+func (f PushHandlerFunc) ServePush(push *Frame) {
+	f(push)
+}
+
+type serverConnContextKey struct{}
+
+// Push writes f, unsolicited, to the client of the connection that the frame being handled with ctx arrived on. ctx
+// must be derived from a context passed to FrameHandler.ServeFrame, though may be retained to push frames after
+// ServeFrame returns for as long as the connection is open. Push fails once the connection is closed.
+//
+// The client handles f with its PushHandler, or discards f should it have none.
+func Push(ctx context.Context, f *Frame) error {
+	sc, ok := ctx.Value(serverConnContextKey{}).(*serverConn)
+	if !ok {
+		return errNoServerConn
+	}
+
+	return sc.writeFrame(f, framePushFlag)
+}
+
+// multiplexed reports whether requests are multiplexed over connections. Should PushHandler be set, connections are
+// multiplexed such that every connection has a goroutine reading frames off of it, as pushes may arrive at any time.
+func (c *HostClient) multiplexed() bool {
+	return c.Multiplexed || c.PushHandler != nil
+}
+
+// readResponseHeader reads frame headers from br until the header of a response is read. Frames pushed by the peer
+// that precede the response are read and handled in the meantime.
+func (c *HostClient) readResponseHeader(br *bufio.Reader, maxBodySize int, codec Codec) (FrameHeader, error) {
+	for {
+		header, err := readFrameHeader(br)
+		if err != nil || !header.push() {
+			return header, err
+		}
+
+		if err = c.servePush(br, header, maxBodySize, codec); err != nil {
+			return header, err
+		}
+	}
+}
+
+// servePush reads the body of a frame pushed by the peer from br, decompresses it with codec should it be compressed,
+// and handles it with PushHandler. Pushed frames are discarded should PushHandler not be set, or should their body
+// exceed maxBodySize.
+func (c *HostClient) servePush(br *bufio.Reader, header FrameHeader, maxBodySize int, codec Codec) error {
+	if c.PushHandler == nil || (!header.chunked() && maxBodySize > 0 && int(header.size) > maxBodySize) {
+		return discardFrameBody(br, header)
+	}
+
+	push := AcquireFrame()
+	defer ReleaseFrame(push)
+
+	if err := push.readBody(br, header, maxBodySize, codec); err != nil {
+		return err
+	}
+
+	c.metrics.recordTraffic(FrameHeaderSize+frameBodyWireSize(header, len(push.Body())), 0)
+
+	push.SetAddr(c.Addr)
+	c.PushHandler.ServePush(push)
+
+	return nil
+}
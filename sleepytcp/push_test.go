@@ -0,0 +1,118 @@
+package sleepytcp
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// pushHandler pushes n frames to the client before responding to each request, and hands the connection's context
+// to contexts such that more frames may be pushed afterwards.
+func pushHandler(t *testing.T, n int, contexts chan<- context.Context) FrameHandlerFunc {
+	return func(ctx context.Context, req *Frame, resp *Frame) {
+		push := AcquireFrame()
+		defer ReleaseFrame(push)
+
+		for i := 0; i < n; i++ {
+			push.SetBody([]byte("push " + strconv.Itoa(i)))
+			if err := Push(ctx, push); err != nil {
+				t.Error(err)
+			}
+		}
+
+		if contexts != nil {
+			contexts <- ctx
+		}
+
+		resp.SetBody(req.Body())
+	}
+}
+
+func TestHostClientPush(t *testing.T) {
+	contexts := make(chan context.Context, 1)
+
+	_, addr := newTestServer(t, pushHandler(t, 3, contexts))
+
+	pushes := make(chan string, 16)
+
+	c := &HostClient{
+		Addr: addr,
+		PushHandler: PushHandlerFunc(func(push *Frame) {
+			if push.Addr() != addr {
+				t.Errorf("got push from %q, expected %q", push.Addr(), addr)
+			}
+			pushes <- string(push.Body())
+		}),
+	}
+	defer c.Close()
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.SetBody([]byte("hello"))
+
+	// Pushes should be handled in order, and the response should still be routed to its caller.
+
+	res, err := c.Do(nil, req)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	for i := 0; i < 3; i++ {
+		require.EqualValues(t, "push "+strconv.Itoa(i), <-pushes)
+	}
+
+	// Frames may be pushed while the connection is idle.
+
+	ctx := <-contexts
+
+	push := AcquireFrame()
+	defer ReleaseFrame(push)
+
+	push.SetBody([]byte("later"))
+	require.NoError(t, Push(ctx, push))
+
+	select {
+	case body := <-pushes:
+		require.EqualValues(t, "later", body)
+	case <-time.After(time.Second):
+		t.Fatal("push was not handled")
+	}
+
+	// Pushing over a closed connection should fail.
+
+	require.NoError(t, c.Close())
+
+	require.Eventually(t, func() bool { return Push(ctx, push) != nil }, time.Second, time.Millisecond)
+}
+
+func TestHostClientPushDiscarded(t *testing.T) {
+	_, addr := newTestServer(t, pushHandler(t, 3, nil))
+
+	// Clients without a PushHandler should discard pushes, and still read responses.
+
+	for _, multiplexed := range []bool{false, true} {
+		c := &HostClient{Addr: addr, Multiplexed: multiplexed}
+
+		req := AcquireFrame()
+		req.SetBody([]byte("hello"))
+
+		for i := 0; i < 3; i++ {
+			res, err := c.Do(nil, req)
+			require.NoError(t, err)
+			require.EqualValues(t, "hello", res)
+		}
+
+		ReleaseFrame(req)
+
+		require.NoError(t, c.Close())
+	}
+}
+
+func TestPushWithoutServerConn(t *testing.T) {
+	push := AcquireFrame()
+	defer ReleaseFrame(push)
+
+	require.Equal(t, errNoServerConn, Push(context.Background(), push))
+}
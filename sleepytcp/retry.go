@@ -0,0 +1,109 @@
+package sleepytcp
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRetryBaseBackoff = 10 * time.Millisecond
+	DefaultRetryMaxBackoff  = 1 * time.Second
+
+	DefaultRetryBudgetRatio = 0.2
+	DefaultRetryBudgetBurst = 10
+)
+
+// RetryPolicy decides whether a frame that failed to be delivered should be retried.
+type RetryPolicy interface {
+	// Retry reports whether req should be retried after its attempts'th attempt failed with err, and how long to
+	// back off for before retrying it.
+	Retry(req *Frame, err error, attempts int) (retry bool, backoff time.Duration)
+}
+
+// RetryPolicyFunc is an adapter that allows ordinary functions to be used as a RetryPolicy.
+type RetryPolicyFunc func(req *Frame, err error, attempts int) (retry bool, backoff time.Duration)
+
+func (f RetryPolicyFunc) Retry(req *Frame, err error, attempts int) (bool, time.Duration) {
+	return f(req, err, attempts)
+}
+
+// DefaultRetryPolicy retries a frame should it either be idempotent, or should the connection it was being
+// delivered on have been closed by the peer (ErrConnectionClosed). Retries are backed off exponentially with full
+// jitter.
+type DefaultRetryPolicy struct {
+	// Backoff before the first retry. Each subsequent backoff is doubled up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+func (p *DefaultRetryPolicy) Retry(req *Frame, err error, attempts int) (bool, time.Duration) {
+	if !req.Idempotent && !errors.Is(err, ErrConnectionClosed) {
+		return false, 0
+	}
+	return true, ExponentialBackoff(p.BaseBackoff, p.MaxBackoff, attempts)
+}
+
+var defaultRetryPolicy = &DefaultRetryPolicy{}
+
+// ExponentialBackoff returns a duration picked uniformly at random between zero and min(max, base * 2^(attempts-1)).
+func ExponentialBackoff(base, max time.Duration, attempts int) time.Duration {
+	if base <= 0 {
+		base = DefaultRetryBaseBackoff
+	}
+	if max <= 0 {
+		max = DefaultRetryMaxBackoff
+	}
+
+	backoff := base
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// retryBudget caps the number of retries to a ratio of the number of requests made, such that a dead peer may not
+// trigger a storm of retries. Every request deposits ratio tokens into the budget up to burst tokens, and every
+// retry withdraws a single token from the budget.
+type retryBudget struct {
+	mu          sync.Mutex
+	tokens      float64
+	initialized bool
+}
+
+func (b *retryBudget) deposit(ratio float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.init(burst)
+
+	b.tokens += ratio
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+}
+
+func (b *retryBudget) withdraw(burst int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.init(burst)
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+func (b *retryBudget) init(burst int) {
+	if !b.initialized {
+		b.tokens, b.initialized = float64(burst), true
+	}
+}
@@ -0,0 +1,115 @@
+package sleepytcp
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	base, max := 10*time.Millisecond, 100*time.Millisecond
+
+	for attempts := 1; attempts < 10; attempts++ {
+		limit := base << uint(attempts-1)
+		if limit > max {
+			limit = max
+		}
+
+		for i := 0; i < 100; i++ {
+			backoff := ExponentialBackoff(base, max, attempts)
+			require.True(t, backoff >= 0 && backoff <= limit)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var b retryBudget
+
+	// A fresh budget allows for a burst of retries.
+
+	for i := 0; i < 10; i++ {
+		require.True(t, b.withdraw(10))
+	}
+	require.False(t, b.withdraw(10))
+
+	// Five requests at a ratio of 0.2 earns a single retry.
+
+	for i := 0; i < 5; i++ {
+		b.deposit(0.2, 10)
+	}
+	require.True(t, b.withdraw(10))
+	require.False(t, b.withdraw(10))
+}
+
+// newClosingListener returns the address of a listener that immediately closes every connection it accepts, and a
+// counter of the number of connections it has accepted.
+func newClosingListener(t *testing.T) (string, *int32) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { ln.Close() })
+
+	var accepted int32
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+
+	return ln.Addr().String(), &accepted
+}
+
+func TestHostClientRetriesAreBounded(t *testing.T) {
+	addr, accepted := newClosingListener(t)
+
+	c := &HostClient{
+		Addr:                      addr,
+		MaxIdempotentCallAttempts: 3,
+		RetryPolicy:               &DefaultRetryPolicy{BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.Idempotent = true
+
+	_, err := c.Do(nil, req)
+	require.Error(t, err)
+	require.EqualValues(t, 3, atomic.LoadInt32(accepted))
+}
+
+func TestHostClientRetryBudget(t *testing.T) {
+	addr, accepted := newClosingListener(t)
+
+	c := &HostClient{
+		Addr:             addr,
+		RetryBudgetBurst: 2,
+		RetryPolicy: RetryPolicyFunc(func(*Frame, error, int) (bool, time.Duration) {
+			return true, 0
+		}),
+	}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	// The first request may only be retried twice before the budget is exhausted. Subsequent requests may not be
+	// retried until enough requests have been made.
+
+	_, err := c.Do(nil, req)
+	require.Error(t, err)
+	require.EqualValues(t, 3, atomic.LoadInt32(accepted))
+
+	_, err = c.Do(nil, req)
+	require.Error(t, err)
+	require.EqualValues(t, 4, atomic.LoadInt32(accepted))
+}
@@ -2,11 +2,17 @@ package sleepytcp
 
 import (
 	"bufio"
+	"errors"
+	"github.com/lithdew/bytesutil"
 	"github.com/valyala/bytebufferpool"
+	"io"
 	"sync"
 	"time"
 )
 
+// Max size of each chunk a chunked frame body is written over the wire in.
+const frameChunkSize = 64 * 1024
+
 var (
 	framePool     sync.Pool
 	frameBodyPool bytebufferpool.Pool
@@ -29,14 +35,26 @@ type Frame struct {
 	// Address to send this frame to.
 	addr string
 
+	// Request ID this frame is tagged with over the wire.
+	id uint32
+
 	// Whether or not this frame may be retried if it fails to be delivered.
 	Idempotent bool
 
+	// Priority of this frame should it have to wait for a connection to become available. Callers sending frames of
+	// higher priority are handed connections first.
+	Priority int
+
 	// Total duration to wait for until we consider this frame to have timed out.
 	Timeout time.Duration
 
 	// Body of this frame.
 	body *bytebufferpool.ByteBuffer
+
+	// Stream to read the body of this frame from instead of body, and its size. The body is chunked should the size
+	// be negative.
+	bodyStream     io.Reader
+	bodyStreamSize int
 }
 
 func (r *Frame) bodyBuffer() *bytebufferpool.ByteBuffer {
@@ -53,16 +71,132 @@ func (r *Frame) bodyBytes() []byte {
 	return r.body.B
 }
 
+// WriteTo writes this frame, prefixed with its header, to dst. Should this frame have a body stream, the body is
+// read from the stream as it is written.
 func (r *Frame) WriteTo(dst *bufio.Writer) error {
+	_, err := r.writeTo(dst, r.id, nil, 0)
+	return err
+}
+
+// writeTo writes this frame to dst tagged with the request ID id, and returns the number of bytes written. Should
+// codec not be nil, and the body of this frame be at least threshold bytes, the body is written compressed with codec
+// should compressing it make it any smaller. Body streams are never compressed.
+func (r *Frame) writeTo(dst *bufio.Writer, id uint32, codec Codec, threshold int) (int, error) {
+	if r.bodyStream != nil {
+		return r.writeBodyStreamTo(dst, id)
+	}
+
 	body := r.bodyBytes()
+
+	var scratch [FrameHeaderSize]byte
+
+	header := FrameHeader{size: uint32(len(body)), id: id}
+
+	if codec != nil && len(body) > 0 && len(body) >= threshold {
+		buf := frameBodyPool.Get()
+		defer frameBodyPool.Put(buf)
+
+		compressed, err := codec.Compress(buf.B[:0], body)
+		if err != nil {
+			return 0, err
+		}
+		buf.B = compressed
+
+		if len(compressed) < len(body) {
+			body = compressed
+			header = FrameHeader{size: uint32(len(body)), id: id | frameCompressedFlag}
+		}
+	}
+
+	if _, err := dst.Write(header.AppendTo(scratch[:0])); err != nil {
+		return 0, err
+	}
+
 	if len(body) == 0 {
-		return nil
+		return FrameHeaderSize, nil
+	}
+
+	n, err := dst.Write(body)
+	return FrameHeaderSize + n, err
+}
+
+func (r *Frame) writeBodyStreamTo(dst *bufio.Writer, id uint32) (int, error) {
+	var scratch [FrameHeaderSize]byte
+
+	header := FrameHeader{size: chunkedFrameSize, id: id}
+	if r.bodyStreamSize >= 0 {
+		header.size = uint32(r.bodyStreamSize)
+	}
+
+	if _, err := dst.Write(header.AppendTo(scratch[:0])); err != nil {
+		return 0, err
+	}
+
+	// Should the size of the body be known, copy exactly that many bytes from the body stream.
+
+	if !header.chunked() {
+		n, err := io.CopyN(dst, r.bodyStream, int64(r.bodyStreamSize))
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return FrameHeaderSize + int(n), err
+	}
+
+	// Otherwise, write the body stream in chunks, each prefixed with its length, until the body stream is exhausted.
+	// The end of the body is marked by an empty chunk. Each chunk is flushed as soon as it is written such that the
+	// peer may read it while the rest of the body stream is still being produced.
+
+	buf := frameBodyPool.Get()
+	defer frameBodyPool.Put(buf)
+
+	buf.B = bytesutil.ExtendSlice(buf.B, frameChunkSize)
+
+	total := FrameHeaderSize
+
+	for {
+		n, err := r.bodyStream.Read(buf.B)
+		if n > 0 {
+			if _, werr := dst.Write(bytesutil.AppendUint32BE(scratch[:0], uint32(n))); werr != nil {
+				return total, werr
+			}
+			if _, werr := dst.Write(buf.B[:n]); werr != nil {
+				return total, werr
+			}
+			if werr := dst.Flush(); werr != nil {
+				return total, werr
+			}
+			total += 4 + n
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return total, err
+		}
 	}
-	_, err := dst.Write(body)
+
+	if _, err := dst.Write(bytesutil.AppendUint32BE(scratch[:0], 0)); err != nil {
+		return total, err
+	}
+
+	return total + 4, nil
+}
+
+// readBody reads a frame body of the size denoted by header from br into this frame's body, and decompresses it with
+// codec should it be compressed.
+func (r *Frame) readBody(br *bufio.Reader, header FrameHeader, maxBodySize int, codec Codec) error {
+	r.id = header.requestID()
+
+	buf := r.bodyBuffer()
+	b, err := readDecodedFrameBody(br, header, buf.B[:0], maxBodySize, codec)
+	buf.B = b
 	return err
 }
 
 func (r *Frame) AppendBody(b []byte) {
+	r.closeBodyStream()
+
 	buf := r.bodyBuffer()
 	buf.B = append(buf.B, b...)
 }
@@ -72,20 +206,72 @@ func (r *Frame) Body() []byte {
 }
 
 func (r *Frame) SetBody(b []byte) {
+	r.closeBodyStream()
+
 	buf := r.bodyBuffer()
 	buf.Reset()
 	buf.Write(b)
 }
 
+// SetBodyStream sets the body of this frame to be read from stream as this frame is written, replacing any body
+// that was previously set. Should size be negative, the body is written over the wire in chunks until stream returns
+// io.EOF. Otherwise, exactly size bytes are read from stream.
+//
+// stream is closed once this frame is reset should it implement io.Closer. As stream may only be read once, frames
+// with a body stream are never retried.
+func (r *Frame) SetBodyStream(stream io.Reader, size int) {
+	r.closeBodyStream()
+
+	if r.body != nil {
+		r.body.Reset()
+	}
+
+	r.bodyStream = stream
+	r.bodyStreamSize = size
+}
+
+// IsBodyStream reports whether the body of this frame is read from a body stream set by SetBodyStream.
+func (r *Frame) IsBodyStream() bool {
+	return r.bodyStream != nil
+}
+
+// BodyStream returns the body stream of this frame, or nil should it not have one. Requests received by a Server
+// whose body was sent in chunks have their body read from BodyStream rather than Body.
+func (r *Frame) BodyStream() io.Reader {
+	return r.bodyStream
+}
+
+func (r *Frame) closeBodyStream() {
+	if r.bodyStream == nil {
+		return
+	}
+
+	if closer, ok := r.bodyStream.(io.Closer); ok {
+		closer.Close()
+	}
+
+	r.bodyStream = nil
+	r.bodyStreamSize = 0
+}
+
+// Addr returns the address this frame is to be sent to, or the address of the peer that pushed this frame.
+func (r *Frame) Addr() string {
+	return r.addr
+}
+
 func (r *Frame) SetAddr(addr string) {
 	r.addr = addr
 }
 
 func (r *Frame) Reset() {
+	r.closeBodyStream()
+
 	if r.body != nil {
 		frameBodyPool.Put(r.body)
 		r.body = nil
 	}
 
+	r.id = 0
 	r.Timeout = 0
+	r.Priority = 0
 }
@@ -0,0 +1,650 @@
+package sleepytcp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultMaxServerConns     = 256 * 1024
+	DefaultMaxRequestBodySize = 16 * 1024 * 1024
+)
+
+// ErrServerClosed is returned by Server.Serve and Server.ListenAndServe after a call to Server.Shutdown or
+// Server.Close.
+var ErrServerClosed = errors.New("server closed")
+
+// ErrNoHandler is returned by Server.Serve and Server.ListenAndServe should the server not have a Handler.
+var ErrNoHandler = errors.New("server has no handler")
+
+// FrameHandler responds to frames sent by a HostClient. The handler should write its response into resp. Neither
+// req nor resp may be retained after ServeFrame returns.
+//
+// Should the body of req have been sent in chunks, it is not buffered, and is instead read by the handler from
+// req.BodyStream() as it arrives. No further frames are read from the connection req arrived on until the body stream
+// has either been read up to io.EOF, failed to be read, or been closed. The body stream is closed once the handler
+// returns.
+type FrameHandler interface {
+	ServeFrame(ctx context.Context, req *Frame, resp *Frame)
+}
+
+// FrameHandlerFunc is an adapter that allows ordinary functions to be used as a FrameHandler.
+type FrameHandlerFunc func(ctx context.Context, req *Frame, resp *Frame)
+
+func (f FrameHandlerFunc) ServeFrame(ctx context.Context, req *Frame, resp *Frame) {
+	f(ctx, req, resp)
+}
+
+type Server struct {
+	Handler FrameHandler
+
+	MaxConns int
+
+	// Max number of frames that may be concurrently handled per connection. Frames received on a connection are
+	// handled concurrently so that clients may multiplex requests over a single connection.
+	MaxInflightPerConn int
+
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Max duration to wait for the next frame to arrive on a connection. Defaults to ReadTimeout.
+	IdleTimeout time.Duration
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Max size in bytes of request bodies that are buffered whole before being handled. Request bodies sent in chunks
+	// are streamed to Handler instead, and are not limited by MaxRequestBodySize.
+	MaxRequestBodySize int
+
+	// TLS configuration to serve connections with. Connections are served over plaintext should it be nil. The TLS
+	// handshake of a connection must complete within IdleTimeout.
+	TLSConfig *tls.Config
+
+	// Codecs that clients may pick from to compress frames sent over their connection. The first codec a client
+	// offers that is in Codecs is picked. Frames are never compressed should it be empty.
+	Codecs []Codec
+
+	// Min size in bytes a response body must have for it to be compressed. Defaults to DefaultCompressionThreshold.
+	CompressionThreshold int
+
+	mu sync.Mutex
+
+	listeners map[net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+
+	// Whether or not Shutdown() or Close() has been called.
+	shuttingDown int32
+
+	readerPool sync.Pool
+	writerPool sync.Pool
+}
+
+type serverConnState int32
+
+const (
+	serverConnActive serverConnState = iota
+	serverConnIdle
+)
+
+type serverConn struct {
+	conn net.Conn
+
+	state    int32
+	inflight int32
+
+	// Protects writes to conn. bw is nil once conn is no longer being served.
+	mu sync.Mutex
+	bw *bufio.Writer
+
+	// Codec negotiated for conn, and the min size in bytes a frame body must have for it to be compressed. codec is
+	// nil should frames sent over conn not be compressed. Protected by mu.
+	codec     Codec
+	threshold int
+
+	writeTimeout time.Duration
+}
+
+func (sc *serverConn) setState(state serverConnState) {
+	atomic.StoreInt32(&sc.state, int32(state))
+}
+
+// isIdle reports whether sc is waiting for the next frame to arrive, and is not handling any frames.
+func (sc *serverConn) isIdle() bool {
+	return serverConnState(atomic.LoadInt32(&sc.state)) == serverConnIdle && atomic.LoadInt32(&sc.inflight) == 0
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections from ln and serves frames over them until either ln fails or the server is shut down.
+// Serve always closes ln before returning.
+func (s *Server) Serve(ln net.Listener) error {
+	if s.Handler == nil {
+		ln.Close()
+		return ErrNoHandler
+	}
+
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+
+	var delay time.Duration
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.closing() {
+				return ErrServerClosed
+			}
+
+			// Back off should accepting a connection temporarily fail (i.e. due to hitting a file descriptor
+			// limit). Otherwise, stop serving.
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+
+				time.Sleep(delay)
+				continue
+			}
+
+			return err
+		}
+
+		delay = 0
+
+		if s.TLSConfig != nil {
+			conn = tls.Server(conn, s.TLSConfig)
+		}
+
+		sc := &serverConn{conn: conn, threshold: s.compressionThreshold(), writeTimeout: s.WriteTimeout}
+
+		if !s.trackConn(sc, true) {
+			conn.Close()
+			continue
+		}
+
+		go s.serveConn(sc)
+	}
+}
+
+// Shutdown gracefully shuts down the server. It closes all listeners, closes all idle connections, and then waits
+// until all active connections have finished serving their current frame or until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners and connections, regardless of whether or not they are actively serving
+// frames.
+func (s *Server) Close() error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.closeListenersLocked()
+
+	for sc := range s.conns {
+		sc.conn.Close()
+		delete(s.conns, sc)
+	}
+
+	return err
+}
+
+func (s *Server) closing() bool {
+	return atomic.LoadInt32(&s.shuttingDown) != 0
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for ln := range s.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, ln)
+	}
+	return err
+}
+
+// closeIdleConns closes all idle connections and reports whether the server has no connections left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sc := range s.conns {
+		if sc.isIdle() {
+			sc.conn.Close()
+		}
+	}
+
+	return len(s.conns) == 0
+}
+
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.listeners, ln)
+		return true
+	}
+
+	if s.closing() {
+		return false
+	}
+
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+
+	return true
+}
+
+func (s *Server) trackConn(sc *serverConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, sc)
+		return true
+	}
+
+	maxConns := s.MaxConns
+	if maxConns <= 0 {
+		maxConns = DefaultMaxServerConns
+	}
+
+	if s.closing() || len(s.conns) >= maxConns {
+		return false
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]struct{})
+	}
+	s.conns[sc] = struct{}{}
+
+	return true
+}
+
+func (s *Server) serveConn(sc *serverConn) {
+	defer s.trackConn(sc, false)
+	defer sc.conn.Close()
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), serverConnContextKey{}, sc))
+	defer cancel()
+
+	br := s.acquireReader(sc.conn)
+	defer s.releaseReader(br)
+
+	// Release the writer once all frames being handled have had their responses written. Pushes made afterwards
+	// fail.
+
+	sc.bw = s.acquireWriter(sc.conn)
+	defer func() {
+		sc.mu.Lock()
+		bw := sc.bw
+		sc.bw = nil
+		sc.mu.Unlock()
+
+		s.releaseWriter(bw)
+	}()
+
+	maxBodySize := s.MaxRequestBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxRequestBodySize
+	}
+
+	maxInflight := s.MaxInflightPerConn
+	if maxInflight <= 0 {
+		maxInflight = DefaultMaxInflightPerConn
+	}
+
+	idleTimeout := s.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = s.ReadTimeout
+	}
+
+	// Slots for frames that may be concurrently handled. Wait for all frames being handled to have their responses
+	// written before closing the connection.
+
+	sem := make(chan struct{}, maxInflight)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		// Wait for a slot to handle the next frame with.
+
+		sem <- struct{}{}
+
+		// Wait for the next frame to arrive. The connection is idle until its header is fully read.
+
+		sc.setState(serverConnIdle)
+
+		if s.closing() {
+			return
+		}
+
+		if idleTimeout > 0 {
+			if err := sc.conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+				return
+			}
+		}
+
+		header, err := readFrameHeader(br)
+		if err != nil {
+			return
+		}
+
+		sc.setState(serverConnActive)
+
+		// Read request data.
+
+		if s.ReadTimeout > 0 {
+			if err := sc.conn.SetReadDeadline(time.Now().Add(s.ReadTimeout)); err != nil {
+				return
+			}
+		}
+
+		// Should the client be negotiating a codec, reply with the codec picked for the connection. Negotiation
+		// frames are never handled by Handler.
+
+		if header.negotiate() {
+			if err := s.negotiateCodec(sc, br, header); err != nil {
+				return
+			}
+			<-sem
+			continue
+		}
+
+		sc.mu.Lock()
+		codec := sc.codec
+		sc.mu.Unlock()
+
+		req := AcquireFrame()
+
+		// Should the request body be chunked, have the handler stream it from the connection rather than buffer it
+		// whole. Compressed bodies are always buffered, as they are decompressed whole.
+
+		var body *requestBodyStream
+
+		if header.chunked() && !header.compressed() {
+			body = &requestBodyStream{
+				conn:        sc.conn,
+				br:          br,
+				readTimeout: s.ReadTimeout,
+				closed:      make(chan struct{}),
+			}
+
+			req.id = header.requestID()
+			req.SetBodyStream(body, -1)
+		} else if err := req.readBody(br, header, maxBodySize, codec); err != nil {
+			ReleaseFrame(req)
+			return
+		}
+
+		// Handle the request.
+
+		atomic.AddInt32(&sc.inflight, 1)
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				atomic.AddInt32(&sc.inflight, -1)
+				<-sem
+				wg.Done()
+			}()
+
+			s.serveFrame(ctx, sc, req)
+		}()
+
+		// Wait for the handler to be done with the request body stream before reading the next frame, and discard
+		// whatever is left of the body.
+
+		if body != nil {
+			<-body.closed
+
+			if err := body.discard(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// requestBodyStream is the chunked body of a request that is read by Handler as it arrives on a connection.
+type requestBodyStream struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// Max duration to wait for each read to complete.
+	readTimeout time.Duration
+
+	// Number of bytes left to be read in the current chunk.
+	remaining int
+
+	// Error that all subsequent reads fail with. It is io.EOF once the body has been fully read, and
+	// errBodyStreamClosed should the body have been closed before being fully read.
+	err error
+
+	// Closed once the body has been fully read, has failed to be read, or has been closed. The connection may only be
+	// read from by the body until then.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *requestBodyStream) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Extend the read timeout such that it applies to each read rather than to the body as a whole.
+
+	if s.readTimeout > 0 {
+		if err := s.conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+			return 0, s.finish(err)
+		}
+	}
+
+	// Read the length of the next chunk should the current chunk have been fully read. The body ends with an empty
+	// chunk.
+
+	if s.remaining == 0 {
+		size, err := readChunkSize(s.br)
+		if err != nil {
+			return 0, s.finish(err)
+		}
+
+		if size == 0 {
+			return 0, s.finish(io.EOF)
+		}
+
+		s.remaining = size
+	}
+
+	if len(p) > s.remaining {
+		p = p[:s.remaining]
+	}
+
+	n, err := s.br.Read(p)
+	s.remaining -= n
+
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, s.finish(err)
+	}
+
+	return n, nil
+}
+
+// Close hands the connection the body is read from back to the server. Subsequent reads fail.
+func (s *requestBodyStream) Close() error {
+	s.finish(errBodyStreamClosed)
+	return nil
+}
+
+// finish fails all subsequent reads with err, and hands the connection the body is read from back to the server. It
+// returns the error that subsequent reads fail with, which is left as is should the body already be finished.
+func (s *requestBodyStream) finish(err error) error {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.closed)
+	})
+	return s.err
+}
+
+// discard discards whatever is left of the body once it has been closed such that the next frame may be read from
+// the connection. It returns an error should the body have failed to be read.
+func (s *requestBodyStream) discard() error {
+	switch s.err {
+	case io.EOF:
+		return nil
+	case errBodyStreamClosed:
+	default:
+		return s.err
+	}
+
+	if s.readTimeout > 0 {
+		if err := s.conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.br.Discard(s.remaining); err != nil {
+		return err
+	}
+
+	return discardFrameBody(s.br, FrameHeader{size: chunkedFrameSize})
+}
+
+// serveFrame handles req, and writes its response to sc. Should Handler panic, sc is closed such that frames still
+// pending on sc fail rather than wait for a response that is never written.
+func (s *Server) serveFrame(ctx context.Context, sc *serverConn, req *Frame) {
+	defer func() {
+		if r := recover(); r != nil {
+			sc.conn.Close()
+		}
+	}()
+
+	resp := AcquireFrame()
+	defer ReleaseFrame(resp)
+	defer ReleaseFrame(req)
+
+	s.Handler.ServeFrame(ctx, req, resp)
+
+	// Write response data, tagged with the request ID of the request it is responding to.
+
+	sc.writeFrame(resp, req.id)
+}
+
+// writeFrame writes f to sc tagged with the request ID id, and closes sc should writing f fail. Frames are written
+// whole such that responses and pushes never interleave.
+func (sc *serverConn) writeFrame(f *Frame, id uint32) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.bw == nil {
+		return ErrConnectionClosed
+	}
+
+	if sc.writeTimeout > 0 {
+		if err := sc.conn.SetWriteDeadline(time.Now().Add(sc.writeTimeout)); err != nil {
+			sc.conn.Close()
+			return err
+		}
+	}
+
+	_, err := f.writeTo(sc.bw, id, sc.codec, sc.threshold)
+	if err == nil {
+		err = sc.bw.Flush()
+	}
+	if err != nil {
+		sc.conn.Close()
+	}
+
+	return err
+}
+
+func (s *Server) acquireWriter(conn net.Conn) *bufio.Writer {
+	v := s.writerPool.Get()
+	if v == nil {
+		n := s.WriteBufferSize
+		if n <= 0 {
+			n = DefaultWriteBufferSize
+		}
+		return bufio.NewWriterSize(conn, n)
+	}
+	bw := v.(*bufio.Writer)
+	bw.Reset(conn)
+	return bw
+}
+
+func (s *Server) releaseWriter(bw *bufio.Writer) {
+	s.writerPool.Put(bw)
+}
+
+func (s *Server) acquireReader(conn net.Conn) *bufio.Reader {
+	v := s.readerPool.Get()
+	if v == nil {
+		n := s.ReadBufferSize
+		if n <= 0 {
+			n = DefaultReadBufferSize
+		}
+		return bufio.NewReaderSize(conn, n)
+	}
+	br := v.(*bufio.Reader)
+	br.Reset(conn)
+	return br
+}
+
+func (s *Server) releaseReader(br *bufio.Reader) {
+	s.readerPool.Put(br)
+}
@@ -0,0 +1,250 @@
+package sleepytcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, handler FrameHandlerFunc) (*Server, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &Server{Handler: handler}
+
+	go s.Serve(ln)
+
+	t.Cleanup(func() { s.Close() })
+
+	return s, ln.Addr().String()
+}
+
+func echoHandler(_ context.Context, req *Frame, resp *Frame) {
+	if req.IsBodyStream() {
+		body, _ := ioutil.ReadAll(req.BodyStream())
+		resp.SetBody(body)
+		return
+	}
+	resp.SetBody(req.Body())
+}
+
+func TestServerEcho(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	c := &HostClient{Addr: addr}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	for i := 0; i < 10; i++ {
+		req.SetBody([]byte("hello"))
+
+		res, err := c.Do(nil, req)
+		require.NoError(t, err)
+		require.EqualValues(t, "hello", res)
+	}
+
+	// All requests should have been served by a single connection.
+
+	c.mu.Lock()
+	require.EqualValues(t, 1, c.count)
+	c.mu.Unlock()
+}
+
+func TestServerShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &Server{Handler: FrameHandlerFunc(echoHandler)}
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+
+	c := &HostClient{Addr: ln.Addr().String()}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	_, err = c.Do(nil, req)
+	require.NoError(t, err)
+
+	// The client's connection is now idle, and should be closed by shutting down the server.
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, s.Shutdown(ctx))
+	require.Equal(t, ErrServerClosed, <-served)
+
+	s.mu.Lock()
+	require.Len(t, s.conns, 0)
+	s.mu.Unlock()
+}
+
+func TestServerHandlerPanic(t *testing.T) {
+	_, addr := newTestServer(t, func(_ context.Context, req *Frame, resp *Frame) {
+		if string(req.Body()) == "panic" {
+			panic("handler panicked")
+		}
+		resp.SetBody(req.Body())
+	})
+
+	c := &HostClient{Addr: addr}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	// A panicking handler should only close the connection it was serving a frame over.
+
+	req.SetBody([]byte("panic"))
+
+	_, err := c.Do(nil, req)
+	require.Error(t, err)
+
+	req.SetBody([]byte("hello"))
+
+	res, err := c.Do(nil, req)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+}
+
+func TestServerNoHandler(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &Server{}
+	require.Equal(t, ErrNoHandler, s.Serve(ln))
+
+	// The listener should have been closed.
+
+	_, err = ln.Accept()
+	require.Error(t, err)
+}
+
+func TestServerRequestBodyStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// Respond with the size of the request body, or with its first 4 bytes should they be "skip".
+
+	s := &Server{
+		MaxRequestBodySize: 1024,
+		Handler: FrameHandlerFunc(func(_ context.Context, req *Frame, resp *Frame) {
+			if !req.IsBodyStream() {
+				resp.SetBody(req.Body())
+				return
+			}
+
+			var prefix [4]byte
+			if _, err := io.ReadFull(req.BodyStream(), prefix[:]); err == nil && string(prefix[:]) == "skip" {
+				resp.SetBody(prefix[:])
+				return
+			}
+
+			n, _ := io.Copy(ioutil.Discard, req.BodyStream())
+			resp.SetBody([]byte(strconv.FormatInt(n+int64(len(prefix)), 10)))
+		}),
+	}
+
+	go s.Serve(ln)
+	defer s.Close()
+
+	c := &HostClient{Addr: ln.Addr().String()}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	// Chunked request bodies should be streamed to the handler rather than be limited by MaxRequestBodySize.
+
+	body := bytes.Repeat([]byte("0123456789"), 1024*1024)
+
+	req.SetBodyStream(bytes.NewReader(body), -1)
+
+	res, err := c.Do(nil, req)
+	require.NoError(t, err)
+	require.EqualValues(t, strconv.Itoa(len(body)), res)
+
+	// Whatever is left of a body the handler did not fully read should be discarded, and the connection reused.
+
+	req.SetBodyStream(bytes.NewReader(append([]byte("skip"), body...)), -1)
+
+	res, err = c.Do(nil, req)
+	require.NoError(t, err)
+	require.EqualValues(t, "skip", res)
+
+	req.SetBody([]byte("hello"))
+
+	res, err = c.Do(nil, req)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	c.mu.Lock()
+	require.EqualValues(t, 1, c.count)
+	c.mu.Unlock()
+}
+
+func TestServerRequestBodyStreamEOF(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	_, addr := newTestServer(t, func(_ context.Context, req *Frame, resp *Frame) {
+		if !req.IsBodyStream() {
+			resp.SetBody(req.Body())
+			return
+		}
+
+		body, _ := ioutil.ReadAll(req.BodyStream())
+		<-release
+		resp.SetBody(body)
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Send a request with a chunked body, followed by another request over the same connection.
+
+	bw := bufio.NewWriter(conn)
+
+	streamed := AcquireFrame()
+	defer ReleaseFrame(streamed)
+
+	streamed.SetBodyStream(strings.NewReader("streamed"), -1)
+
+	_, err = streamed.writeTo(bw, 1, nil, 0)
+	require.NoError(t, err)
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.SetBody([]byte("hello"))
+
+	_, err = req.writeTo(bw, 2, nil, 0)
+	require.NoError(t, err)
+	require.NoError(t, bw.Flush())
+
+	// The second request should be served once the body of the first has been read up to io.EOF, even though the
+	// handler of the first has yet to return.
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	br := bufio.NewReader(conn)
+
+	header, err := readFrameHeader(br)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, header.requestID())
+
+	body, err := readFrameBody(br, header, nil, 0)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", body)
+}
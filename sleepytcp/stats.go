@@ -0,0 +1,290 @@
+package sleepytcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the inclusive upper bounds of each bucket of a LatencyHistogram. Durations that exceed the
+// last bucket are counted in an overflow bucket.
+var LatencyBuckets = [...]time.Duration{
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram is a histogram of durations bucketed by LatencyBuckets.
+type LatencyHistogram struct {
+	// Number of durations observed per bucket. Counts[len(LatencyBuckets)] counts durations that exceed the last
+	// bucket.
+	Counts [len(LatencyBuckets) + 1]uint64
+
+	Count uint64
+	Sum   time.Duration
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+func (h *LatencyHistogram) merge(o LatencyHistogram) {
+	for i := range h.Counts {
+		h.Counts[i] += o.Counts[i]
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+}
+
+// Mean returns the mean of all observed durations.
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns the upper bound of the bucket the q'th quantile of all observed durations falls into. Durations
+// that fall into the overflow bucket are reported as the upper bound of the last bucket.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	rank := uint64(q*float64(h.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, count := range h.Counts[:len(LatencyBuckets)] {
+		if seen += count; seen >= rank {
+			return LatencyBuckets[i]
+		}
+	}
+
+	return LatencyBuckets[len(LatencyBuckets)-1]
+}
+
+// HostClientStats is a snapshot of the connections and requests of a HostClient.
+type HostClientStats struct {
+	// Connections that are established, established and idle, and pending to be established.
+	OpenConns    int
+	IdleConns    int
+	DialingConns int
+
+	// Max number of connections that may be established. It varies over time should AdaptivePoolSize be set.
+	TargetConns int
+
+	// Callers waiting for a connection to become available, and requests that are in-flight.
+	WaitingCallers  int
+	PendingRequests int
+
+	// Callers waiting for a connection to become available, keyed by the priority of the frame they are waiting to
+	// send. Priorities with no waiting callers are omitted.
+	WaitingCallersByPriority map[int]int
+
+	DialSuccesses uint64
+	DialFailures  uint64
+
+	// Requests made, requests that failed, and requests that failed as either no connection was available
+	// (ErrNoFreeConns) or as they timed out (ErrTimeout).
+	Requests        uint64
+	RequestFailures uint64
+	NoFreeConns     uint64
+	Timeouts        uint64
+	Retries         uint64
+
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// Idle connections that were closed by the idle connection cleaner, and idle connections that were closed as they
+	// were found to be dead upon being validated.
+	IdleConnsReaped    uint64
+	IdleConnsDiscarded uint64
+
+	// Latency of requests, including retries, and the time callers spent waiting for a connection to become
+	// available.
+	Latency  LatencyHistogram
+	ConnWait LatencyHistogram
+}
+
+func (s *HostClientStats) add(o HostClientStats) {
+	s.OpenConns += o.OpenConns
+	s.IdleConns += o.IdleConns
+	s.DialingConns += o.DialingConns
+	s.TargetConns += o.TargetConns
+
+	s.WaitingCallers += o.WaitingCallers
+	s.PendingRequests += o.PendingRequests
+
+	for priority, n := range o.WaitingCallersByPriority {
+		if s.WaitingCallersByPriority == nil {
+			s.WaitingCallersByPriority = make(map[int]int)
+		}
+		s.WaitingCallersByPriority[priority] += n
+	}
+
+	s.DialSuccesses += o.DialSuccesses
+	s.DialFailures += o.DialFailures
+
+	s.Requests += o.Requests
+	s.RequestFailures += o.RequestFailures
+	s.NoFreeConns += o.NoFreeConns
+	s.Timeouts += o.Timeouts
+	s.Retries += o.Retries
+
+	s.BytesRead += o.BytesRead
+	s.BytesWritten += o.BytesWritten
+
+	s.IdleConnsReaped += o.IdleConnsReaped
+	s.IdleConnsDiscarded += o.IdleConnsDiscarded
+
+	s.Latency.merge(o.Latency)
+	s.ConnWait.merge(o.ConnWait)
+}
+
+// ClientStats is a snapshot of the connections and requests of all HostClients managed by a Client.
+type ClientStats struct {
+	// Stats aggregated across all hosts.
+	Total HostClientStats
+
+	// Stats per host address.
+	Hosts map[string]HostClientStats
+}
+
+// isTimeout reports whether err was caused by a timeout or a deadline being exceeded.
+func isTimeout(err error) bool {
+	if errors.Is(err, ErrTimeout) || errors.Is(err, ErrDialTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// hostClientMetrics holds the counters that make up a HostClientStats snapshot.
+type hostClientMetrics struct {
+	mu sync.Mutex
+
+	dialSuccesses uint64
+	dialFailures  uint64
+
+	requests        uint64
+	requestFailures uint64
+	noFreeConns     uint64
+	timeouts        uint64
+	retries         uint64
+
+	bytesRead    uint64
+	bytesWritten uint64
+
+	idleConnsReaped    uint64
+	idleConnsDiscarded uint64
+
+	latency  LatencyHistogram
+	connWait LatencyHistogram
+}
+
+func (m *hostClientMetrics) recordDial(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.dialFailures++
+	} else {
+		m.dialSuccesses++
+	}
+}
+
+func (m *hostClientMetrics) recordRequest(latency time.Duration, retries int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests++
+	m.retries += uint64(retries)
+	m.latency.observe(latency)
+
+	if err == nil {
+		return
+	}
+
+	m.requestFailures++
+
+	if errors.Is(err, ErrNoFreeConns) {
+		m.noFreeConns++
+	} else if isTimeout(err) {
+		m.timeouts++
+	}
+}
+
+func (m *hostClientMetrics) recordConnWait(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.connWait.observe(d)
+}
+
+func (m *hostClientMetrics) recordTraffic(read, written int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bytesRead += uint64(read)
+	m.bytesWritten += uint64(written)
+}
+
+func (m *hostClientMetrics) recordReaped(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.idleConnsReaped += uint64(n)
+}
+
+func (m *hostClientMetrics) recordIdleConnDiscarded() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.idleConnsDiscarded++
+}
+
+func (m *hostClientMetrics) snapshot(s *HostClientStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s.DialSuccesses = m.dialSuccesses
+	s.DialFailures = m.dialFailures
+
+	s.Requests = m.requests
+	s.RequestFailures = m.requestFailures
+	s.NoFreeConns = m.noFreeConns
+	s.Timeouts = m.timeouts
+	s.Retries = m.retries
+
+	s.BytesRead = m.bytesRead
+	s.BytesWritten = m.bytesWritten
+
+	s.IdleConnsReaped = m.idleConnsReaped
+	s.IdleConnsDiscarded = m.idleConnsDiscarded
+
+	s.Latency = m.latency
+	s.ConnWait = m.connWait
+}
@@ -0,0 +1,120 @@
+package sleepytcp
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h LatencyHistogram
+
+	for i := 0; i < 90; i++ {
+		h.observe(500 * time.Microsecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.observe(time.Minute)
+	}
+
+	require.EqualValues(t, 100, h.Count)
+	require.EqualValues(t, 90, h.Counts[0])
+	require.EqualValues(t, 10, h.Counts[len(LatencyBuckets)])
+
+	require.Equal(t, time.Millisecond, h.Quantile(0.5))
+	require.Equal(t, LatencyBuckets[len(LatencyBuckets)-1], h.Quantile(0.99))
+}
+
+func TestClientStats(t *testing.T) {
+	release := make(chan struct{})
+
+	_, addr := newTestServer(t, func(ctx context.Context, req *Frame, resp *Frame) {
+		if len(req.Body()) == 0 {
+			<-release
+		}
+		resp.SetBody(req.Body())
+	})
+
+	c := &Client{MaxConnsPerHost: 1}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.SetAddr(addr)
+	req.SetBody([]byte("hello"))
+
+	_, err := c.Do(nil, req)
+	require.NoError(t, err)
+
+	stats := c.Stats()
+	require.Len(t, stats.Hosts, 1)
+	require.Equal(t, stats.Total, stats.Hosts[addr])
+
+	s := stats.Total
+	require.EqualValues(t, 1, s.OpenConns)
+	require.EqualValues(t, 1, s.IdleConns)
+	require.EqualValues(t, 1, s.DialSuccesses)
+	require.EqualValues(t, 1, s.Requests)
+	require.EqualValues(t, 1, s.Latency.Count)
+	require.EqualValues(t, FrameHeaderSize+5, s.BytesRead)
+	require.EqualValues(t, FrameHeaderSize+5, s.BytesWritten)
+
+	// Occupy the only connection, such that the next request fails due to the pool being exhausted.
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		req := AcquireFrame()
+		defer ReleaseFrame(req)
+
+		req.SetAddr(addr)
+
+		_, err := c.Do(nil, req)
+		require.NoError(t, err)
+	}()
+
+	require.Eventually(t, func() bool { return c.Stats().Total.IdleConns == 0 }, time.Second, time.Millisecond)
+
+	_, err = c.Do(nil, req)
+	require.True(t, errors.Is(err, ErrNoFreeConns))
+
+	close(release)
+	<-done
+
+	s = c.Stats().Total
+	require.EqualValues(t, 3, s.Requests)
+	require.EqualValues(t, 1, s.RequestFailures)
+	require.EqualValues(t, 1, s.NoFreeConns)
+}
+
+func TestHostClientStatsOpenConns(t *testing.T) {
+	_, addr := newTestServer(t, echoHandler)
+
+	release := make(chan struct{})
+
+	c := &HostClient{
+		Addr:         addr,
+		MinIdleConns: 2,
+		Dial: func(addr string) (net.Conn, error) {
+			<-release
+			return net.Dial("tcp", addr)
+		},
+	}
+	defer c.Close()
+
+	// Connections reserved to be established should not be counted as open.
+
+	require.NoError(t, c.Prewarm())
+	require.Zero(t, c.Stats().OpenConns)
+
+	close(release)
+
+	require.Eventually(t, func() bool { return c.Stats().OpenConns == 2 }, time.Second, time.Millisecond)
+
+	require.NoError(t, c.Close())
+	require.Zero(t, c.Stats().OpenConns)
+}
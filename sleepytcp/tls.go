@@ -0,0 +1,51 @@
+package sleepytcp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
+// tlsClientConfig returns a copy of c.TLSConfig that has its server name set to the host of c.Addr should it not
+// already be set, and that caches TLS sessions such that connections to c.Addr may resume them.
+func (c *HostClient) tlsClientConfig() *tls.Config {
+	c.tlsConfigOnce.Do(func() {
+		config := c.TLSConfig.Clone()
+
+		if config.ServerName == "" && !config.InsecureSkipVerify {
+			host, _, err := net.SplitHostPort(c.Addr)
+			if err != nil {
+				host = c.Addr
+			}
+			config.ServerName = host
+		}
+
+		if config.ClientSessionCache == nil {
+			config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		}
+
+		c.tlsConfig = config
+	})
+
+	return c.tlsConfig
+}
+
+// handshakeTLS completes a TLS handshake over conn within TLSHandshakeTimeout, or until ctx is done. conn is closed
+// should the handshake fail.
+func (c *HostClient) handshakeTLS(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	timeout := c.TLSHandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultTLSHandshakeTimeout
+	}
+
+	tlsConn := tls.Client(conn, c.tlsClientConfig())
+
+	if err := withDialDeadline(ctx, conn, timeout, tlsConn.Handshake); err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
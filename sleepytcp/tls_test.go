@@ -0,0 +1,107 @@
+package sleepytcp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newSelfSignedCert returns a self-signed certificate for 127.0.0.1, and a pool of root certificates that trusts it.
+func newSelfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sleepytcp"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestHostClientTLS(t *testing.T) {
+	cert, pool := newSelfSignedCert(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &Server{Handler: FrameHandlerFunc(echoHandler), TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	go s.Serve(ln)
+	defer s.Close()
+
+	c := &HostClient{Addr: ln.Addr().String(), TLSConfig: &tls.Config{RootCAs: pool}}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	req.SetBody([]byte("hello"))
+
+	for i := 0; i < 2; i++ {
+		res, err := c.Do(nil, req)
+		require.NoError(t, err)
+		require.EqualValues(t, "hello", res)
+
+		// Pooled connections should keep their TLS state. Connections established after the first should resume the
+		// TLS session of the first.
+
+		c.mu.Lock()
+		require.Len(t, c.conns, 1)
+		cc := c.conns[0]
+		c.conns = c.conns[:0]
+		c.mu.Unlock()
+
+		state := cc.conn.(*tls.Conn).ConnectionState()
+		require.True(t, state.HandshakeComplete)
+		require.Equal(t, i > 0, state.DidResume)
+
+		c.destroyClientConn(cc)
+	}
+}
+
+func TestHostClientTLSHandshakeTimeout(t *testing.T) {
+	// A listener that never completes a TLS handshake.
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	c := &HostClient{
+		Addr:                ln.Addr().String(),
+		TLSConfig:           &tls.Config{InsecureSkipVerify: true},
+		TLSHandshakeTimeout: 50 * time.Millisecond,
+	}
+
+	req := AcquireFrame()
+	defer ReleaseFrame(req)
+
+	_, err = c.Do(nil, req)
+	require.Error(t, err)
+	require.True(t, isTimeout(err))
+	require.EqualValues(t, 1, c.Stats().DialFailures)
+}